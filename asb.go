@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// GS a n: enable Automatic Status Back for drawer kick pin (bit 0),
+// online/offline (bit 1), errors (bit 2) and roll paper sensor (bit 3)
+var ENABLE_ASB_CMD = []byte{0x1d, 0x61, 0x0f}
+
+// GS a 0: disable Automatic Status Back
+var DISABLE_ASB_CMD = []byte{0x1d, 0x61, 0x00}
+
+// ASB_POLL_INTERVAL bounds each read in the ASB reader so it notices Close
+// promptly.
+const ASB_POLL_INTERVAL = 500 * time.Millisecond
+
+// asbMonitor holds the most recent status pushed by the printer
+type asbMonitor struct {
+	mu      sync.Mutex
+	enabled bool
+	known   bool
+	status  PrinterStatus
+	updated time.Time
+	stop    chan struct{}
+}
+
+// isASBHeader checks the fixed bits of the first ASB byte: bit 4 set,
+// bits 0, 1 and 7 clear.
+func isASBHeader(b byte) bool {
+	return b&0x93 == 0x10
+}
+
+// isASBTrailer checks the fixed bits of ASB bytes 2-4: bits 4 and 7 clear
+func isASBTrailer(b byte) bool {
+	return b&0x90 == 0x00
+}
+
+// decodeASB decodes a 4-byte Automatic Status Back message
+func decodeASB(msg [4]byte) PrinterStatus {
+	return PrinterStatus{
+		DrawerKick:         msg[0]&0x04 != 0,
+		Offline:            msg[0]&0x08 != 0,
+		CoverOpen:          msg[0]&0x20 != 0,
+		PaperFeed:          msg[0]&0x40 != 0,
+		MechanicalError:    msg[1]&0x04 != 0,
+		AutoCutterError:    msg[1]&0x08 != 0,
+		UnrecoverableError: msg[1]&0x20 != 0,
+		AutoRecoverError:   msg[1]&0x40 != 0,
+		ReceiptNearEnd:     msg[2]&0x03 != 0,
+		ReceiptEnd:         msg[2]&0x0c != 0,
+	}
+}
+
+// EnableASB turns on Automatic Status Back and starts a background reader
+// that keeps the printer's cached status current. ASB is re-enabled every
+// time the connection is reopened.
+func (p *Printer) EnableASB() error {
+	reader, ok := p.connection.(Readable)
+	if !ok {
+		return ErrStatusUnsupported
+	}
+
+	p.asb.mu.Lock()
+	if p.asb.enabled {
+		p.asb.mu.Unlock()
+		return nil
+	}
+	p.asb.enabled = true
+	p.asb.stop = make(chan struct{})
+	stop := p.asb.stop
+	p.asb.mu.Unlock()
+
+	log.Printf("[ASB] Enabling Automatic Status Back on %s", p.connection_string)
+	if err := p.connection.WriteRaw(ENABLE_ASB_CMD); err != nil {
+		log.Printf("[ASB] WARNING: Failed to send GS a, will retry on reconnect: %v", err)
+	}
+
+	go p.asbLoop(reader, stop)
+	return nil
+}
+
+func (p *Printer) asbEnabled() bool {
+	p.asb.mu.Lock()
+	defer p.asb.mu.Unlock()
+	return p.asb.enabled
+}
+
+// afterOpen restores per-connection printer state after a (re)connect
+func (p *Printer) afterOpen() {
+	if !p.asbEnabled() {
+		return
+	}
+	log.Printf("[ASB] Connection reopened, re-enabling Automatic Status Back")
+	if err := p.connection.WriteRaw(ENABLE_ASB_CMD); err != nil {
+		log.Printf("[ASB] WARNING: Failed to re-enable ASB: %v", err)
+	}
+}
+
+// DisableASB turns Automatic Status Back off on the printer and stops the
+// background reader. Status is queried with DLE EOT again afterwards.
+func (p *Printer) DisableASB() error {
+	if !p.asbEnabled() {
+		return nil
+	}
+	p.stopASB()
+
+	log.Printf("[ASB] Disabling Automatic Status Back on %s", p.connection_string)
+	if err := p.connection.WriteRaw(DISABLE_ASB_CMD); err != nil {
+		return fmt.Errorf("failed to disable ASB: %w", err)
+	}
+	return nil
+}
+
+// stopASB stops the background reader, if running, and forgets the last
+// pushed status so it is not mistaken for a current one.
+func (p *Printer) stopASB() {
+	p.asb.mu.Lock()
+	defer p.asb.mu.Unlock()
+	if p.asb.stop != nil {
+		close(p.asb.stop)
+		p.asb.stop = nil
+	}
+	p.asb.enabled = false
+	p.asb.known = false
+}
+
+func (p *Printer) asbLoop(reader Readable, stop chan struct{}) {
+	log.Printf("[ASB] Status reader started for %s", p.connection_string)
+	buf := make([]byte, 4)
+
+	for {
+		select {
+		case <-stop:
+			log.Printf("[ASB] Status reader stopped for %s", p.connection_string)
+			return
+		default:
+		}
+
+		// Sync on a header byte first so a stray byte never shifts the
+		// 4-byte framing.
+		_, err := ReadFull(reader, buf[:1], ASB_POLL_INTERVAL)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if errors.Is(err, ErrReadUnsupported) {
+			log.Printf("[ASB] Connection cannot be read, status reader exiting")
+			return
+		}
+		if err != nil {
+			time.Sleep(ASB_POLL_INTERVAL)
+			continue
+		}
+		if !isASBHeader(buf[0]) {
+			log.Printf("[ASB] Discarding unexpected byte 0x%02x", buf[0])
+			continue
+		}
+
+		if _, err := ReadFull(reader, buf[1:], p.statusTimeout); err != nil {
+			log.Printf("[ASB] WARNING: Incomplete status message: %v", err)
+			continue
+		}
+		if !isASBTrailer(buf[1]) || !isASBTrailer(buf[2]) || !isASBTrailer(buf[3]) {
+			log.Printf("[ASB] Discarding malformed status message %x", buf)
+			continue
+		}
+
+		status := decodeASB([4]byte(buf))
+		p.asb.mu.Lock()
+		p.asb.status = status
+		p.asb.known = true
+		p.asb.updated = time.Now()
+		p.asb.mu.Unlock()
+		log.Printf("[ASB] Status update from %s: %+v (asb=0x%08x, code=%q)",
+			p.connection_string, status, status.ASB(), status.Code())
+	}
+}
+
+// CachedStatus returns the last status pushed by the printer over ASB and
+// when it arrived. ok is false until the first ASB message is received.
+func (p *Printer) CachedStatus() (status PrinterStatus, updated time.Time, ok bool) {
+	p.asb.mu.Lock()
+	defer p.asb.mu.Unlock()
+	return p.asb.status, p.asb.updated, p.asb.known
+}
+
+// waitCachedStatus waits up to timeout for the first ASB message
+func (p *Printer) waitCachedStatus(timeout time.Duration) (PrinterStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if status, _, ok := p.CachedStatus(); ok {
+			return status, nil
+		}
+		if time.Now().After(deadline) {
+			return PrinterStatus{}, ErrStatusTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
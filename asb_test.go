@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDecodeASB(t *testing.T) {
+	// Cover open and offline, autocutter error, paper end
+	status := decodeASB([4]byte{0x38, 0x08, 0x0c, 0x00})
+
+	expected := PrinterStatus{
+		Offline:         true,
+		CoverOpen:       true,
+		AutoCutterError: true,
+		ReceiptEnd:      true,
+	}
+	if status != expected {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestASBFraming(t *testing.T) {
+	if !isASBHeader(0x10) || !isASBHeader(0x3c) {
+		t.Error("expected valid ASB header bytes to be accepted")
+	}
+	if isASBHeader(0x12) {
+		t.Error("DLE EOT response byte must not be taken as an ASB header")
+	}
+	if isASBTrailer(0x10) || isASBTrailer(0x80) {
+		t.Error("expected trailer bytes with bit 4 or 7 set to be rejected")
+	}
+}
+
+func waitForStatus(t *testing.T, p *Printer, match func(PrinterStatus) bool) PrinterStatus {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, _, ok := p.CachedStatus(); ok && match(status) {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for ASB status update")
+	return PrinterStatus{}
+}
+
+func TestEnableASB_TracksStatus(t *testing.T) {
+	conn := &FakeConnection{}
+	printer := createFakePrinter(conn)
+	defer printer.Close()
+
+	// A stray byte ahead of the message must be skipped
+	conn.Feed([]byte{0xff, 0x10, 0x00, 0x00, 0x00})
+
+	if err := printer.EnableASB(); err != nil {
+		t.Fatalf("EnableASB failed: %v", err)
+	}
+	if !bytes.Equal(conn.Written, ENABLE_ASB_CMD) {
+		t.Errorf("EnableASB sent wrong bytes. Got %v, expected %v", conn.Written, ENABLE_ASB_CMD)
+	}
+
+	waitForStatus(t, printer, func(s PrinterStatus) bool { return s == PrinterStatus{} })
+
+	conn.Feed([]byte{0x30, 0x00, 0x00, 0x00})
+	status := waitForStatus(t, printer, func(s PrinterStatus) bool { return s.CoverOpen })
+
+	if status.Code() != EPTR_COVER_OPEN {
+		t.Errorf("expected EPTR_COVER_OPEN, got %q", status.Code())
+	}
+
+	// QueryStatus must use the cached value instead of sending DLE EOT
+	written := len(conn.Written)
+	queried, err := printer.QueryStatus()
+	if err != nil {
+		t.Fatalf("QueryStatus failed: %v", err)
+	}
+	if !queried.CoverOpen {
+		t.Errorf("expected QueryStatus to report cover open, got %+v", queried)
+	}
+	if len(conn.Written) != written {
+		t.Errorf("expected no status query bytes with ASB enabled, got %v", conn.Written[written:])
+	}
+}
+
+func TestEnableASB_ReenabledAfterReopen(t *testing.T) {
+	conn := &FakeConnection{}
+	printer := createFakePrinter(conn)
+	defer printer.Close()
+
+	if err := printer.EnableASB(); err != nil {
+		t.Fatalf("EnableASB failed: %v", err)
+	}
+
+	conn.mu.Lock()
+	conn.Written = nil
+	conn.mu.Unlock()
+
+	printer.afterOpen()
+
+	if !bytes.Equal(conn.Written, ENABLE_ASB_CMD) {
+		t.Errorf("expected GS a after reopen, got %v", conn.Written)
+	}
+}
+
+func TestEnableASB_WriteOnlyConnection(t *testing.T) {
+	printer := &Printer{connection_string: "/test", connection: &MockWritable{}}
+
+	if err := printer.EnableASB(); err != ErrStatusUnsupported {
+		t.Errorf("expected ErrStatusUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+type BarcodeDecoded struct {
+	Type   string
+	Data   []byte
+	HRI    string
+	Font   string
+	Width  int
+	Height int
+}
+
+type barcodeSymbology struct {
+	// code is the GS k function B symbology selector (m)
+	code     byte
+	validate func(data string) error
+}
+
+var barcodeSymbologies = map[string]barcodeSymbology{
+	"upc_a":                       {code: 65, validate: validateUPCA},
+	"upc_e":                       {code: 66, validate: validateUPCE},
+	"ean13":                       {code: 67, validate: validateEAN13},
+	"jan13":                       {code: 67, validate: validateEAN13},
+	"ean8":                        {code: 68, validate: validateEAN8},
+	"jan8":                        {code: 68, validate: validateEAN8},
+	"code39":                      {code: 69, validate: validateCode39},
+	"itf":                         {code: 70, validate: validateITF},
+	"codabar":                     {code: 71, validate: validateCodabar},
+	"code93":                      {code: 72, validate: validateASCII},
+	"code128":                     {code: 73, validate: validateCode128},
+	"gs1_128":                     {code: 74, validate: validatePrintableASCII},
+	"gs1_databar_omnidirectional": {code: 75, validate: validateDataBar},
+	"gs1_databar_truncated":       {code: 76, validate: validateDataBar},
+	"gs1_databar_limited":         {code: 77, validate: validateDataBarLimited},
+	"gs1_databar_expanded":        {code: 78, validate: validatePrintableASCII},
+}
+
+var BARCODE_HRI_CODES = map[string]byte{
+	"none":  0,
+	"above": 1,
+	"below": 2,
+	"both":  3,
+}
+
+var BARCODE_FONT_CODES = map[string]byte{
+	"font_a": 0,
+	"font_b": 1,
+	"font_c": 2,
+	"font_d": 3,
+	"font_e": 4,
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// gtinCheckDigit computes the GS1 mod-10 check digit for the given digits,
+// which must not include the check digit itself.
+func gtinCheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			sum += d * 3
+		} else {
+			sum += d
+		}
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// validateGTIN checks a numeric barcode that is either dataLen digits long
+// (printer computes the check digit) or dataLen+1 digits with a check digit.
+func validateGTIN(name string, data string, dataLen int) error {
+	if !isDigits(data) {
+		return fmt.Errorf("%s data must be numeric: %q", name, data)
+	}
+	switch len(data) {
+	case dataLen:
+		return nil
+	case dataLen + 1:
+		if expected := gtinCheckDigit(data[:dataLen]); data[dataLen] != expected {
+			return fmt.Errorf("%s check digit mismatch: got %c, expected %c", name, data[dataLen], expected)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s data must be %d or %d digits, got %d", name, dataLen, dataLen+1, len(data))
+}
+
+func validateUPCA(data string) error {
+	return validateGTIN("upc_a", data, 11)
+}
+
+func validateEAN13(data string) error {
+	return validateGTIN("ean13", data, 12)
+}
+
+func validateEAN8(data string) error {
+	return validateGTIN("ean8", data, 7)
+}
+
+// expandUPCE converts the number system digit and six UPC-E digits to the
+// eleven-digit UPC-A form used to compute the check digit.
+func expandUPCE(ns byte, d string) string {
+	switch d[5] {
+	case '0', '1', '2':
+		return string(ns) + d[0:2] + d[5:6] + "0000" + d[2:5]
+	case '3':
+		return string(ns) + d[0:3] + "00000" + d[3:5]
+	case '4':
+		return string(ns) + d[0:4] + "00000" + d[4:5]
+	}
+	return string(ns) + d[0:5] + "0000" + d[5:6]
+}
+
+func validateUPCE(data string) error {
+	if !isDigits(data) {
+		return fmt.Errorf("upc_e data must be numeric: %q", data)
+	}
+	switch len(data) {
+	case 6:
+		return nil
+	case 7, 8:
+		if data[0] != '0' && data[0] != '1' {
+			return fmt.Errorf("upc_e number system must be 0 or 1, got %c", data[0])
+		}
+		if len(data) == 8 {
+			if expected := gtinCheckDigit(expandUPCE(data[0], data[1:7])); data[7] != expected {
+				return fmt.Errorf("upc_e check digit mismatch: got %c, expected %c", data[7], expected)
+			}
+		}
+		return nil
+	case 11, 12:
+		if data[0] != '0' && data[0] != '1' {
+			return fmt.Errorf("upc_e number system must be 0 or 1, got %c", data[0])
+		}
+		return validateUPCA(data)
+	}
+	return fmt.Errorf("upc_e data must be 6, 7, 8, 11 or 12 digits, got %d", len(data))
+}
+
+func validateCode39(data string) error {
+	if data == "" {
+		return fmt.Errorf("code39 data must not be empty")
+	}
+	for _, r := range data {
+		if !(r >= '0' && r <= '9') && !(r >= 'A' && r <= 'Z') && !strings.ContainsRune(" $%*+-./", r) {
+			return fmt.Errorf("code39 data contains illegal character %q", r)
+		}
+	}
+	return nil
+}
+
+func validateITF(data string) error {
+	if !isDigits(data) {
+		return fmt.Errorf("itf data must be numeric: %q", data)
+	}
+	if len(data)%2 != 0 {
+		return fmt.Errorf("itf data must have an even number of digits, got %d", len(data))
+	}
+	return nil
+}
+
+func isCodabarStartStop(b byte) bool {
+	return (b >= 'A' && b <= 'D') || (b >= 'a' && b <= 'd')
+}
+
+func validateCodabar(data string) error {
+	if len(data) < 2 {
+		return fmt.Errorf("codabar data must include start and stop characters")
+	}
+	if !isCodabarStartStop(data[0]) || !isCodabarStartStop(data[len(data)-1]) {
+		return fmt.Errorf("codabar data must start and end with A-D: %q", data)
+	}
+	for _, r := range data[1 : len(data)-1] {
+		if !(r >= '0' && r <= '9') && !strings.ContainsRune("$+-./:", r) {
+			return fmt.Errorf("codabar data contains illegal character %q", r)
+		}
+	}
+	return nil
+}
+
+func validateASCII(data string) error {
+	if data == "" {
+		return fmt.Errorf("barcode data must not be empty")
+	}
+	for _, r := range data {
+		if r > 0x7f {
+			return fmt.Errorf("barcode data contains non-ASCII character %q", r)
+		}
+	}
+	return nil
+}
+
+// validateCode128 checks CODE128 data. Data without a code set prefix is
+// sent in code set B (see encodeBarcodeData), which only has the characters
+// 0x20 to 0x7F; the same goes for the parts of prefixed data in set B.
+func validateCode128(data string) error {
+	if err := validateASCII(data); err != nil {
+		return err
+	}
+	prefixed, set := hasCode128Set(data), byte('B')
+	for i := 0; i < len(data); i++ {
+		if prefixed && data[i] == '{' && i+1 < len(data) {
+			switch data[i+1] {
+			case 'A', 'B', 'C':
+				set = data[i+1]
+			}
+			i++
+			continue
+		}
+		if set == 'B' && data[i] < 0x20 {
+			return fmt.Errorf("code128 code set B cannot encode control character %q", data[i])
+		}
+	}
+	return nil
+}
+
+func validatePrintableASCII(data string) error {
+	if data == "" {
+		return fmt.Errorf("barcode data must not be empty")
+	}
+	for _, r := range data {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("barcode data contains non-printable character %q", r)
+		}
+	}
+	return nil
+}
+
+func validateDataBar(data string) error {
+	if !isDigits(data) || len(data) != 13 {
+		return fmt.Errorf("gs1_databar data must be 13 digits: %q", data)
+	}
+	return nil
+}
+
+func validateDataBarLimited(data string) error {
+	if err := validateDataBar(data); err != nil {
+		return err
+	}
+	if data[0] != '0' && data[0] != '1' {
+		return fmt.Errorf("gs1_databar_limited data must start with 0 or 1: %q", data)
+	}
+	return nil
+}
+
+// encodeBarcodeData returns the bytes sent after GS k m n. CODE128 needs a
+// code set prefix; when the client did not give one ({A, {B or {C) the data
+// is sent in code set B with literal braces escaped.
+func encodeBarcodeData(barcodeType string, data string) []byte {
+	if barcodeType != "code128" {
+		return []byte(data)
+	}
+	if hasCode128Set(data) {
+		return []byte(data)
+	}
+	return []byte("{B" + strings.ReplaceAll(data, "{", "{{"))
+}
+
+// hasCode128Set reports whether CODE128 data starts with a code set prefix
+func hasCode128Set(data string) bool {
+	return strings.HasPrefix(data, "{A") || strings.HasPrefix(data, "{B") || strings.HasPrefix(data, "{C")
+}
+
+// parseBarcodeAttrs reads the attributes of a <barcode> element, filling in
+// the ePOS-Print defaults for any that are missing.
+func parseBarcodeAttrs(attrs []xml.Attr) (*BarcodeDecoded, error) {
+	barcode := &BarcodeDecoded{
+		HRI:    "none",
+		Font:   "font_a",
+		Width:  3,
+		Height: 162,
+	}
+
+	var err error
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "type":
+			if _, ok := barcodeSymbologies[attr.Value]; !ok {
+				return nil, fmt.Errorf("unsupported barcode type %q", attr.Value)
+			}
+			barcode.Type = attr.Value
+		case "hri":
+			barcode.HRI, err = parseEnumAttr("barcode", attr, "none", "above", "below", "both")
+		case "font":
+			barcode.Font, err = parseEnumAttr("barcode", attr, "font_a", "font_b", "font_c", "font_d", "font_e")
+		case "width":
+			barcode.Width, err = parseIntAttr("barcode", attr, 2, 6)
+		case "height":
+			barcode.Height, err = parseIntAttr("barcode", attr, 1, 255)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if barcode.Type == "" {
+		return nil, fmt.Errorf("barcode element is missing the type attribute")
+	}
+
+	return barcode, nil
+}
+
+// setBarcodeData validates barcode content against its symbology and stores
+// the bytes to send to the printer. Whitespace around the content, as left
+// by pretty-printed XML, is not part of the barcode.
+func setBarcodeData(barcode *BarcodeDecoded, data string) error {
+	data = strings.TrimSpace(data)
+	if err := barcodeSymbologies[barcode.Type].validate(data); err != nil {
+		return fmt.Errorf("invalid %s barcode: %w", barcode.Type, err)
+	}
+
+	encoded := encodeBarcodeData(barcode.Type, data)
+	if len(encoded) > 255 {
+		return fmt.Errorf("invalid %s barcode: data too long (%d bytes, max 255)", barcode.Type, len(encoded))
+	}
+
+	barcode.Data = encoded
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+// BMP compression methods the decoder handles
+const (
+	BMP_RGB       = 0
+	BMP_BITFIELDS = 3
+)
+
+// bmpHeader is the part of a Windows bitmap's file and info headers needed
+// to read its pixels. Only BITMAPINFOHEADER and its V2-V5 extensions are
+// read; OS/2 core headers and RLE compression are not supported.
+type bmpHeader struct {
+	width     int
+	height    int
+	topDown   bool
+	bpp       int
+	offset    int
+	stride    int
+	palette   []color.NRGBA
+	masks     [4]uint32 // red, green, blue, alpha
+	bitfields bool
+}
+
+func parseBMPHeader(data []byte) (bmpHeader, error) {
+	var h bmpHeader
+	if len(data) < 54 || string(data[:2]) != "BM" {
+		return h, fmt.Errorf("bmp: not a Windows bitmap")
+	}
+	le := binary.LittleEndian
+	h.offset = int(le.Uint32(data[10:]))
+	infoSize := int(le.Uint32(data[14:]))
+	if infoSize < 40 || 14+infoSize > len(data) {
+		return h, fmt.Errorf("bmp: unsupported info header of %d bytes", infoSize)
+	}
+	info := data[14 : 14+infoSize]
+
+	width := int(int32(le.Uint32(info[4:])))
+	height := int(int32(le.Uint32(info[8:])))
+	h.bpp = int(le.Uint16(info[14:]))
+	compression := le.Uint32(info[16:])
+	colorsUsed := int(le.Uint32(info[32:]))
+	if height < 0 {
+		h.topDown = true
+		height = -height
+	}
+	if width <= 0 || height <= 0 {
+		return h, fmt.Errorf("bmp: invalid dimensions %dx%d", width, height)
+	}
+	h.width, h.height = width, height
+
+	switch {
+	case compression == BMP_RGB && (h.bpp == 1 || h.bpp == 4 || h.bpp == 8 || h.bpp == 24 || h.bpp == 32):
+	case compression == BMP_BITFIELDS && (h.bpp == 16 || h.bpp == 32):
+		h.bitfields = true
+		// Masks follow a plain BITMAPINFOHEADER and are part of the longer ones
+		masks := data[14+40:]
+		if infoSize > 40 {
+			masks = info[40:]
+		}
+		count := 3
+		if infoSize >= 56 {
+			count = 4
+		}
+		if len(masks) < 4*count {
+			return h, fmt.Errorf("bmp: truncated color masks")
+		}
+		for i := range count {
+			h.masks[i] = le.Uint32(masks[4*i:])
+		}
+	case compression == BMP_RGB && h.bpp == 16:
+		// 5 bits each of red, green and blue
+		h.bitfields = true
+		h.masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+	default:
+		return h, fmt.Errorf("bmp: unsupported format: %d bits per pixel, compression %d", h.bpp, compression)
+	}
+
+	if h.bpp <= 8 {
+		if colorsUsed == 0 || colorsUsed > 1<<h.bpp {
+			colorsUsed = 1 << h.bpp
+		}
+		start := 14 + infoSize
+		if start+4*colorsUsed > len(data) {
+			return h, fmt.Errorf("bmp: truncated palette")
+		}
+		h.palette = make([]color.NRGBA, colorsUsed)
+		for i := range h.palette {
+			entry := data[start+4*i:]
+			h.palette[i] = color.NRGBA{R: entry[2], G: entry[1], B: entry[0], A: 0xff}
+		}
+	}
+
+	h.stride = (h.bpp*h.width + 31) / 32 * 4
+	if h.offset < 0 || h.offset > len(data) || h.stride > (len(data)-h.offset)/h.height {
+		return h, fmt.Errorf("bmp: pixel data truncated")
+	}
+	return h, nil
+}
+
+// decodeBMPConfig reads a bitmap's dimensions without decoding its pixels
+func decodeBMPConfig(data []byte) (image.Config, error) {
+	h, err := parseBMPHeader(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: h.width, Height: h.height}, nil
+}
+
+// decodeBMP decodes an uncompressed Windows bitmap
+func decodeBMP(data []byte) (image.Image, error) {
+	h, err := parseBMPHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, h.width, h.height))
+	for row := range h.height {
+		y := row
+		if !h.topDown {
+			y = h.height - 1 - row
+		}
+		line := data[h.offset+row*h.stride : h.offset+(row+1)*h.stride]
+		for x := range h.width {
+			img.SetNRGBA(x, y, h.pixel(line, x))
+		}
+	}
+	return img, nil
+}
+
+func (h *bmpHeader) pixel(line []byte, x int) color.NRGBA {
+	le := binary.LittleEndian
+	switch {
+	case h.bpp <= 8:
+		perByte := 8 / h.bpp
+		shift := 8 - h.bpp*(x%perByte+1)
+		index := int(line[x/perByte]>>shift) & (1<<h.bpp - 1)
+		if index >= len(h.palette) {
+			return color.NRGBA{A: 0xff}
+		}
+		return h.palette[index]
+	case h.bitfields:
+		var v uint32
+		if h.bpp == 16 {
+			v = uint32(le.Uint16(line[2*x:]))
+		} else {
+			v = le.Uint32(line[4*x:])
+		}
+		c := color.NRGBA{R: maskedValue(v, h.masks[0]), G: maskedValue(v, h.masks[1]), B: maskedValue(v, h.masks[2]), A: 0xff}
+		if h.masks[3] != 0 {
+			c.A = maskedValue(v, h.masks[3])
+		}
+		return c
+	case h.bpp == 24:
+		p := line[3*x:]
+		return color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+	default:
+		// 32 bits without masks: BGR plus an unused byte
+		p := line[4*x:]
+		return color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+	}
+}
+
+// maskedValue extracts the channel selected by mask and scales it to 8 bits
+func maskedValue(v uint32, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	top := uint64(1)<<width - 1
+	return uint8(uint64((v&mask)>>shift) * 255 / top)
+}
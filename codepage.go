@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"unicode/utf8"
+)
+
+// How <text> content is sent. Code pages convert each character to one
+// byte of a code page selected with ESC t, and work on every model. UTF-8
+// sends the text as it is after FS ( C function 48 selects UTF-8, which
+// newer models need for Japanese, Chinese and Korean.
+const (
+	TEXT_ENCODING_CODE_PAGE = "code_page"
+	TEXT_ENCODING_UTF8      = "utf8"
+	DEFAULT_TEXT_ENCODING   = TEXT_ENCODING_CODE_PAGE
+)
+
+// FS ( C function 48 m=2: select UTF-8 as the character encoding
+var UTF8_ENCODING_CMD = []byte{0x1c, 0x28, 0x43, 0x02, 0x00, 0x30, 0x02}
+
+// FS ( C function 60 m=0: the font tried first for characters several
+// scripts share, by <text lang>
+var FONT_PRIORITY_CMD = func(font byte) []byte {
+	return []byte{0x1c, 0x28, 0x43, 0x03, 0x00, 0x3c, 0x00, font}
+}
+
+var TEXT_LANG_FONTS = map[string]byte{
+	"ja":    11,
+	"zh-cn": 20,
+	"zh-tw": 21,
+	"ko":    30,
+}
+
+// ESC t n: select character code table
+var CODE_PAGE_CMD = func(n byte) []byte {
+	return []byte{0x1b, 0x74, n}
+}
+
+// codePage is a character code table: the characters its upper half
+// (0x80-0xFF) prints, by byte
+type codePage struct {
+	code  byte
+	chars map[rune]byte
+}
+
+func newCodePage(code byte, upper [128]rune) codePage {
+	chars := map[rune]byte{}
+	for i, r := range upper {
+		if r != 0 {
+			chars[r] = byte(0x80 + i)
+		}
+	}
+	return codePage{code: code, chars: chars}
+}
+
+// wpc1252Upper is Windows code page 1252 (Western European) above 0x7F:
+// Latin-1 plus typographic punctuation and the euro sign
+var wpc1252Upper = func() [128]rune {
+	upper := [128]rune{
+		0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+		0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+		0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+		0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+	}
+	for i := 0x20; i < 0x80; i++ {
+		upper[i] = rune(0x80 + i)
+	}
+	return upper
+}()
+
+// pc866Upper is code page 866 (Cyrillic) above 0x7F. Its box drawing
+// characters are left out.
+var pc866Upper = func() [128]rune {
+	var upper [128]rune
+	for i := range 0x30 {
+		upper[i] = rune(0x0410 + i)
+	}
+	for i := range 0x10 {
+		upper[0x60+i] = rune(0x0440 + i)
+	}
+	copy(upper[0x70:], []rune{
+		0x0401, 0x0451, 0x0404, 0x0454, 0x0407, 0x0457, 0x040E, 0x045E,
+		0x00B0, 0x2219, 0x00B7, 0x221A, 0x2116, 0x00A4, 0x25A0, 0x00A0,
+	})
+	return upper
+}()
+
+// CODE_PAGES are the tables non-ASCII text is converted with, in order of
+// preference: WPC1252 (ESC t 16) and PC866 (ESC t 17). Every table has
+// ASCII in its lower half.
+var CODE_PAGES = []codePage{
+	newCodePage(16, wpc1252Upper),
+	newCodePage(17, pc866Upper),
+}
+
+// encodeText converts text content to printer bytes. Carriage returns are
+// dropped, since the printer feeds on line feeds alone. With code pages,
+// non-ASCII characters select the first code page that has them, staying
+// on the current one while it can; characters no code page has print as
+// '?'. With UTF-8 the text is sent as it is.
+func encodeText(content string, lang string, encoding string) []byte {
+	if encoding == TEXT_ENCODING_UTF8 {
+		return encodeUTF8(content, lang)
+	}
+
+	buf := make([]byte, 0, len(content))
+	current := -1
+	var missing []rune
+	for _, r := range content {
+		switch {
+		case r == '\r':
+			continue
+		case r == '\n' || r == '\t' || (r >= 0x20 && r < 0x7f):
+			buf = append(buf, byte(r))
+			continue
+		case r < 0x80:
+			// Other control characters
+			buf = append(buf, '?')
+			continue
+		}
+
+		page := -1
+		if current >= 0 {
+			if _, ok := CODE_PAGES[current].chars[r]; ok {
+				page = current
+			}
+		}
+		for i := 0; page < 0 && i < len(CODE_PAGES); i++ {
+			if _, ok := CODE_PAGES[i].chars[r]; ok {
+				page = i
+			}
+		}
+		if page < 0 {
+			missing = append(missing, r)
+			buf = append(buf, '?')
+			continue
+		}
+		if page != current {
+			buf = append(buf, CODE_PAGE_CMD(CODE_PAGES[page].code)...)
+			current = page
+		}
+		buf = append(buf, CODE_PAGES[page].chars[r])
+	}
+	if len(missing) > 0 {
+		log.Printf("[PRINTER] WARNING: No code page has %q, printing '?' instead (printers with UTF-8 support can use \"encoding\": %q)",
+			string(missing), TEXT_ENCODING_UTF8)
+	}
+	return buf
+}
+
+// encodeUTF8 selects UTF-8 and the font for lang, then sends the text
+func encodeUTF8(content string, lang string) []byte {
+	buf := make([]byte, 0, len(UTF8_ENCODING_CMD)+8+len(content))
+	buf = append(buf, UTF8_ENCODING_CMD...)
+	if font, ok := TEXT_LANG_FONTS[lang]; ok {
+		buf = append(buf, FONT_PRIORITY_CMD(font)...)
+	}
+	for _, r := range content {
+		switch {
+		case r == '\r':
+			continue
+		case r < 0x20 && r != '\n' && r != '\t', r == 0x7f, r == utf8.RuneError:
+			buf = append(buf, '?')
+		default:
+			buf = utf8.AppendRune(buf, r)
+		}
+	}
+	return buf
+}
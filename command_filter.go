@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// DEFAULT_COMMAND_DENY blocks raw commands that rewrite printer non-volatile
+// memory or settings:
+//
+//	1c71       FS q              define NV bit image
+//	1c6731     FS g 1            write to NV user memory
+//	1d2843     GS ( C            edit NV user memory
+//	1d2845     GS ( E            set user setup commands (memory switches, customize values)
+//	1d284c3041 GS ( L fn 65-68   delete or define NV graphics
+//	1d384c3041 GS 8 L fn 65-68   (the same with a 4 byte length)
+//	1d284d     GS ( M            save or restore settings in NV memory
+//
+// GS ( and GS 8 L entries leave out the command's length bytes.
+const DEFAULT_COMMAND_DENY = "1c71,1c6731,1d2843,1d2845," +
+	"1d284c3041,1d284c3042,1d284c3043,1d284c3044," +
+	"1d384c3041,1d384c3042,1d384c3043,1d384c3044," +
+	"1d284d"
+
+// CommandFilter decides which raw <command> payloads may reach the printer.
+// Payloads are split into ESC/POS commands, and each command is matched
+// against the lists by its key (see escposCommand): deny entries are
+// prefixes no command may start with, and when allow entries are set every
+// command must start with one of them. Printable text and line feeds
+// between commands are not commands and need no allow entry.
+type CommandFilter struct {
+	Allow [][]byte
+	Deny  [][]byte
+}
+
+// parseHexList parses a comma-separated list of hex byte sequences
+func parseHexList(list string) ([][]byte, error) {
+	var out [][]byte
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		b, err := hex.DecodeString(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex command prefix %q: %w", item, err)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func NewCommandFilter(allow string, deny string) (*CommandFilter, error) {
+	allowList, err := parseHexList(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyList, err := parseHexList(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandFilter{Allow: allowList, Deny: denyList}, nil
+}
+
+// Check checks the raw <command> payloads of one job. They are read joined,
+// as the printer receives them when sent back to back, so a command split
+// across elements is checked whole. A split command is then refused anyway:
+// other instructions may be printed between the elements. A command the
+// filter does not recognise ends the parse, since its length is unknown;
+// the rest of the payload is searched for denied commands at every offset.
+func (f *CommandFilter) Check(commands ...[]byte) error {
+	if f == nil {
+		return nil
+	}
+
+	data := bytes.Join(commands, nil)
+	var ends []int
+	end := 0
+	for _, command := range commands {
+		end += len(command)
+		ends = append(ends, end)
+	}
+
+	for pos := 0; pos < len(data); {
+		cmd := parseCommand(data[pos:])
+		if cmd.size == 0 {
+			return f.checkUnknown(data[pos:])
+		}
+		if err := f.checkCommand(cmd); err != nil {
+			return err
+		}
+		if cmd.size > len(data)-pos {
+			return fmt.Errorf("raw command %x is incomplete", cmd.key[:min(len(cmd.key), 8)])
+		}
+		for _, end := range ends {
+			if end > pos && end < pos+cmd.size {
+				return fmt.Errorf("raw command %x is split across <command> elements", cmd.key[:min(len(cmd.key), 8)])
+			}
+		}
+		pos += cmd.size
+	}
+	return nil
+}
+
+func (f *CommandFilter) checkCommand(cmd escposCommand) error {
+	for _, denied := range f.Deny {
+		if bytes.HasPrefix(cmd.key, denied) {
+			return fmt.Errorf("raw command %x is denied by %x", cmd.key[:min(len(cmd.key), 8)], denied)
+		}
+	}
+
+	if len(f.Allow) == 0 || cmd.text {
+		return nil
+	}
+	for _, allowed := range f.Allow {
+		if bytes.HasPrefix(cmd.key, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("raw command %x does not start with an allowed prefix", cmd.key[:min(len(cmd.key), 8)])
+}
+
+// checkUnknown checks a payload that starts with an unrecognised command.
+// Without knowing where it ends, any offset may start the next command.
+func (f *CommandFilter) checkUnknown(data []byte) error {
+	if len(f.Allow) > 0 {
+		return fmt.Errorf("raw command %x is not recognised, so it cannot be allowed", data[:min(len(data), 8)])
+	}
+	for i := range data {
+		cmd := parseCommand(data[i:])
+		for _, denied := range f.Deny {
+			if bytes.HasPrefix(cmd.key, denied) {
+				return fmt.Errorf("raw command %x contains denied command %x", data[:min(len(data), 8)], denied)
+			}
+		}
+	}
+	return nil
+}
+
+// escposCommand is one command at the start of a raw payload
+type escposCommand struct {
+	// key is what allow and deny entries are matched against: the
+	// command's bytes, without the length bytes of ( and 8 L commands
+	key []byte
+	// size is how many bytes the command takes, which is more than the
+	// payload holds if it is cut short, or 0 if the command is unknown
+	size int
+	// text is set for printable characters and line controls
+	text bool
+}
+
+// ESC_PARAMS, FS_PARAMS and GS_PARAMS are how many parameter bytes follow
+// the ESC/POS commands with a fixed length, by the byte after the prefix
+var ESC_PARAMS = map[byte]int{
+	0x0c: 0, ' ': 1, '!': 1, '$': 2, '%': 1, '-': 1, '2': 0, '3': 1, '<': 0, '=': 1,
+	'?': 1, '@': 0, 'E': 1, 'G': 1, 'J': 1, 'K': 1, 'L': 0, 'M': 1, 'R': 1, 'S': 0,
+	'T': 1, 'U': 1, 'V': 1, 'W': 8, '\\': 2, 'a': 1, 'c': 2, 'd': 1, 'e': 1, 'i': 0,
+	'm': 0, 'p': 3, 'r': 1, 't': 1, 'u': 1, 'v': 0, '{': 1,
+}
+
+var FS_PARAMS = map[byte]int{
+	'!': 1, '&': 0, '-': 1, '.': 0, '2': 74, 'C': 1, 'S': 2, 'W': 1, 'p': 2,
+}
+
+var GS_PARAMS = map[byte]int{
+	'!': 1, '$': 2, '/': 1, ':': 0, 'B': 1, 'H': 1, 'I': 1, 'L': 2, 'P': 2, 'T': 1,
+	'W': 2, '\\': 2, '^': 3, 'a': 1, 'b': 1, 'c': 0, 'f': 1, 'g': 4, 'h': 1, 'j': 1,
+	'r': 1, 'w': 1,
+}
+
+// parseCommand reads the ESC/POS command at the start of data
+func parseCommand(data []byte) escposCommand {
+	b := data[0]
+	switch b {
+	case 0x1b, 0x1c, 0x1d, 0x10:
+	default:
+		return escposCommand{key: data[:1], size: 1, text: b >= 0x20 || b == '\t' || b == '\n' || b == '\r'}
+	}
+	if len(data) < 2 {
+		return escposCommand{key: data, size: 2}
+	}
+
+	var params map[byte]int
+	switch b {
+	case 0x1b:
+		params = ESC_PARAMS
+	case 0x1c:
+		params = FS_PARAMS
+	case 0x1d:
+		params = GS_PARAMS
+	}
+	if n, ok := params[data[1]]; ok {
+		return fixedCommand(data, 2+n)
+	}
+
+	// truncated is a command whose length fields are themselves cut short
+	truncated := escposCommand{key: data, size: len(data) + 1}
+	at := func(i int) int { return int(data[i]) }
+	u16 := func(i int) int { return at(i) | at(i+1)<<8 }
+
+	switch {
+	case data[1] == '(' && b != 0x10:
+		// ESC (, FS ( and GS ( X pL pH d1...dk
+		if len(data) < 5 {
+			return truncated
+		}
+		return lengthCommand(data, 5, 5+u16(3))
+	case b == 0x1d && data[1] == '8':
+		// GS 8 X p1 p2 p3 p4 d1...dk
+		if len(data) < 7 {
+			return truncated
+		}
+		return lengthCommand(data, 7, 7+u16(3)+u16(5)<<16)
+	case b == 0x10:
+		return dleCommand(data)
+	case b == 0x1b && data[1] == '*':
+		// ESC * m nL nH: n columns of 1 or 3 bytes
+		if len(data) < 5 {
+			return truncated
+		}
+		if at(2) <= 1 {
+			return fixedCommand(data, 5+u16(3))
+		}
+		return fixedCommand(data, 5+3*u16(3))
+	case b == 0x1b && data[1] == 'D':
+		// ESC D n1...nk NUL
+		if i := bytes.IndexByte(data[2:], 0); i >= 0 {
+			return fixedCommand(data, 2+i+1)
+		}
+		return truncated
+	case b == 0x1b && data[1] == '&':
+		// ESC & y c1 c2, then per character x and y*x bytes
+		if len(data) < 5 {
+			return truncated
+		}
+		size := 5
+		for range max(0, at(4)-at(3)+1) {
+			if len(data) <= size {
+				return truncated
+			}
+			size += 1 + at(2)*at(size)
+		}
+		return fixedCommand(data, size)
+	case b == 0x1c && data[1] == 'g':
+		// FS g 1 m a1-a4 nL nH d1...dk writes, FS g 2 m a1-a4 nL nH reads
+		if len(data) < 10 {
+			return truncated
+		}
+		switch at(2) {
+		case '1', 1:
+			return fixedCommand(data, 10+u16(8))
+		case '2', 2:
+			return fixedCommand(data, 10)
+		}
+	case b == 0x1c && data[1] == 'q':
+		// FS q n, then per image xL xH yL yH and x*y*8 bytes
+		if len(data) < 3 {
+			return truncated
+		}
+		size := 3
+		for range at(2) {
+			if len(data) < size+4 {
+				return truncated
+			}
+			size += 4 + u16(size)*u16(size+2)*8
+		}
+		return fixedCommand(data, size)
+	case b == 0x1d && data[1] == '*':
+		// GS * x y: x*8 by y*8 dots
+		if len(data) < 4 {
+			return truncated
+		}
+		return fixedCommand(data, 4+at(2)*at(3)*8)
+	case b == 0x1d && data[1] == 'V':
+		// GS V m, with a feed amount n for functions B, C and D
+		if len(data) < 3 {
+			return truncated
+		}
+		switch at(2) {
+		case 0, 1, '0', '1':
+			return fixedCommand(data, 3)
+		case 'A', 'B', 'a', 'b', 'g', 'h':
+			return fixedCommand(data, 4)
+		}
+	case b == 0x1d && data[1] == 'k':
+		// GS k m d1...dk NUL (m 0-6) or GS k m n d1...dn (m 65-79)
+		if len(data) < 3 {
+			return truncated
+		}
+		if at(2) <= 6 {
+			if i := bytes.IndexByte(data[3:], 0); i >= 0 {
+				return fixedCommand(data, 3+i+1)
+			}
+			return truncated
+		}
+		if len(data) < 4 {
+			return truncated
+		}
+		return fixedCommand(data, 4+at(3))
+	case b == 0x1d && data[1] == 'v':
+		// GS v 0 m xL xH yL yH: x bytes by y lines
+		if len(data) < 8 {
+			return truncated
+		}
+		if at(2) == '0' {
+			return fixedCommand(data, 8+u16(4)*u16(6))
+		}
+	}
+	return escposCommand{key: data[:2]}
+}
+
+// dleCommand reads DLE EOT, DLE ENQ and DLE DC4 real-time commands
+func dleCommand(data []byte) escposCommand {
+	switch data[1] {
+	case 0x04, 0x05:
+		return fixedCommand(data, 3)
+	case 0x14:
+		if len(data) < 3 {
+			return escposCommand{key: data, size: len(data) + 1}
+		}
+		switch data[2] {
+		case 1, 2, 3:
+			return fixedCommand(data, 5)
+		case 7:
+			return fixedCommand(data, 4)
+		case 8:
+			return fixedCommand(data, 10)
+		}
+	}
+	return escposCommand{key: data[:2]}
+}
+
+// fixedCommand is a command of size bytes keyed by all of them
+func fixedCommand(data []byte, size int) escposCommand {
+	return escposCommand{key: data[:min(size, len(data))], size: size}
+}
+
+// lengthCommand is a command of size bytes whose length field ends at
+// header; its key is the 3 byte command followed by its data
+func lengthCommand(data []byte, header int, size int) escposCommand {
+	key := append(bytes.Clone(data[:3]), data[header:min(size, len(data))]...)
+	return escposCommand{key: key, size: size}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommandFilter_DefaultDenyBlocksNVWrites(t *testing.T) {
+	filter, err := NewCommandFilter("", DEFAULT_COMMAND_DENY)
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+
+	if err := filter.Check([]byte{0x1b, 0x40}); err != nil {
+		t.Errorf("expected ESC @ to be allowed, got: %v", err)
+	}
+
+	// GS ( E hidden behind an innocuous ESC @
+	if err := filter.Check([]byte{0x1b, 0x40, 0x1d, 0x28, 0x45, 0x03, 0x00, 0x01, 0x49, 0x4e}); err == nil {
+		t.Error("expected GS ( E to be denied anywhere in the payload")
+	}
+}
+
+func TestCommandFilter_AllowList(t *testing.T) {
+	filter, err := NewCommandFilter("1b40, 1b61", "")
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+
+	if err := filter.Check([]byte{0x1b, 0x61, 0x01}); err != nil {
+		t.Errorf("expected allowed prefix to pass, got: %v", err)
+	}
+	if err := filter.Check([]byte{0x1d, 0x56, 0x00}); err == nil {
+		t.Error("expected payload without an allowed prefix to be rejected")
+	}
+}
+
+func TestCommandFilter_InvalidHex(t *testing.T) {
+	if _, err := NewCommandFilter("1g", ""); err == nil {
+		t.Error("expected error for invalid allow list hex")
+	}
+	if _, err := NewCommandFilter("", "abc"); err == nil {
+		t.Error("expected error for odd-length deny list hex")
+	}
+}
+
+func TestCommandFilter_Nil(t *testing.T) {
+	var filter *CommandFilter
+	if err := filter.Check([]byte{0x1c, 0x71}); err != nil {
+		t.Errorf("nil filter should allow everything, got: %v", err)
+	}
+}
+
+func TestCommandFilter_SplitAcrossElements(t *testing.T) {
+	filter, err := NewCommandFilter("", DEFAULT_COMMAND_DENY)
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+
+	// FS q split over two <command> elements reaches the printer whole
+	if err := filter.Check([]byte{0x1c}, []byte{0x71, 0x01}); err == nil {
+		t.Error("expected FS q split across elements to be denied")
+	}
+	// ESC a n split across elements is refused even though it is allowed
+	if err := filter.Check([]byte{0x1b, 0x61}, []byte{0x01}); err == nil {
+		t.Error("expected a command split across elements to be refused")
+	}
+	if err := filter.Check([]byte{0x1b, 0x61, 0x01}, []byte{0x1b, 0x40}); err != nil {
+		t.Errorf("expected whole commands in separate elements to pass, got: %v", err)
+	}
+	if err := filter.Check([]byte{0x1b, 0x61}); err == nil {
+		t.Error("expected an incomplete command to be refused")
+	}
+}
+
+func TestCommandFilter_DefaultDenyCommands(t *testing.T) {
+	filter, err := NewCommandFilter("", DEFAULT_COMMAND_DENY)
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		allowed bool
+	}{
+		{"GS ( L define NV graphics", []byte{0x1d, 0x28, 0x4c, 0x06, 0x00, 0x30, 0x43, 0x30, 0x20, 0x20, 0x01}, false},
+		{"GS ( L delete all NV graphics", []byte{0x1d, 0x28, 0x4c, 0x05, 0x00, 0x30, 0x41, 0x43, 0x4c, 0x52}, false},
+		{"GS 8 L define NV graphics", []byte{0x1d, 0x38, 0x4c, 0x03, 0x00, 0x00, 0x00, 0x30, 0x43, 0x30}, false},
+		{"GS ( M save settings", []byte{0x1d, 0x28, 0x4d, 0x02, 0x00, 0x01, 0x01}, false},
+		{"GS ( L print graphics", []byte{0x1d, 0x28, 0x4c, 0x02, 0x00, 0x30, 0x32}, true},
+		// Image data that happens to hold FS q and GS ( E is just data
+		{"GS ( L store graphics", []byte{0x1d, 0x28, 0x4c, 0x0e, 0x00, 0x30, 0x70, 0x30, 0x01, 0x01, 0x31, 0x10, 0x00, 0x01, 0x00, 0x1c, 0x71, 0x1d, 0x28}, true},
+		{"GS v 0 raster", []byte{0x1d, 0x76, 0x30, 0x00, 0x03, 0x00, 0x01, 0x00, 0x1d, 0x28, 0x45}, true},
+		{"text and cut", []byte("Hello\n\x1dV\x42\x00"), true},
+	}
+	for _, tt := range tests {
+		err := filter.Check(tt.data)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: expected to pass, got: %v", tt.name, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("%s: expected to be denied", tt.name)
+		}
+	}
+}
+
+func TestCommandFilter_UnknownCommand(t *testing.T) {
+	deny, err := NewCommandFilter("", DEFAULT_COMMAND_DENY)
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+	// ESC y is not known, so FS q anywhere after it is denied
+	if err := deny.Check([]byte{0x1b, 0x79, 0x05, 0x1c, 0x71}); err == nil {
+		t.Error("expected FS q after an unknown command to be denied")
+	}
+	if err := deny.Check([]byte{0x1b, 0x79, 0x05}); err != nil {
+		t.Errorf("expected an unknown command without denied bytes to pass, got: %v", err)
+	}
+
+	allow, err := NewCommandFilter("1b79", "")
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+	if err := allow.Check([]byte{0x1b, 0x79, 0x05}); err == nil {
+		t.Error("expected an unknown command to fail the allow list")
+	}
+}
+
+func TestCommandFilter_AllowListEveryCommand(t *testing.T) {
+	filter, err := NewCommandFilter("1b61", "")
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+	if err := filter.Check([]byte("\x1ba\x01Total\n")); err != nil {
+		t.Errorf("expected an allowed command and text to pass, got: %v", err)
+	}
+	if err := filter.Check([]byte{0x1b, 0x61, 0x01, 0x1d, 0x56, 0x00}); err == nil {
+		t.Error("expected a command after an allowed one to need its own allow entry")
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DEFAULT_MAX_BODY_BYTES caps the size of a print job request
+const DEFAULT_MAX_BODY_BYTES = 16 << 20
+
+// Config is everything the proxy can be configured with. It is loaded from
+// the -config JSON file and then overridden by any flags given on the
+// command line.
+type Config struct {
+	Listen       []string        `json:"listen"`
+	Secure       bool            `json:"secure"`
+	TLS          TLSConfig       `json:"tls"`
+	AllowOrigins []string        `json:"allow_origins"`
+	CommandAllow []string        `json:"command_allow"`
+	CommandDeny  []string        `json:"command_deny"`
+	Drawer       string          `json:"drawer"`
+	PulseTime    string          `json:"pulse_time"`
+	ASB          bool            `json:"asb"`
+	Retry        RetryPolicy     `json:"retry"`
+	Limits       Limits          `json:"limits"`
+	Journal      JournalConfig   `json:"journal"`
+	Printers     []PrinterConfig `json:"printers"`
+}
+
+// JournalConfig enables the on-disk job journal. With ResumeInterrupted,
+// jobs that were printing when the proxy stopped are printed again in full
+// on the next start rather than reported as failed.
+type JournalConfig struct {
+	Path              string `json:"path"`
+	ResumeInterrupted bool   `json:"resume_interrupted"`
+}
+
+// TLSConfig names the certificate used with "secure". When both are empty
+// a self-signed certificate is generated.
+type TLSConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type Limits struct {
+	// MaxBodyBytes caps a request body; 0 disables the limit
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// QueueDepth caps how many jobs may wait for each printer
+	QueueDepth int `json:"queue_depth"`
+	// IdempotencyTTL is how long job results are kept for resubmissions
+	// with the same Idempotency-Key or printjobid; 0 disables deduplication
+	IdempotencyTTL Duration `json:"idempotency_ttl"`
+	// IdempotencyKeys caps how many job results are kept at once
+	IdempotencyKeys int `json:"idempotency_keys"`
+	// SpoolMaxAge is how long a job may wait for an offline printer before
+	// it is failed instead of printed; 0 lets jobs wait indefinitely
+	SpoolMaxAge Duration `json:"spool_max_age"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:      []string{"127.0.0.1:8000"},
+		CommandDeny: splitList(DEFAULT_COMMAND_DENY),
+		Limits: Limits{
+			MaxBodyBytes:    DEFAULT_MAX_BODY_BYTES,
+			QueueDepth:      DEFAULT_QUEUE_DEPTH,
+			IdempotencyTTL:  Duration(DEFAULT_IDEMPOTENCY_TTL),
+			IdempotencyKeys: DEFAULT_IDEMPOTENCY_KEYS,
+			SpoolMaxAge:     Duration(DEFAULT_SPOOL_MAX_AGE),
+		},
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(list string) []string {
+	var out []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// jsonFields maps the JSON keys of a struct type to their field types
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// unknownKeys walks decoded JSON alongside the Go type it is meant for and
+// reports every key the type does not have. encoding/json stops at the
+// first unknown field, which would hide the rest of a config's mistakes.
+func unknownKeys(path string, value any, t reflect.Type) []error {
+	switch v := value.(type) {
+	case map[string]any:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var errs []error
+		for _, key := range keys {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			fieldType, ok := fields[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key", keyPath))
+				continue
+			}
+			errs = append(errs, unknownKeys(keyPath, v[key], fieldType)...)
+		}
+		return errs
+	case []any:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		var errs []error
+		for i, item := range v {
+			errs = append(errs, unknownKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+		return errs
+	}
+	return nil
+}
+
+// decodeJSONFile reads a JSON file into out, reporting all unknown keys
+// together with any type errors.
+func decodeJSONFile(path string, out any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%s is not valid JSON: %w", path, err)
+	}
+
+	errs := unknownKeys("", raw, reflect.TypeOf(out).Elem())
+	if err := json.Unmarshal(data, out); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid %s:\n%w", path, errors.Join(errs...))
+	}
+	return nil
+}
+
+// LoadConfig reads a JSON config file on top of the defaults
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if err := decodeJSONFile(path, &cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the whole configuration and reports every problem found,
+// not just the first. It also fills in per-printer defaults.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if len(c.Listen) == 0 {
+		errs = append(errs, fmt.Errorf("listen: at least one address is required"))
+	}
+	for _, addr := range c.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("listen: invalid address %q: %w", addr, err))
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, fmt.Errorf("tls: cert and key must be set together"))
+	} else if c.TLS.Cert != "" {
+		certErr := checkReadable("tls.cert", c.TLS.Cert)
+		keyErr := checkReadable("tls.key", c.TLS.Key)
+		errs = append(errs, certErr, keyErr)
+		if certErr == nil && keyErr == nil {
+			if _, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key); err != nil {
+				errs = append(errs, fmt.Errorf("tls: cannot load certificate: %w", err))
+			}
+		}
+	}
+
+	if _, err := parseHexList(strings.Join(c.CommandAllow, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("command_allow: %w", err))
+	}
+	if _, err := parseHexList(strings.Join(c.CommandDeny, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("command_deny: %w", err))
+	}
+
+	if _, ok := PULSE_DRAWER_CODES[c.Drawer]; c.Drawer != "" && !ok {
+		errs = append(errs, fmt.Errorf("drawer: invalid value %q (must be drawer_1 or drawer_2)", c.Drawer))
+	}
+	if _, ok := PULSE_TIME_CODES[c.PulseTime]; c.PulseTime != "" && !ok {
+		errs = append(errs, fmt.Errorf("pulse_time: invalid value %q (must be pulse_100 ... pulse_500)", c.PulseTime))
+	}
+
+	if c.Retry.Attempts < 0 {
+		errs = append(errs, fmt.Errorf("retry: attempts must not be negative, got %d", c.Retry.Attempts))
+	}
+	if c.Retry.Delay < 0 {
+		errs = append(errs, fmt.Errorf("retry: delay must not be negative"))
+	}
+	if c.Limits.MaxBodyBytes < 0 {
+		errs = append(errs, fmt.Errorf("limits: max_body_bytes must not be negative, got %d", c.Limits.MaxBodyBytes))
+	}
+	if c.Limits.QueueDepth < 1 {
+		errs = append(errs, fmt.Errorf("limits: queue_depth must be at least 1, got %d", c.Limits.QueueDepth))
+	}
+	if c.Limits.IdempotencyTTL < 0 {
+		errs = append(errs, fmt.Errorf("limits: idempotency_ttl must not be negative"))
+	}
+	if c.Limits.IdempotencyKeys < 1 {
+		errs = append(errs, fmt.Errorf("limits: idempotency_keys must be at least 1, got %d", c.Limits.IdempotencyKeys))
+	}
+	if c.Limits.SpoolMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("limits: spool_max_age must not be negative"))
+	}
+
+	if c.Journal.Path != "" {
+		if info, err := os.Stat(filepath.Dir(c.Journal.Path)); err != nil {
+			errs = append(errs, fmt.Errorf("journal.path: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("journal.path: %s is not a directory", filepath.Dir(c.Journal.Path)))
+		}
+	}
+
+	if len(c.Printers) == 0 {
+		errs = append(errs, fmt.Errorf("printers: no printers configured (use printers in the config file, -printers or -printer/-proto)"))
+	}
+	errs = append(errs, validatePrinters(c.Printers)...)
+
+	// Printers without their own retry policy use the global one
+	for i := range c.Printers {
+		if c.Printers[i].Retry.Attempts == 0 {
+			c.Printers[i].Retry.Attempts = c.Retry.Attempts
+		}
+		if c.Printers[i].Retry.Delay == 0 {
+			c.Printers[i].Retry.Delay = c.Retry.Delay
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// buildConfig assembles the effective configuration: the config file (if
+// any), then the flags given on the command line, then validation.
+func buildConfig(path string, set map[string]bool, f cliFlags) (Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		var err error
+		cfg, err = LoadConfig(path)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	if err := applyFlags(&cfg, set, f); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func checkReadable(name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	f.Close()
+	return nil
+}
+
+// cliFlags holds the command-line flag values that can override the config
+// file.
+type cliFlags struct {
+	printer        string
+	proto          string
+	receiptWidth   int
+	devid          string
+	profile        string
+	wideImages     string
+	printers       string
+	host           string
+	port           string
+	secure         bool
+	tlsCert        string
+	tlsKey         string
+	allowOrigins   string
+	commandAllow   string
+	commandDeny    string
+	drawer         string
+	pulseTime      string
+	asb            bool
+	maxBodyBytes   int64
+	queueDepth     int
+	idempotencyTTL time.Duration
+	spoolMaxAge    time.Duration
+	journal        string
+}
+
+// applyFlags overrides config values with the flags named in set, i.e. the
+// ones given explicitly on the command line.
+func applyFlags(cfg *Config, set map[string]bool, f cliFlags) error {
+	if set["host"] || set["port"] {
+		host, port := "127.0.0.1", "8000"
+		if len(cfg.Listen) > 0 {
+			if h, p, err := net.SplitHostPort(cfg.Listen[0]); err == nil {
+				host, port = h, p
+			}
+		}
+		if set["host"] {
+			host = f.host
+		}
+		if set["port"] {
+			port = f.port
+		}
+		cfg.Listen = []string{net.JoinHostPort(host, port)}
+	}
+
+	if set["secure"] {
+		cfg.Secure = f.secure
+	}
+	if set["tls-cert"] {
+		cfg.TLS.Cert = f.tlsCert
+	}
+	if set["tls-key"] {
+		cfg.TLS.Key = f.tlsKey
+	}
+	if set["allow-origins"] {
+		cfg.AllowOrigins = splitList(f.allowOrigins)
+	}
+	if set["command-allow"] {
+		cfg.CommandAllow = splitList(f.commandAllow)
+	}
+	if set["command-deny"] {
+		cfg.CommandDeny = splitList(f.commandDeny)
+	}
+	if set["drawer"] {
+		cfg.Drawer = f.drawer
+	}
+	if set["pulse-time"] {
+		cfg.PulseTime = f.pulseTime
+	}
+	if set["asb"] {
+		cfg.ASB = f.asb
+	}
+	if set["max-body-bytes"] {
+		cfg.Limits.MaxBodyBytes = f.maxBodyBytes
+	}
+	if set["queue-depth"] {
+		cfg.Limits.QueueDepth = f.queueDepth
+	}
+	if set["idempotency-ttl"] {
+		cfg.Limits.IdempotencyTTL = Duration(f.idempotencyTTL)
+	}
+	if set["spool-max-age"] {
+		cfg.Limits.SpoolMaxAge = Duration(f.spoolMaxAge)
+	}
+	if set["journal"] {
+		cfg.Journal.Path = f.journal
+	}
+
+	if set["printers"] && set["printer"] {
+		return fmt.Errorf("-printers cannot be combined with -printer/-proto")
+	}
+	if set["printers"] {
+		printers, err := LoadPrinterConfigs(f.printers)
+		if err != nil {
+			return err
+		}
+		cfg.Printers = printers
+	}
+	if set["printer"] {
+		if !set["proto"] {
+			return fmt.Errorf("-proto flag is required with -printer")
+		}
+		cfg.Printers = []PrinterConfig{{
+			DevID:        f.devid,
+			Proto:        f.proto,
+			Connection:   f.printer,
+			ReceiptWidth: f.receiptWidth,
+			Profile:      f.profile,
+			WideImages:   f.wideImages,
+		}}
+	} else if set["proto"] || set["receipt-width"] || set["devid"] || set["profile"] || set["wide-images"] {
+		return fmt.Errorf("-proto, -receipt-width, -devid, -profile and -wide-images only apply together with -printer")
+	}
+
+	return nil
+}
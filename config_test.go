@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+	"listen": ["0.0.0.0:8000", "127.0.0.1:9000"],
+	"allow_origins": ["https://pos.example.com"],
+	"drawer": "drawer_2",
+	"asb": true,
+	"retry": {"attempts": 4, "delay": "1s"},
+	"limits": {"max_body_bytes": 1024},
+	"printers": [
+		{"devid": "counter", "proto": "USB", "connection": "/dev/usb/lp0"},
+		{"devid": "kitchen", "proto": "TCP", "connection": "192.168.1.20:9100", "retry": {"attempts": 8}}
+	]
+}`
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeTempFile(t, "config.json", testConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	if len(cfg.Listen) != 2 || cfg.Listen[1] != "127.0.0.1:9000" {
+		t.Errorf("unexpected listen addresses: %v", cfg.Listen)
+	}
+	if cfg.Drawer != "drawer_2" || !cfg.ASB || cfg.Limits.MaxBodyBytes != 1024 {
+		t.Errorf("unexpected config values: %+v", cfg)
+	}
+	if len(cfg.CommandDeny) == 0 {
+		t.Errorf("expected default command deny list to be kept")
+	}
+
+	counter, kitchen := cfg.Printers[0], cfg.Printers[1]
+	if counter.ReceiptWidth != 576 {
+		t.Errorf("expected default receipt width, got %d", counter.ReceiptWidth)
+	}
+	if counter.Retry.Attempts != 4 || time.Duration(counter.Retry.Delay) != time.Second {
+		t.Errorf("expected global retry policy for counter, got %+v", counter.Retry)
+	}
+	if kitchen.Retry.Attempts != 8 || time.Duration(kitchen.Retry.Delay) != time.Second {
+		t.Errorf("expected kitchen attempts with global delay, got %+v", kitchen.Retry)
+	}
+}
+
+func TestLoadConfig_ReportsAllUnknownKeys(t *testing.T) {
+	path := writeTempFile(t, "config.json", `{
+		"listen": ["127.0.0.1:8000"],
+		"cors": ["https://pos.example.com"],
+		"tls": {"certificate": "server.crt"},
+		"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "baud": 9600}]
+	}`)
+
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	for _, key := range []string{"cors", "tls.certificate", "printers[0].baud"} {
+		if !strings.Contains(err.Error(), key+": unknown key") {
+			t.Errorf("expected unknown key %s to be reported, got: %v", key, err)
+		}
+	}
+}
+
+func TestConfigValidate_ReportsAllProblems(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Listen = []string{"no-port"}
+	cfg.TLS = TLSConfig{Cert: filepath.Join(t.TempDir(), "missing.crt"), Key: filepath.Join(t.TempDir(), "missing.key")}
+	cfg.Drawer = "drawer_3"
+	cfg.CommandDeny = []string{"zz"}
+	cfg.Printers = []PrinterConfig{
+		{DevID: "a", Proto: "USB", Connection: "/dev/usb/lp0", ReceiptWidth: -8},
+		{DevID: "a", Proto: "TCP", Connection: "192.168.1.20:9100"},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	for _, want := range []string{"listen", "tls.cert", "tls.key", "drawer", "command_deny", "receipt_width", "duplicate printer devid"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q to be reported, got: %v", want, err)
+		}
+	}
+}
+
+func TestConfigValidate_NoPrinters(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "no printers configured") {
+		t.Errorf("expected missing printers error, got %v", err)
+	}
+}
+
+func TestApplyFlags_OverridesConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeTempFile(t, "config.json", testConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	flags := cliFlags{
+		port:         "8443",
+		allowOrigins: "https://a.example.com, https://b.example.com",
+		asb:          false,
+		printer:      "/dev/usb/lp1",
+		proto:        "USB",
+		receiptWidth: 384,
+		devid:        "local_printer",
+	}
+	set := map[string]bool{"port": true, "allow-origins": true, "asb": true, "printer": true, "proto": true, "receipt-width": true}
+	if err := applyFlags(&cfg, set, flags); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cfg.Listen) != 1 || cfg.Listen[0] != "0.0.0.0:8443" {
+		t.Errorf("expected port to override the first listen address, got %v", cfg.Listen)
+	}
+	if len(cfg.AllowOrigins) != 2 || cfg.AllowOrigins[1] != "https://b.example.com" {
+		t.Errorf("unexpected origins: %v", cfg.AllowOrigins)
+	}
+	if cfg.ASB {
+		t.Errorf("expected -asb=false to override the config file")
+	}
+	if cfg.Drawer != "drawer_2" {
+		t.Errorf("expected unset flags to keep config values, got drawer %q", cfg.Drawer)
+	}
+	if len(cfg.Printers) != 1 || cfg.Printers[0].DevID != "local_printer" || cfg.Printers[0].ReceiptWidth != 384 {
+		t.Errorf("expected -printer to replace the configured printers, got %+v", cfg.Printers)
+	}
+}
+
+func TestApplyFlags_Conflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		set  map[string]bool
+	}{
+		{"printer without proto", map[string]bool{"printer": true}},
+		{"printers with printer", map[string]bool{"printers": true, "printer": true, "proto": true}},
+		{"proto without printer", map[string]bool{"proto": true}},
+		{"devid without printer", map[string]bool{"devid": true}},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		if err := applyFlags(&cfg, tt.set, cliFlags{}); err == nil {
+			t.Errorf("%s: expected error, got nil", tt.name)
+		}
+	}
+}
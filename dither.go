@@ -0,0 +1,142 @@
+package main
+
+import "fmt"
+
+// Dithering methods for turning shades into black and white dots.
+// Threshold suits logos and text; the error diffusion methods and Bayer's
+// ordered pattern keep photos and gradients recognisable.
+const (
+	DITHER_THRESHOLD       = "threshold"
+	DITHER_FLOYD_STEINBERG = "floyd_steinberg"
+	DITHER_ATKINSON        = "atkinson"
+	DITHER_BAYER           = "bayer"
+	DEFAULT_DITHER         = DITHER_FLOYD_STEINBERG
+)
+
+func parseDither(dither string) error {
+	switch dither {
+	case "", DITHER_THRESHOLD, DITHER_FLOYD_STEINBERG, DITHER_ATKINSON, DITHER_BAYER:
+		return nil
+	}
+	return fmt.Errorf("unknown dither %q (must be %s, %s, %s or %s)",
+		dither, DITHER_THRESHOLD, DITHER_FLOYD_STEINBERG, DITHER_ATKINSON, DITHER_BAYER)
+}
+
+// ditherImage converts darkness values, one per pixel from 0 (white) to 255
+// (black), to 1 bit per pixel raster data. An empty method selects
+// DEFAULT_DITHER.
+func ditherImage(method string, darkness []int, width int, height int) []byte {
+	switch method {
+	case DITHER_THRESHOLD:
+		return ditherThreshold(darkness, width, height)
+	case DITHER_ATKINSON:
+		return ditherAtkinson(darkness, width, height)
+	case DITHER_BAYER:
+		return ditherBayer(darkness, width, height)
+	}
+	return ditherFloydSteinberg(darkness, width, height)
+}
+
+// gray16Darkness unpacks 4 bits per pixel image data, high nibble first,
+// into one darkness value per pixel from 0 (white) to 255 (black)
+func gray16Darkness(data []byte, width int, height int) []int {
+	rowBytes := (width + 1) / 2
+	darkness := make([]int, width*height)
+	for y := range height {
+		for x := range width {
+			b := data[y*rowBytes+x/2]
+			if x%2 == 0 {
+				b >>= 4
+			}
+			darkness[y*width+x] = int(b&0x0f) * 17
+		}
+	}
+	return darkness
+}
+
+// ditherThreshold prints every pixel that is at least half dark
+func ditherThreshold(darkness []int, width int, height int) []byte {
+	widthBytes := (width + 7) / 8
+	out := make([]byte, widthBytes*height)
+	for y := range height {
+		for x := range width {
+			if darkness[y*width+x] >= 128 {
+				setRasterPixel(out, widthBytes, x, y)
+			}
+		}
+	}
+	return out
+}
+
+// diffusion is one neighbour's share of a pixel's error
+type diffusion struct {
+	dx, dy, weight int
+}
+
+var FLOYD_STEINBERG_DIFFUSION = []diffusion{{1, 0, 7}, {-1, 1, 3}, {0, 1, 5}, {1, 1, 1}}
+
+// Atkinson spreads only 6/8 of the error, which keeps highlights and
+// shadows clean at the cost of some detail
+var ATKINSON_DIFFUSION = []diffusion{{1, 0, 1}, {2, 0, 1}, {-1, 1, 1}, {0, 1, 1}, {1, 1, 1}, {0, 2, 1}}
+
+// ditherFloydSteinberg spreads each pixel's error over its unvisited
+// neighbours so that shades survive as dot patterns
+func ditherFloydSteinberg(darkness []int, width int, height int) []byte {
+	return ditherDiffuse(darkness, width, height, FLOYD_STEINBERG_DIFFUSION, 16)
+}
+
+func ditherAtkinson(darkness []int, width int, height int) []byte {
+	return ditherDiffuse(darkness, width, height, ATKINSON_DIFFUSION, 8)
+}
+
+// ditherDiffuse thresholds each pixel and passes weight/divisor of the
+// difference on to each neighbour in kernel. darkness is modified.
+func ditherDiffuse(darkness []int, width int, height int, kernel []diffusion, divisor int) []byte {
+	widthBytes := (width + 7) / 8
+	out := make([]byte, widthBytes*height)
+	for y := range height {
+		for x := range width {
+			value := darkness[y*width+x]
+			err := value
+			if value >= 128 {
+				setRasterPixel(out, widthBytes, x, y)
+				err = value - 255
+			}
+			for _, d := range kernel {
+				nx, ny := x+d.dx, y+d.dy
+				if nx >= 0 && nx < width && ny < height {
+					darkness[ny*width+nx] += err * d.weight / divisor
+				}
+			}
+		}
+	}
+	return out
+}
+
+// BAYER_MATRIX is the 8x8 ordered dither threshold map
+var BAYER_MATRIX = [8][8]int{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// ditherBayer compares each pixel against a repeating threshold pattern,
+// which gives a regular crosshatch that prints evenly on thermal paper
+func ditherBayer(darkness []int, width int, height int) []byte {
+	widthBytes := (width + 7) / 8
+	out := make([]byte, widthBytes*height)
+	for y := range height {
+		for x := range width {
+			threshold := (BAYER_MATRIX[y%8][x%8]*2 + 1) * 256 / 128
+			if darkness[y*width+x] >= threshold {
+				setRasterPixel(out, widthBytes, x, y)
+			}
+		}
+	}
+	return out
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type InstructionType int
@@ -16,22 +19,183 @@ const (
 	InstImage InstructionType = iota
 	InstPulse
 	InstCut
+	InstText
+	InstFeed
+	InstBarcode
+	InstSymbol
+	InstCommand
 )
 
 type Instruction struct {
-	Type  InstructionType
-	Image *ImageDecoded
+	Type    InstructionType
+	Image   *ImageDecoded
+	Text    *TextDecoded
+	Feed    *FeedDecoded
+	Barcode *BarcodeDecoded
+	Symbol  *SymbolDecoded
+	Command []byte
+	Cut     CutType
+	Pulse   *PulseDecoded
 }
 
 type EposPrint struct {
 	XMLName      xml.Name
 	Instructions []Instruction
+	// DevID, Timeout and PrintJobID come from the <parameter> block of a
+	// SOAP header, when the request has one.
+	DevID      string
+	Timeout    time.Duration
+	PrintJobID string
 }
 
 type ImageDecoded struct {
 	Width  int
 	Height int
 	Data   []byte
+	// Align is left, center or right, from the <image> or the last <text>
+	// that set an alignment. Empty means neither did, and the image is
+	// centered.
+	Align string
+	// Mode is IMAGE_MONO (1 bit per pixel, 1 = black) or IMAGE_GRAY16
+	// (4 bits per pixel, high nibble first, 0 = white to 15 = black)
+	Mode string
+	// Color is the ink the image is printed in on two-color printers:
+	// none, color_1 ... color_4
+	Color string
+	// ContentType, when set, says Data is a PNG, JPEG or BMP file rather
+	// than raster data. Such images are resized to Width, or the receipt
+	// width without one, when printed.
+	ContentType string
+	// Dither is how gray16 and ContentType images are reduced to black
+	// and white; empty selects DEFAULT_DITHER
+	Dither string
+}
+
+// <image mode> values
+const (
+	IMAGE_MONO   = "mono"
+	IMAGE_GRAY16 = "gray16"
+)
+
+// TextStyle is the fully resolved set of <text> attributes in effect for a
+// run of text. ePOS-Print attributes are sticky: a <text> element only
+// changes the attributes it names and the rest carry over from earlier
+// <text> elements in the same document.
+type TextStyle struct {
+	Lang         string
+	Font         string
+	Smooth       bool
+	DoubleWidth  bool
+	DoubleHeight bool
+	Width        int
+	Height       int
+	Reverse      bool
+	Underline    bool
+	Emphasis     bool
+	Color        string
+	Align        string
+}
+
+type TextDecoded struct {
+	Content string
+	Style   TextStyle
+}
+
+type CutType int
+
+const (
+	// CutDefault is a <cut/> without a type attribute: full cut followed by
+	// a two line feed, which is what the proxy has always sent.
+	CutDefault CutType = iota
+	CutNoFeed
+	CutFeed
+	CutReserve
+	CutFullNoFeed
+	CutFullFeed
+	CutFullReserve
+)
+
+var cutTypes = map[string]CutType{
+	"no_feed":          CutNoFeed,
+	"feed":             CutFeed,
+	"reserve":          CutReserve,
+	"full_cut_no_feed": CutFullNoFeed,
+	"full_cut_feed":    CutFullFeed,
+	"full_cut_reserve": CutFullReserve,
+}
+
+func parseCutAttrs(attrs []xml.Attr) (CutType, error) {
+	for _, attr := range attrs {
+		if attr.Name.Local != "type" {
+			continue
+		}
+		cutType, ok := cutTypes[attr.Value]
+		if !ok {
+			return CutDefault, fmt.Errorf("invalid cut attribute type=%q: must be one of no_feed, feed, reserve, full_cut_no_feed, full_cut_feed, full_cut_reserve", attr.Value)
+		}
+		return cutType, nil
+	}
+	return CutDefault, nil
+}
+
+// PulseDecoded holds the <pulse> attributes. Empty fields were not given by
+// the client and fall back to the printer's configured default.
+type PulseDecoded struct {
+	Drawer string
+	Time   string
+}
+
+var pulseDrawers = []string{"drawer_1", "drawer_2"}
+var pulseTimes = []string{"pulse_100", "pulse_200", "pulse_300", "pulse_400", "pulse_500"}
+
+func parsePulseAttrs(attrs []xml.Attr) (*PulseDecoded, error) {
+	pulse := &PulseDecoded{}
+	var err error
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "drawer":
+			pulse.Drawer, err = parseEnumAttr("pulse", attr, pulseDrawers...)
+		case "time":
+			pulse.Time, err = parseEnumAttr("pulse", attr, pulseTimes...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pulse, nil
+}
+
+type FeedMode int
+
+const (
+	// FeedLineFeed prints the buffer and advances one line (bare <feed/>)
+	FeedLineFeed FeedMode = iota
+	// FeedLines advances Amount lines (<feed line="n"/>)
+	FeedLines
+	// FeedUnits advances Amount motion units (<feed unit="n"/>)
+	FeedUnits
+	// FeedPosition advances to the paper position named by Pos (<feed pos="..."/>)
+	FeedPosition
+	// FeedNone only changes line spacing (<feed linespc="n"/>)
+	FeedNone
+)
+
+type FeedDecoded struct {
+	Mode           FeedMode
+	Amount         int
+	Pos            string
+	LineSpacing    int
+	SetLineSpacing bool
+}
+
+func defaultTextStyle() TextStyle {
+	return TextStyle{
+		Lang:   "en",
+		Font:   "font_a",
+		Width:  1,
+		Height: 1,
+		Align:  "left",
+	}
 }
 
 const (
@@ -39,6 +203,66 @@ const (
 	eposNamespaceSuffix = "/epos-print"
 )
 
+// SOAP 1.1 and 1.2 envelope namespaces accepted around <epos-print>
+var soapNamespaces = []string{
+	"http://schemas.xmlsoap.org/soap/envelope/",
+	"http://www.w3.org/2003/05/soap-envelope",
+}
+
+func isSoapElement(name xml.Name, local string) bool {
+	if name.Local != local {
+		return false
+	}
+	for _, ns := range soapNamespaces {
+		if name.Space == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// soapHeader is the ePOS-Print <parameter> block some SDK clients send in
+// the SOAP header.
+type soapHeader struct {
+	Parameter struct {
+		DevID      string `xml:"devid"`
+		Timeout    string `xml:"timeout"`
+		PrintJobID string `xml:"printjobid"`
+	} `xml:"parameter"`
+}
+
+// maxPrintJobID is the longest print job ID ePOS-Print accepts
+const maxPrintJobID = 30
+
+// applySoapHeader validates the SOAP header parameters and stores them on
+// the parsed request.
+func applySoapHeader(epos *EposPrint, header *soapHeader) error {
+	param := header.Parameter
+
+	epos.DevID = strings.TrimSpace(param.DevID)
+
+	if timeout := strings.TrimSpace(param.Timeout); timeout != "" {
+		ms, err := strconv.Atoi(timeout)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("invalid SOAP header timeout %q: must be a positive number of milliseconds", timeout)
+		}
+		epos.Timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	jobID := strings.TrimSpace(param.PrintJobID)
+	if len(jobID) > maxPrintJobID {
+		return fmt.Errorf("invalid SOAP header printjobid: longer than %d characters", maxPrintJobID)
+	}
+	for _, r := range jobID {
+		if !(r >= '0' && r <= '9') && !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') && !strings.ContainsRune("_.-", r) {
+			return fmt.Errorf("invalid SOAP header printjobid %q: only letters, digits, '_', '.' and '-' are allowed", jobID)
+		}
+	}
+	epos.PrintJobID = jobID
+
+	return nil
+}
+
 func isSupportedEposNamespace(namespace string) bool {
 	if !strings.HasPrefix(namespace, eposNamespacePrefix) || !strings.HasSuffix(namespace, eposNamespaceSuffix) {
 		return false
@@ -63,6 +287,126 @@ func isSupportedEposNamespace(namespace string) bool {
 	return true
 }
 
+func parseBoolAttr(element string, attr xml.Attr) (bool, error) {
+	switch attr.Value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s attribute %s=%q: must be true or false", element, attr.Name.Local, attr.Value)
+}
+
+func parseIntAttr(element string, attr xml.Attr, min int, max int) (int, error) {
+	n, err := strconv.Atoi(attr.Value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid %s attribute %s=%q: must be an integer from %d to %d", element, attr.Name.Local, attr.Value, min, max)
+	}
+	return n, nil
+}
+
+func parseEnumAttr(element string, attr xml.Attr, allowed ...string) (string, error) {
+	for _, a := range allowed {
+		if attr.Value == a {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s attribute %s=%q: must be one of %s", element, attr.Name.Local, attr.Value, strings.Join(allowed, ", "))
+}
+
+// applyTextAttrs updates style with the attributes present on a <text>
+// element. Attributes that are not present leave style unchanged.
+func applyTextAttrs(style *TextStyle, attrs []xml.Attr) error {
+	var err error
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "lang":
+			style.Lang, err = parseEnumAttr("text", attr, "en", "ja", "ko", "zh-cn", "zh-tw", "vi")
+		case "font":
+			style.Font, err = parseEnumAttr("text", attr, "font_a", "font_b", "font_c", "font_d", "font_e", "special_a", "special_b")
+		case "smooth":
+			style.Smooth, err = parseBoolAttr("text", attr)
+		case "dw":
+			style.DoubleWidth, err = parseBoolAttr("text", attr)
+		case "dh":
+			style.DoubleHeight, err = parseBoolAttr("text", attr)
+		case "width":
+			style.Width, err = parseIntAttr("text", attr, 1, 8)
+		case "height":
+			style.Height, err = parseIntAttr("text", attr, 1, 8)
+		case "reverse":
+			style.Reverse, err = parseBoolAttr("text", attr)
+		case "ul":
+			style.Underline, err = parseBoolAttr("text", attr)
+		case "em":
+			style.Emphasis, err = parseBoolAttr("text", attr)
+		case "color":
+			style.Color, err = parseEnumAttr("text", attr, "none", "color_1", "color_2")
+		case "align":
+			style.Align, err = parseEnumAttr("text", attr, "left", "center", "right")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseFeedAttrs(attrs []xml.Attr) (*FeedDecoded, error) {
+	feed := &FeedDecoded{Mode: FeedLineFeed}
+	movements := 0
+	var err error
+
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "line":
+			feed.Mode = FeedLines
+			feed.Amount, err = parseIntAttr("feed", attr, 0, 255)
+			movements++
+		case "unit":
+			feed.Mode = FeedUnits
+			feed.Amount, err = parseIntAttr("feed", attr, 0, 255)
+			movements++
+		case "pos":
+			feed.Mode = FeedPosition
+			feed.Pos, err = parseEnumAttr("feed", attr, "peeling", "cutting", "current-tof", "next-tof")
+			movements++
+		case "linespc":
+			feed.LineSpacing, err = parseIntAttr("feed", attr, 0, 255)
+			feed.SetLineSpacing = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if movements > 1 {
+		return nil, fmt.Errorf("invalid feed element: only one of line, unit or pos may be given")
+	}
+	if movements == 0 && feed.SetLineSpacing {
+		feed.Mode = FeedNone
+	}
+
+	return feed, nil
+}
+
+// decodeCommand decodes the hex payload of a <command> element. Whitespace
+// between bytes is ignored.
+func decodeCommand(content string) ([]byte, error) {
+	hexData := strings.Join(strings.Fields(content), "")
+	if hexData == "" {
+		return nil, fmt.Errorf("command element has no data")
+	}
+	if len(hexData)%2 != 0 {
+		return nil, fmt.Errorf("command data has odd length %d: hex bytes must be two digits each", len(hexData))
+	}
+	command, err := hex.DecodeString(hexData)
+	if err != nil {
+		return nil, fmt.Errorf("command data is not valid hex: %w", err)
+	}
+	return command, nil
+}
+
 func Parse(xmlData []byte) (*EposPrint, error) {
 	log.Printf("[PARSER] Starting XML parsing of %d bytes", len(xmlData))
 
@@ -74,8 +418,21 @@ func Parse(xmlData []byte) (*EposPrint, error) {
 
 	var currentImage *ImageDecoded
 	var inImage bool
+	var currentText *TextDecoded
+	var currentBarcode *BarcodeDecoded
+	var barcodeData string
+	var currentSymbol *SymbolDecoded
+	var symbolData string
+	var inCommand bool
+	var commandData string
+	textStyle := defaultTextStyle()
+	// textAlign is the alignment set by the last <text align>, which
+	// images follow unless they set their own
+	textAlign := ""
 	var rootSeen bool
 	var rootOpen bool
+	var inEnvelope bool
+	var inBody bool
 	rootDepth := 0
 	tokenCount := 0
 
@@ -97,7 +454,37 @@ func Parse(xmlData []byte) (*EposPrint, error) {
 			space := se.Name.Space
 			log.Printf("[PARSER] Token %d: StartElement <%s> in namespace '%s'", tokenCount, name, space)
 
+			if !rootSeen && !inEnvelope && isSoapElement(se.Name, "Envelope") {
+				inEnvelope = true
+				log.Printf("[PARSER] Found SOAP envelope, looking for epos-print in the body")
+				continue
+			}
+
+			if !rootSeen && inEnvelope && !inBody && isSoapElement(se.Name, "Header") {
+				var header soapHeader
+				if err := decoder.DecodeElement(&header, &se); err != nil {
+					log.Printf("[PARSER] ERROR: Invalid SOAP header: %v", err)
+					return nil, fmt.Errorf("invalid SOAP header: %w", err)
+				}
+				if err := applySoapHeader(epos, &header); err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				log.Printf("[PARSER] SOAP header parameters: devid=%q, timeout=%v, printjobid=%q",
+					epos.DevID, epos.Timeout, epos.PrintJobID)
+				continue
+			}
+
+			if !rootSeen && inEnvelope && !inBody && isSoapElement(se.Name, "Body") {
+				inBody = true
+				continue
+			}
+
 			if !rootSeen {
+				if inEnvelope && !inBody {
+					log.Printf("[PARSER] ERROR: Unexpected element <%s> in SOAP envelope", name)
+					return nil, fmt.Errorf("unexpected element <%s> in SOAP envelope, expected Header or Body", name)
+				}
 				if name != "epos-print" || !isSupportedEposNamespace(space) {
 					log.Printf("[PARSER] ERROR: Invalid root element <%s> in namespace '%s'", name, space)
 					return nil, fmt.Errorf("invalid EPOS root element <%s> in namespace %q", name, space)
@@ -119,14 +506,25 @@ func Parse(xmlData []byte) (*EposPrint, error) {
 			rootDepth++
 
 			if name == "pulse" && space == epos.XMLName.Space {
-				epos.Instructions = append(epos.Instructions, Instruction{Type: InstPulse})
-				log.Printf("[PARSER] Added instruction: PULSE (kick drawer) [total: %d]", len(epos.Instructions))
+				pulse, err := parsePulseAttrs(se.Attr)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{Type: InstPulse, Pulse: pulse})
+				log.Printf("[PARSER] Added instruction: PULSE (kick drawer, drawer=%q, time=%q) [total: %d]",
+					pulse.Drawer, pulse.Time, len(epos.Instructions))
 			} else if name == "cut" && space == epos.XMLName.Space {
-				epos.Instructions = append(epos.Instructions, Instruction{Type: InstCut})
-				log.Printf("[PARSER] Added instruction: CUT [total: %d]", len(epos.Instructions))
+				cutType, err := parseCutAttrs(se.Attr)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{Type: InstCut, Cut: cutType})
+				log.Printf("[PARSER] Added instruction: CUT (type=%d) [total: %d]", cutType, len(epos.Instructions))
 			} else if name == "image" && space == epos.XMLName.Space {
 				inImage = true
-				currentImage = &ImageDecoded{}
+				currentImage = &ImageDecoded{Align: textAlign}
 				log.Printf("[PARSER] Processing image element with attributes:")
 				for _, attr := range se.Attr {
 					log.Printf("[PARSER]   Attribute: %s = %s", attr.Name.Local, attr.Value)
@@ -134,12 +532,99 @@ func Parse(xmlData []byte) (*EposPrint, error) {
 						fmt.Sscanf(attr.Value, "%d", &currentImage.Width)
 					} else if attr.Name.Local == "height" {
 						fmt.Sscanf(attr.Value, "%d", &currentImage.Height)
+					} else if attr.Name.Local == "align" {
+						if currentImage.Align, err = parseEnumAttr("image", attr, "left", "center", "right"); err != nil {
+							log.Printf("[PARSER] ERROR: %v", err)
+							return nil, err
+						}
+					} else if attr.Name.Local == "mode" {
+						if currentImage.Mode, err = parseEnumAttr("image", attr, IMAGE_MONO, IMAGE_GRAY16); err != nil {
+							log.Printf("[PARSER] ERROR: %v", err)
+							return nil, err
+						}
+					} else if attr.Name.Local == "color" {
+						if currentImage.Color, err = parseEnumAttr("image", attr, "none", "color_1", "color_2", "color_3", "color_4"); err != nil {
+							log.Printf("[PARSER] ERROR: %v", err)
+							return nil, err
+						}
+					} else if attr.Name.Local == "content-type" {
+						currentImage.ContentType = attr.Value
+					} else if attr.Name.Local == "dither" {
+						currentImage.Dither, err = parseEnumAttr("image", attr,
+							DITHER_THRESHOLD, DITHER_FLOYD_STEINBERG, DITHER_ATKINSON, DITHER_BAYER)
+						if err != nil {
+							log.Printf("[PARSER] ERROR: %v", err)
+							return nil, err
+						}
 					}
 				}
-				log.Printf("[PARSER] Image dimensions set: width=%d, height=%d", currentImage.Width, currentImage.Height)
+				if currentImage.Mode == "" {
+					currentImage.Mode = IMAGE_MONO
+				}
+				log.Printf("[PARSER] Image dimensions set: width=%d, height=%d, align=%q, mode=%s, color=%q",
+					currentImage.Width, currentImage.Height, currentImage.Align, currentImage.Mode, currentImage.Color)
+			} else if name == "feed" && space == epos.XMLName.Space {
+				feed, err := parseFeedAttrs(se.Attr)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{Type: InstFeed, Feed: feed})
+				log.Printf("[PARSER] Added instruction: FEED (%+v) [total: %d]", *feed, len(epos.Instructions))
+			} else if name == "barcode" && space == epos.XMLName.Space {
+				currentBarcode, err = parseBarcodeAttrs(se.Attr)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				barcodeData = ""
+				log.Printf("[PARSER] Processing barcode element: type=%s, hri=%s, font=%s, width=%d, height=%d",
+					currentBarcode.Type, currentBarcode.HRI, currentBarcode.Font, currentBarcode.Width, currentBarcode.Height)
+			} else if name == "symbol" && space == epos.XMLName.Space {
+				currentSymbol, err = parseSymbolAttrs(se.Attr)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				symbolData = ""
+				log.Printf("[PARSER] Processing symbol element: type=%s, level=%s, width=%d, height=%d, size=%d",
+					currentSymbol.Type, currentSymbol.Level, currentSymbol.Width, currentSymbol.Height, currentSymbol.Size)
+			} else if name == "command" && space == epos.XMLName.Space {
+				inCommand = true
+				commandData = ""
+				log.Printf("[PARSER] Processing command element")
+			} else if name == "text" && space == epos.XMLName.Space {
+				if err := applyTextAttrs(&textStyle, se.Attr); err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				for _, attr := range se.Attr {
+					if attr.Name.Local == "align" {
+						textAlign = textStyle.Align
+					}
+				}
+				currentText = &TextDecoded{Style: textStyle}
+				log.Printf("[PARSER] Processing text element with style: %+v", textStyle)
 			}
 
 		case xml.CharData:
+			if rootOpen && currentText != nil {
+				currentText.Content += string(se)
+				continue
+			}
+			if rootOpen && currentBarcode != nil {
+				barcodeData += string(se)
+				continue
+			}
+			if rootOpen && currentSymbol != nil {
+				symbolData += string(se)
+				continue
+			}
+			if rootOpen && inCommand {
+				commandData += string(se)
+				continue
+			}
+
 			content := strings.TrimSpace(string(se))
 			if rootOpen && inImage && currentImage != nil && content != "" {
 				log.Printf("[PARSER] Processing base64 image data: %d characters", len(content))
@@ -156,9 +641,32 @@ func Parse(xmlData []byte) (*EposPrint, error) {
 			name := se.Name.Local
 			space := se.Name.Space
 
+			if rootOpen && name == "image" && space == epos.XMLName.Space && inImage && currentImage.ContentType != "" {
+				inImage = false
+				if currentImage.Width < 0 {
+					err := fmt.Errorf("invalid image width %d", currentImage.Width)
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				config, err := checkEncodedImage(currentImage, 0)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{Type: InstImage, Image: currentImage})
+				log.Printf("[PARSER] Added instruction: IMAGE (%s, %dx%d, %d bytes) [total: %d]",
+					currentImage.ContentType, config.Width, config.Height, len(currentImage.Data), len(epos.Instructions))
+				currentImage = nil
+			}
+
 			if rootOpen && name == "image" && space == epos.XMLName.Space && inImage {
 				inImage = false
-				widthBytes, expectedBytes, err := rasterDataSize(currentImage.Width, currentImage.Height)
+				if currentImage.Width <= 0 || currentImage.Height <= 0 {
+					err := fmt.Errorf("invalid image size %dx%d", currentImage.Width, currentImage.Height)
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				widthBytes, expectedBytes, err := imageDataSize(currentImage.Mode, currentImage.Width, currentImage.Height)
 				if err != nil {
 					log.Printf("[PARSER] ERROR: Invalid image dimensions: %v", err)
 					return nil, fmt.Errorf("invalid image dimensions: %w", err)
@@ -183,6 +691,62 @@ func Parse(xmlData []byte) (*EposPrint, error) {
 				currentImage = nil
 			}
 
+			if rootOpen && name == "barcode" && space == epos.XMLName.Space && currentBarcode != nil {
+				if err := setBarcodeData(currentBarcode, barcodeData); err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{
+					Type:    InstBarcode,
+					Barcode: currentBarcode,
+				})
+				log.Printf("[PARSER] Added instruction: BARCODE (type=%s, %d bytes) [total: %d]",
+					currentBarcode.Type, len(currentBarcode.Data), len(epos.Instructions))
+				currentBarcode = nil
+			}
+
+			if rootOpen && name == "symbol" && space == epos.XMLName.Space && currentSymbol != nil {
+				if err := setSymbolData(currentSymbol, symbolData); err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{
+					Type:   InstSymbol,
+					Symbol: currentSymbol,
+				})
+				log.Printf("[PARSER] Added instruction: SYMBOL (type=%s, %d bytes) [total: %d]",
+					currentSymbol.Type, len(currentSymbol.Data), len(epos.Instructions))
+				currentSymbol = nil
+			}
+
+			if rootOpen && name == "command" && space == epos.XMLName.Space && inCommand {
+				inCommand = false
+				command, err := decodeCommand(commandData)
+				if err != nil {
+					log.Printf("[PARSER] ERROR: %v", err)
+					return nil, err
+				}
+				epos.Instructions = append(epos.Instructions, Instruction{
+					Type:    InstCommand,
+					Command: command,
+				})
+				log.Printf("[PARSER] Added instruction: COMMAND (%d bytes) [total: %d]", len(command), len(epos.Instructions))
+			}
+
+			if rootOpen && name == "text" && space == epos.XMLName.Space && currentText != nil {
+				if currentText.Content != "" {
+					epos.Instructions = append(epos.Instructions, Instruction{
+						Type: InstText,
+						Text: currentText,
+					})
+					log.Printf("[PARSER] Added instruction: TEXT (%d characters) [total: %d]",
+						len(currentText.Content), len(epos.Instructions))
+				} else {
+					log.Printf("[PARSER] Text element has no content, attributes carried forward only")
+				}
+				currentText = nil
+			}
+
 			if rootOpen {
 				rootDepth--
 				if rootDepth == 0 {
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/base64"
+	"image"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Core Functionality Tests
@@ -81,6 +83,95 @@ func TestParse_MultipleInstructions(t *testing.T) {
 	}
 }
 
+func TestParse_ImageAlign(t *testing.T) {
+	xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">
+	<image width="8" height="1">AA==</image>
+	<image width="8" height="1" align="left">AA==</image>
+	<text align="right">total</text>
+	<image width="8" height="1">AA==</image>
+	<image width="8" height="1" align="center">AA==</image>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var aligns []string
+	for _, inst := range result.Instructions {
+		if inst.Type == InstImage {
+			aligns = append(aligns, inst.Image.Align)
+		}
+	}
+	expected := []string{"", "left", "right", "center"}
+	if strings.Join(aligns, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected image alignments %q, got %q", expected, aligns)
+	}
+
+	invalid := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">` +
+		`<image width="8" height="1" align="middle">AA==</image></epos-print>`
+	if _, err := Parse([]byte(invalid)); err == nil {
+		t.Errorf("expected error for invalid image align")
+	}
+}
+
+func TestParse_ImageContentType(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString(encodePNG(t, image.NewGray(image.Rect(0, 0, 3, 2))))
+	xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">` +
+		`<image content-type="image/png" dither="atkinson" width="200">` + png + `</image></epos-print>`
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	img := result.Instructions[0].Image
+	if img.ContentType != "image/png" || img.Dither != DITHER_ATKINSON || img.Width != 200 {
+		t.Errorf("unexpected image: %+v", img)
+	}
+
+	tests := []struct {
+		name string
+		xml  string
+	}{
+		{"unsupported type", `<image content-type="image/gif">` + png + `</image>`},
+		{"wrong type", `<image content-type="image/bmp">` + png + `</image>`},
+		{"bad dither", `<image content-type="image/png" dither="halftone">` + png + `</image>`},
+	}
+	for _, tt := range tests {
+		xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">` + tt.xml + `</epos-print>`
+		if _, err := Parse([]byte(xml)); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestParse_ImageGray16(t *testing.T) {
+	// 3x2 pixels at 4 bits each is 2 bytes per row
+	xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">` +
+		`<image width="3" height="2" mode="gray16" color="color_2">AAAAAA==</image></epos-print>`
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	image := result.Instructions[0].Image
+	if image.Mode != IMAGE_GRAY16 || image.Color != "color_2" || len(image.Data) != 4 {
+		t.Errorf("unexpected image: %+v", image)
+	}
+
+	tests := []struct {
+		name string
+		xml  string
+	}{
+		{"mono size", `<image width="3" height="2">AAAAAA==</image>`},
+		{"bad mode", `<image width="8" height="1" mode="gray256">AA==</image>`},
+		{"bad color", `<image width="8" height="1" color="red">AA==</image>`},
+	}
+	for _, tt := range tests {
+		xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">` + tt.xml + `</epos-print>`
+		if _, err := Parse([]byte(xml)); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
 func TestParse_EmptyXML(t *testing.T) {
 	xml := ``
 
@@ -281,6 +372,19 @@ func TestParse_NonByteAlignedWidthRejectsShortData(t *testing.T) {
 	}
 }
 
+func TestParse_ImageZeroSize(t *testing.T) {
+	for _, attrs := range []string{`width="1000" height="0"`, `width="0" height="8"`} {
+		xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<image ` + attrs + `></image>
+</epos-print>`
+
+		if _, err := Parse([]byte(xml)); err == nil || !strings.Contains(err.Error(), "invalid image size") {
+			t.Errorf("%s: expected invalid image size error, got: %v", attrs, err)
+		}
+	}
+}
+
 func TestParse_InvalidBase64(t *testing.T) {
 	xml := `<?xml version="1.0" encoding="UTF-8"?>
 <epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
@@ -351,40 +455,20 @@ func TestParse_ZeroDimensions(t *testing.T) {
 	<image width="0" height="0"></image>
 </epos-print>`
 
-	result, err := Parse([]byte(xml))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-
-	if len(result.Instructions) != 1 {
-		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
-	}
-
-	img := result.Instructions[0].Image
-	if img.Width != 0 || img.Height != 0 {
-		t.Errorf("expected 0x0 dimensions, got %dx%d", img.Width, img.Height)
+	if _, err := Parse([]byte(xml)); err == nil || !strings.Contains(err.Error(), "invalid image size") {
+		t.Errorf("expected invalid image size error, got: %v", err)
 	}
 }
 
 func TestParse_MissingWidthHeight(t *testing.T) {
-	// Default to 0, expected bytes = (0/8) * 0 = 0
+	// Width and height default to 0, which no raster image can have
 	xml := `<?xml version="1.0" encoding="UTF-8"?>
 <epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
 	<image></image>
 </epos-print>`
 
-	result, err := Parse([]byte(xml))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-
-	if len(result.Instructions) != 1 {
-		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
-	}
-
-	img := result.Instructions[0].Image
-	if img.Width != 0 || img.Height != 0 {
-		t.Errorf("expected 0x0 dimensions (defaults), got %dx%d", img.Width, img.Height)
+	if _, err := Parse([]byte(xml)); err == nil || !strings.Contains(err.Error(), "invalid image size") {
+		t.Errorf("expected invalid image size error, got: %v", err)
 	}
 }
 
@@ -418,24 +502,14 @@ func TestParse_WhitespaceInImageData(t *testing.T) {
 // Attribute Edge Cases
 
 func TestParse_NonNumericDimensions(t *testing.T) {
-	// Non-numeric width/height default to 0, so no image data needed
+	// Non-numeric width/height default to 0, which no raster image can have
 	xml := `<?xml version="1.0" encoding="UTF-8"?>
 <epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
 	<image width="abc" height="def"></image>
 </epos-print>`
 
-	result, err := Parse([]byte(xml))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-
-	if len(result.Instructions) != 1 {
-		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
-	}
-
-	img := result.Instructions[0].Image
-	if img.Width != 0 || img.Height != 0 {
-		t.Errorf("expected 0x0 dimensions (invalid parsed), got %dx%d", img.Width, img.Height)
+	if _, err := Parse([]byte(xml)); err == nil || !strings.Contains(err.Error(), "invalid image size") {
+		t.Errorf("expected invalid image size error, got: %v", err)
 	}
 }
 
@@ -478,3 +552,563 @@ func TestParse_VeryLargeDimensions(t *testing.T) {
 		t.Logf("Parser returned partial result with %d instructions", len(result.Instructions))
 	}
 }
+
+// Text Elements
+
+func TestParse_TextElement(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<text lang="en" font="font_b" smooth="true" dw="true" dh="false" width="2" height="3" reverse="true" ul="true" em="true" color="color_2" align="center">Hello&#10;</text>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 1 {
+		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
+	}
+
+	inst := result.Instructions[0]
+	if inst.Type != InstText {
+		t.Fatalf("expected instruction to be Text, got %v", inst.Type)
+	}
+	if inst.Text.Content != "Hello\n" {
+		t.Errorf("expected content %q, got %q", "Hello\n", inst.Text.Content)
+	}
+
+	expected := TextStyle{
+		Lang:         "en",
+		Font:         "font_b",
+		Smooth:       true,
+		DoubleWidth:  true,
+		DoubleHeight: false,
+		Width:        2,
+		Height:       3,
+		Reverse:      true,
+		Underline:    true,
+		Emphasis:     true,
+		Color:        "color_2",
+		Align:        "center",
+	}
+	if inst.Text.Style != expected {
+		t.Errorf("expected style %+v, got %+v", expected, inst.Text.Style)
+	}
+}
+
+func TestParse_TextAttributesAreSticky(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<text align="center"/>
+	<text em="true">Title&#10;</text>
+	<text em="false">Body&#10;</text>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 2 {
+		t.Fatalf("expected 2 instructions (attribute-only text emits none), got %d", len(result.Instructions))
+	}
+
+	first := result.Instructions[0].Text.Style
+	if first.Align != "center" || !first.Emphasis {
+		t.Errorf("expected centered emphasized title, got %+v", first)
+	}
+
+	second := result.Instructions[1].Text.Style
+	if second.Align != "center" || second.Emphasis {
+		t.Errorf("expected centered non-emphasized body, got %+v", second)
+	}
+}
+
+func TestParse_TextInvalidAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		attr string
+	}{
+		{name: "bad bool", attr: `em="yes"`},
+		{name: "width too large", attr: `width="9"`},
+		{name: "height not a number", attr: `height="tall"`},
+		{name: "unknown font", attr: `font="font_z"`},
+		{name: "unknown align", attr: `align="justify"`},
+		{name: "unsupported color", attr: `color="color_4"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print"><text ` + tt.attr + `>x</text></epos-print>`
+			_, err := Parse([]byte(xml))
+			if err == nil {
+				t.Fatalf("expected error for %s, got nil", tt.attr)
+			}
+		})
+	}
+}
+
+// Feed Elements
+
+func TestParse_FeedVariants(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<feed/>
+	<feed line="3"/>
+	<feed unit="40" linespc="24"/>
+	<feed pos="cutting"/>
+	<feed linespc="30"/>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []FeedDecoded{
+		{Mode: FeedLineFeed},
+		{Mode: FeedLines, Amount: 3},
+		{Mode: FeedUnits, Amount: 40, LineSpacing: 24, SetLineSpacing: true},
+		{Mode: FeedPosition, Pos: "cutting"},
+		{Mode: FeedNone, LineSpacing: 30, SetLineSpacing: true},
+	}
+
+	if len(result.Instructions) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d", len(expected), len(result.Instructions))
+	}
+
+	for i, exp := range expected {
+		inst := result.Instructions[i]
+		if inst.Type != InstFeed {
+			t.Fatalf("instruction %d: expected Feed, got %v", i, inst.Type)
+		}
+		if *inst.Feed != exp {
+			t.Errorf("instruction %d: expected %+v, got %+v", i, exp, *inst.Feed)
+		}
+	}
+}
+
+func TestParse_FeedInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		elem string
+	}{
+		{name: "line and unit", elem: `<feed line="1" unit="10"/>`},
+		{name: "line out of range", elem: `<feed line="256"/>`},
+		{name: "unknown pos", elem: `<feed pos="somewhere"/>`},
+		{name: "negative linespc", elem: `<feed linespc="-1"/>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">` + tt.elem + `</epos-print>`
+			_, err := Parse([]byte(xml))
+			if err == nil {
+				t.Fatalf("expected error for %s, got nil", tt.elem)
+			}
+		})
+	}
+}
+
+// Barcode Elements
+
+func TestParse_Barcode(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<barcode type="code128" hri="below" font="font_b" width="2" height="64">ORDER-1042</barcode>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 1 {
+		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
+	}
+
+	inst := result.Instructions[0]
+	if inst.Type != InstBarcode {
+		t.Fatalf("expected instruction to be Barcode, got %v", inst.Type)
+	}
+
+	bc := inst.Barcode
+	if bc.Type != "code128" || bc.HRI != "below" || bc.Font != "font_b" || bc.Width != 2 || bc.Height != 64 {
+		t.Errorf("unexpected barcode attributes: %+v", bc)
+	}
+	if string(bc.Data) != "{BORDER-1042" {
+		t.Errorf("expected code128 data with code set B prefix, got %q", bc.Data)
+	}
+}
+
+func TestParse_BarcodeDefaults(t *testing.T) {
+	xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print"><barcode type="ean13">4901234567894</barcode></epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bc := result.Instructions[0].Barcode
+	if bc.HRI != "none" || bc.Font != "font_a" || bc.Width != 3 || bc.Height != 162 {
+		t.Errorf("expected ePOS defaults, got %+v", bc)
+	}
+}
+
+func TestParse_BarcodeValidData(t *testing.T) {
+	tests := []struct {
+		barcodeType string
+		data        string
+	}{
+		{"upc_a", "03600029145"},
+		{"upc_a", "036000291452"},
+		{"upc_e", "01234565"},
+		{"ean13", "490123456789"},
+		{"jan13", "4901234567894"},
+		{"ean8", "96385074"},
+		{"code39", "ABC-123 $"},
+		{"itf", "12345678"},
+		{"codabar", "A40156B"},
+		{"code93", "Hello"},
+		{"code128", "{C0123"},
+		{"code128", "{AAB&#9;C"},
+		{"code39", "\n\t\tABC-123\n\t"},
+		{"gs1_128", "(01)04912345123459"},
+		{"gs1_databar_omnidirectional", "0491234512345"},
+		{"gs1_databar_limited", "1491234512345"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.barcodeType+"/"+tt.data, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print"><barcode type="` + tt.barcodeType + `">` + tt.data + `</barcode></epos-print>`
+			if _, err := Parse([]byte(xml)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParse_BarcodeInvalidData(t *testing.T) {
+	tests := []struct {
+		name        string
+		barcodeType string
+		data        string
+	}{
+		{"upc_a bad check digit", "upc_a", "036000291453"},
+		{"upc_e bad check digit", "upc_e", "01234566"},
+		{"ean13 bad check digit", "ean13", "4901234567890"},
+		{"ean13 letters", "ean13", "49012345678A"},
+		{"ean8 wrong length", "ean8", "123"},
+		{"code39 lowercase", "code39", "abc"},
+		{"itf odd length", "itf", "12345"},
+		{"codabar missing stop", "codabar", "A40156"},
+		{"code128 non-ascii", "code128", "café"},
+		{"code128 set b control character", "code128", "AB&#9;C"},
+		{"code128 switch to set b control character", "code128", "{AAB{BC&#9;D"},
+		{"databar limited leading digit", "gs1_databar_limited", "2491234512345"},
+		{"empty data", "code93", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print"><barcode type="` + tt.barcodeType + `">` + tt.data + `</barcode></epos-print>`
+			if _, err := Parse([]byte(xml)); err == nil {
+				t.Fatalf("expected error for %s data %q, got nil", tt.barcodeType, tt.data)
+			}
+		})
+	}
+}
+
+func TestParse_BarcodeInvalidAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		elem string
+	}{
+		{name: "missing type", elem: `<barcode>123</barcode>`},
+		{name: "unknown type", elem: `<barcode type="code11">123</barcode>`},
+		{name: "width too small", elem: `<barcode type="code93" width="1">A</barcode>`},
+		{name: "bad hri", elem: `<barcode type="code93" hri="middle">A</barcode>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">` + tt.elem + `</epos-print>`
+			if _, err := Parse([]byte(xml)); err == nil {
+				t.Fatalf("expected error for %s, got nil", tt.elem)
+			}
+		})
+	}
+}
+
+// Symbol Elements
+
+func TestParse_Symbol(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<symbol type="qrcode_model_2" level="level_m" width="6">https://example.com/r/42</symbol>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 1 {
+		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
+	}
+
+	inst := result.Instructions[0]
+	if inst.Type != InstSymbol {
+		t.Fatalf("expected instruction to be Symbol, got %v", inst.Type)
+	}
+
+	sym := inst.Symbol
+	if sym.Type != "qrcode_model_2" || sym.Level != "level_m" || sym.Width != 6 {
+		t.Errorf("unexpected symbol attributes: %+v", sym)
+	}
+	if string(sym.Data) != "https://example.com/r/42" {
+		t.Errorf("unexpected symbol data: %q", sym.Data)
+	}
+}
+
+func TestParse_SymbolInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		elem string
+	}{
+		{name: "missing type", elem: `<symbol>data</symbol>`},
+		{name: "unknown type", elem: `<symbol type="aztec_full_range">data</symbol>`},
+		{name: "qr level from pdf417", elem: `<symbol type="qrcode_model_2" level="level_3">data</symbol>`},
+		{name: "pdf417 level from qr", elem: `<symbol type="pdf417_standard" level="level_h">data</symbol>`},
+		{name: "qr module too large", elem: `<symbol type="qrcode_model_2" width="17">data</symbol>`},
+		{name: "pdf417 row height too small", elem: `<symbol type="pdf417_standard" height="1">data</symbol>`},
+		{name: "empty data", elem: `<symbol type="qrcode_model_2"></symbol>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">` + tt.elem + `</epos-print>`
+			if _, err := Parse([]byte(xml)); err == nil {
+				t.Fatalf("expected error for %s, got nil", tt.elem)
+			}
+		})
+	}
+}
+
+// Command Elements
+
+func TestParse_Command(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<command>1b 40 1B61 01</command>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 1 {
+		t.Fatalf("expected 1 instruction, got %d", len(result.Instructions))
+	}
+
+	inst := result.Instructions[0]
+	if inst.Type != InstCommand {
+		t.Fatalf("expected instruction to be Command, got %v", inst.Type)
+	}
+
+	expected := "\x1b\x40\x1b\x61\x01"
+	if string(inst.Command) != expected {
+		t.Errorf("expected command %x, got %x", expected, inst.Command)
+	}
+}
+
+func TestParse_CommandInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errText string
+	}{
+		{name: "odd length", content: "1b4", errText: "odd length"},
+		{name: "invalid hex", content: "zz", errText: "not valid hex"},
+		{name: "empty", content: "  ", errText: "no data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print"><command>` + tt.content + `</command></epos-print>`
+			_, err := Parse([]byte(xml))
+			if err == nil {
+				t.Fatalf("expected error for %q, got nil", tt.content)
+			}
+			if !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("expected error containing %q, got: %v", tt.errText, err)
+			}
+		})
+	}
+}
+
+// Cut Elements
+
+func TestParse_CutTypes(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<cut/>
+	<cut type="no_feed"/>
+	<cut type="feed"/>
+	<cut type="reserve"/>
+	<cut type="full_cut_no_feed"/>
+	<cut type="full_cut_feed"/>
+	<cut type="full_cut_reserve"/>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []CutType{CutDefault, CutNoFeed, CutFeed, CutReserve, CutFullNoFeed, CutFullFeed, CutFullReserve}
+	if len(result.Instructions) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d", len(expected), len(result.Instructions))
+	}
+
+	for i, exp := range expected {
+		if result.Instructions[i].Type != InstCut {
+			t.Fatalf("instruction %d: expected Cut, got %v", i, result.Instructions[i].Type)
+		}
+		if result.Instructions[i].Cut != exp {
+			t.Errorf("instruction %d: expected cut type %d, got %d", i, exp, result.Instructions[i].Cut)
+		}
+	}
+}
+
+func TestParse_CutInvalidType(t *testing.T) {
+	xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print"><cut type="half"/></epos-print>`
+
+	if _, err := Parse([]byte(xml)); err == nil {
+		t.Fatal("expected error for unknown cut type, got nil")
+	}
+}
+
+// Pulse Elements
+
+func TestParse_PulseAttributes(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">
+	<pulse/>
+	<pulse drawer="drawer_2" time="pulse_200"/>
+</epos-print>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 2 {
+		t.Fatalf("expected 2 instructions, got %d", len(result.Instructions))
+	}
+
+	if *result.Instructions[0].Pulse != (PulseDecoded{}) {
+		t.Errorf("expected bare pulse to leave attributes empty, got %+v", *result.Instructions[0].Pulse)
+	}
+
+	expected := PulseDecoded{Drawer: "drawer_2", Time: "pulse_200"}
+	if *result.Instructions[1].Pulse != expected {
+		t.Errorf("expected %+v, got %+v", expected, *result.Instructions[1].Pulse)
+	}
+}
+
+func TestParse_PulseInvalidAttributes(t *testing.T) {
+	for _, elem := range []string{`<pulse drawer="drawer_3"/>`, `<pulse time="pulse_600"/>`} {
+		xml := `<epos-print xmlns="http://www.epson-pos.com/schemas/2012/10/epos-print">` + elem + `</epos-print>`
+		if _, err := Parse([]byte(xml)); err == nil {
+			t.Errorf("expected error for %s, got nil", elem)
+		}
+	}
+}
+
+func TestParse_SoapEnvelope(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+	<s:Header>
+		<parameter xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">
+			<devid>local_printer</devid>
+			<timeout>10000</timeout>
+			<printjobid>ABC123</printjobid>
+		</parameter>
+	</s:Header>
+	<s:Body>
+		<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">
+			<text>Hi</text>
+			<cut/>
+		</epos-print>
+	</s:Body>
+</s:Envelope>`
+
+	result, err := Parse([]byte(xml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Instructions) != 2 {
+		t.Fatalf("expected 2 instructions, got %d", len(result.Instructions))
+	}
+	if result.DevID != "local_printer" {
+		t.Errorf("expected devid local_printer, got %q", result.DevID)
+	}
+	if result.Timeout != 10*time.Second {
+		t.Errorf("expected timeout 10s, got %v", result.Timeout)
+	}
+	if result.PrintJobID != "ABC123" {
+		t.Errorf("expected printjobid ABC123, got %q", result.PrintJobID)
+	}
+}
+
+func TestParse_SoapEnvelopeWithoutHeader(t *testing.T) {
+	tests := []string{
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+			<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print"><pulse/></epos-print>
+		</s:Body></s:Envelope>`,
+		`<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body>
+			<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print"><pulse/></epos-print>
+		</env:Body></env:Envelope>`,
+	}
+
+	for _, xml := range tests {
+		result, err := Parse([]byte(xml))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if len(result.Instructions) != 1 || result.Instructions[0].Type != InstPulse {
+			t.Errorf("expected a single pulse instruction, got %+v", result.Instructions)
+		}
+		if result.DevID != "" || result.Timeout != 0 || result.PrintJobID != "" {
+			t.Errorf("expected no header parameters, got devid=%q timeout=%v printjobid=%q",
+				result.DevID, result.Timeout, result.PrintJobID)
+		}
+	}
+}
+
+func TestParse_SoapEnvelopeInvalid(t *testing.T) {
+	body := `<s:Body><epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print"><pulse/></epos-print></s:Body>`
+	tests := []struct {
+		name string
+		xml  string
+	}{
+		{"unknown envelope namespace", `<s:Envelope xmlns:s="http://example.com/soap">` + body + `</s:Envelope>`},
+		{"missing body", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"></s:Envelope>`},
+		{"epos-print outside body", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print"/></s:Envelope>`},
+		{"empty body", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body></s:Body></s:Envelope>`},
+		{"bad timeout", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter><timeout>soon</timeout></parameter></s:Header>` + body + `</s:Envelope>`},
+		{"bad printjobid", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter><printjobid>a b</printjobid></parameter></s:Header>` + body + `</s:Envelope>`},
+		{"long printjobid", `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter><printjobid>` + strings.Repeat("a", 31) + `</printjobid></parameter></s:Header>` + body + `</s:Envelope>`},
+	}
+
+	for _, tt := range tests {
+		if _, err := Parse([]byte(tt.xml)); err == nil {
+			t.Errorf("%s: expected error, got nil", tt.name)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DEFAULT_IDEMPOTENCY_TTL is how long the result of a job is kept for
+// clients that resubmit it with the same key
+const DEFAULT_IDEMPOTENCY_TTL = 24 * time.Hour
+
+// DEFAULT_IDEMPOTENCY_KEYS caps how many results are kept at once
+const DEFAULT_IDEMPOTENCY_KEYS = 10000
+
+// MAX_IDEMPOTENCY_KEY_LENGTH caps the Idempotency-Key header
+const MAX_IDEMPOTENCY_KEY_LENGTH = 255
+
+// idempotencyEntry is the outcome of the first request made with a key.
+// done is closed once the outcome is known: when a synchronous job has
+// finished or an asynchronous one has been accepted. A released entry
+// printed nothing, so whoever was waiting on it may try again.
+type idempotencyEntry struct {
+	// fingerprint identifies the request that made the entry, so that a
+	// key reused for a different job can be told apart from a retry
+	fingerprint string
+	done        chan struct{}
+	released    bool
+	httpStatus  int
+	response    EposResponse
+	jobID       string
+	expires     time.Time
+}
+
+// matches reports whether a request with fingerprint repeats the one that
+// made the entry. Entries recovered from an older journal have no
+// fingerprint and match any request.
+func (e *idempotencyEntry) matches(fingerprint string) bool {
+	return e.fingerprint == "" || fingerprint == "" || e.fingerprint == fingerprint
+}
+
+// idempotencyScope scopes a key to the printer it was used with, so that a
+// client numbering its jobs per printer can reuse a key on another one
+func idempotencyScope(devid string, key string) string {
+	return devid + "\x00" + key
+}
+
+// requestFingerprint hashes what decides which job a request prints: its
+// path, body and query, except for the parameters that only say how to
+// wait for it
+func requestFingerprint(r *http.Request, body []byte) string {
+	query := r.URL.Query()
+	query.Del("timeout")
+	query.Del("async")
+	query.Del("devid")
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path + "?" + query.Encode() + "\x00"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IdempotencyStore remembers job outcomes by idempotency key so that a
+// client retrying after a network failure gets the original result instead
+// of a second receipt.
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{entries: map[string]*idempotencyEntry{}}
+}
+
+// Claim returns the entry for key. owner is true when the caller made the
+// first request with it and must finish the entry with Complete, Accept or
+// Release. Otherwise Claim waits until the entry's outcome is known; ok is
+// false if ctx ends first. An entry made by a different request, which the
+// caller should refuse, is returned at once.
+func (s *IdempotencyStore) Claim(ctx context.Context, key string, fingerprint string, maxKeys int) (entry *idempotencyEntry, owner bool, ok bool) {
+	for {
+		entry, owner := s.claim(key, fingerprint, maxKeys)
+		if owner || !entry.matches(fingerprint) {
+			return entry, owner, true
+		}
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, false, false
+		}
+		if !entry.released {
+			return entry, false, true
+		}
+	}
+}
+
+func (s *IdempotencyStore) claim(key string, fingerprint string, maxKeys int) (*idempotencyEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.entries[key]; ok {
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			return entry, false
+		}
+		delete(s.entries, key)
+	}
+	if len(s.entries) >= maxKeys {
+		s.evict(now, maxKeys)
+	}
+
+	entry := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = entry
+	return entry, true
+}
+
+// evict drops expired entries and, if still at the limit, the finished
+// entries closest to expiry. Entries still in flight are always kept.
+func (s *IdempotencyStore) evict(now time.Time, maxKeys int) {
+	var finished []string
+	for key, entry := range s.entries {
+		switch {
+		case entry.expires.IsZero():
+		case !now.Before(entry.expires):
+			delete(s.entries, key)
+		default:
+			finished = append(finished, key)
+		}
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return s.entries[finished[i]].expires.Before(s.entries[finished[j]].expires)
+	})
+	for _, key := range finished {
+		if len(s.entries) < maxKeys {
+			break
+		}
+		delete(s.entries, key)
+	}
+}
+
+// Complete records the result of a synchronous job
+func (s *IdempotencyStore) Complete(entry *idempotencyEntry, httpStatus int, resp EposResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.httpStatus = httpStatus
+	entry.response = resp
+	entry.expires = time.Now().Add(ttl)
+	close(entry.done)
+}
+
+// Accept records the job ID of an asynchronous job. It does nothing if the
+// job was already released.
+func (s *IdempotencyStore) Accept(entry *idempotencyEntry, jobID string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-entry.done:
+	default:
+		entry.jobID = jobID
+		entry.expires = time.Now().Add(ttl)
+		close(entry.done)
+	}
+}
+
+// Release forgets a key whose job never reached the printer, so the next
+// request with it prints. It may also be called after Accept for an
+// asynchronous job that expired in the queue.
+func (s *IdempotencyStore) Release(key string, entry *idempotencyEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[key] == entry {
+		delete(s.entries, key)
+	}
+	select {
+	case <-entry.done:
+	default:
+		entry.released = true
+		close(entry.done)
+	}
+}
+
+// replay answers a repeated request with the outcome of the first one
+func (s *Server) replay(w http.ResponseWriter, requestID int, key string, entry *idempotencyEntry, respond func(int, EposResponse)) {
+	log.Printf("[IDEMPOTENCY] Request #%d: Key %q already used, returning the original result", requestID, key)
+	w.Header().Set("Idempotent-Replayed", "true")
+
+	if entry.jobID != "" {
+		record, ok := s.jobs.Get(entry.jobID)
+		if !ok {
+			record = jobRecord{ID: entry.jobID}
+		}
+		w.Header().Set("Location", "/jobs/"+entry.jobID)
+		writeJobJSON(w, http.StatusAccepted, record)
+		return
+	}
+	respond(entry.httpStatus, entry.response)
+}
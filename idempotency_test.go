@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postWithKey(s *Server, target string, body string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_IdempotencyKey(t *testing.T) {
+	s, conn := createTestServer()
+
+	first := postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	writes := len(conn.WriteRawCalls)
+
+	second := postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1")
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("expected the original result, got %d: %s", second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected replayed response to be marked")
+	}
+	if len(conn.WriteRawCalls) != writes {
+		t.Errorf("expected no bytes sent for a repeated key, got %d more writes", len(conn.WriteRawCalls)-writes)
+	}
+
+	postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-2")
+	if len(conn.WriteRawCalls) == writes {
+		t.Errorf("expected a new key to print")
+	}
+}
+
+func TestServer_IdempotencyPrintJobID(t *testing.T) {
+	s, conn := createTestServer()
+	envelope := `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter>` +
+		`<printjobid>order-42</printjobid></parameter></s:Header><s:Body>` + testJob + `</s:Body></s:Envelope>`
+
+	postJob(s, EPOS_SERVICE_PATH, envelope)
+	writes := len(conn.WriteRawCalls)
+	rec := postJob(s, EPOS_SERVICE_PATH, envelope)
+	if len(conn.WriteRawCalls) != writes {
+		t.Errorf("expected repeated printjobid not to print again")
+	}
+	if !strings.Contains(rec.Body.String(), "<printjobid>order-42</printjobid>") {
+		t.Errorf("expected printjobid echo in replay, got %s", rec.Body.String())
+	}
+
+	// Without a TTL every submission prints
+	s.current().limits.IdempotencyTTL = 0
+	postJob(s, EPOS_SERVICE_PATH, envelope)
+	if len(conn.WriteRawCalls) == writes {
+		t.Errorf("expected deduplication to be off with a zero TTL")
+	}
+}
+
+func TestServer_IdempotencyWaitsForJobInFlight(t *testing.T) {
+	conn := &gatedWritable{gate: make(chan struct{}), started: make(chan struct{}, 1)}
+	s := createQueueTestServer(conn, 16)
+
+	results := make(chan *httptest.ResponseRecorder, 2)
+	go func() { results <- postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1") }()
+	<-conn.started
+	go func() { results <- postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1") }()
+
+	time.Sleep(10 * time.Millisecond)
+	close(conn.gate)
+	first, second := <-results, <-results
+	if first.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("expected both requests to get the same result, got %d %s and %d %s",
+			first.Code, first.Body.String(), second.Code, second.Body.String())
+	}
+
+	receipts := 0
+	for _, w := range conn.writes {
+		if bytes.Contains(w, []byte("Hi")) {
+			receipts++
+		}
+	}
+	if receipts != 1 {
+		t.Errorf("expected one receipt, got %d", receipts)
+	}
+}
+
+func TestServer_IdempotencyAsync(t *testing.T) {
+	s, _ := createTestServer()
+
+	first := postWithKey(s, EPOS_SERVICE_PATH+"?async=true", testJob, "order-1")
+	second := postWithKey(s, EPOS_SERVICE_PATH+"?async=true", testJob, "order-1")
+	if second.Code != http.StatusAccepted || second.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("expected repeated async submission to return the same job, got %d %q and %q",
+			second.Code, first.Header().Get("Location"), second.Header().Get("Location"))
+	}
+}
+
+func TestServer_IdempotencyScopedByDevice(t *testing.T) {
+	kitchen, bar := &MockWritable{}, &MockWritable{}
+	printers := NewPrinterRegistry("kitchen")
+	printers.Add("kitchen", &Printer{connection_string: "/kitchen", receipt_width: 576, connection: kitchen})
+	printers.Add("bar", &Printer{connection_string: "/bar", receipt_width: 576, connection: bar})
+	s := NewServer(printers, nil, nil, DefaultConfig().Limits)
+
+	postWithKey(s, EPOS_SERVICE_PATH+"?devid=kitchen", testJob, "order-1")
+	postWithKey(s, EPOS_SERVICE_PATH+"?devid=bar", testJob, "order-1")
+	if len(kitchen.WriteRawCalls) == 0 || len(bar.WriteRawCalls) == 0 {
+		t.Errorf("expected a key reused on another printer to print there")
+	}
+
+	// The default printer shares keys with requests that name it
+	writes := len(kitchen.WriteRawCalls)
+	if rec := postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the default printer's key to be replayed")
+	}
+	if len(kitchen.WriteRawCalls) != writes {
+		t.Errorf("expected no reprint on the default printer")
+	}
+}
+
+func TestServer_IdempotencyKeyReusedForDifferentJob(t *testing.T) {
+	s, conn := createTestServer()
+
+	postWithKey(s, EPOS_SERVICE_PATH+"?timeout=5000", testJob, "order-1")
+	writes := len(conn.WriteRawCalls)
+
+	// The same job waited for differently is a retry
+	if rec := postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected a retry with another timeout to be replayed, got %d", rec.Code)
+	}
+
+	other := strings.Replace(testJob, "Hi", "Bye", 1)
+	rec := postWithKey(s, EPOS_SERVICE_PATH, other, "order-1")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a key reused with a different body, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) != writes {
+		t.Errorf("expected nothing printed for a reused key")
+	}
+}
+
+func TestIdempotencyStore_AcceptAfterRelease(t *testing.T) {
+	store := NewIdempotencyStore()
+	entry, _, _ := store.Claim(context.Background(), "a", "", 2)
+	store.Release("a", entry)
+	// An asynchronous job released before it was accepted must not panic
+	store.Accept(entry, "job", time.Minute)
+	if !entry.released || entry.jobID != "" {
+		t.Errorf("expected the entry to stay released, got %+v", entry)
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	store := NewIdempotencyStore()
+	ctx := context.Background()
+
+	entry, owner, _ := store.Claim(ctx, "a", "", 2)
+	if !owner {
+		t.Fatal("expected first claim to own the key")
+	}
+	store.Release("a", entry)
+	if _, owner, _ := store.Claim(ctx, "a", "", 2); !owner {
+		t.Errorf("expected a released key to be claimable again")
+	}
+
+	expired, _, _ := store.Claim(ctx, "b", "", 2)
+	store.Complete(expired, http.StatusOK, EposResponse{Success: true}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, owner, _ := store.Claim(ctx, "b", "", 2); !owner {
+		t.Errorf("expected an expired key to be claimable again")
+	}
+}
+
+func TestIdempotencyStore_Evict(t *testing.T) {
+	store := NewIdempotencyStore()
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b"} {
+		entry, _, _ := store.Claim(ctx, key, "", 2)
+		store.Complete(entry, http.StatusOK, EposResponse{Success: true}, time.Hour)
+	}
+	if _, owner, _ := store.Claim(ctx, "a", "", 2); owner {
+		t.Errorf("expected recent key to be remembered")
+	}
+
+	// At the limit the finished key closest to expiry goes; in-flight keys
+	// are kept even beyond it
+	store.Claim(ctx, "c", "", 2)
+	store.Claim(ctx, "d", "", 2)
+	store.mu.Lock()
+	_, keptA := store.entries["a"]
+	_, keptC := store.entries["c"]
+	count := len(store.entries)
+	store.mu.Unlock()
+	if keptA || !keptC || count != 2 {
+		t.Errorf("unexpected entries after eviction: a=%v c=%v count=%d", keptA, keptC, count)
+	}
+}
+
+func TestIdempotencyStore_Cancel(t *testing.T) {
+	store := NewIdempotencyStore()
+	store.Claim(context.Background(), "a", "", 2)
+
+	waitCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, ok := store.Claim(waitCtx, "a", "", 2); ok {
+		t.Errorf("expected waiting on an in-flight key to stop with its context")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"mime"
+)
+
+// MAX_IMAGE_PIXELS caps the size of an uploaded image once decoded, since a
+// small compressed file can expand to far more memory than its size
+const MAX_IMAGE_PIXELS = 16_000_000
+
+// MAX_PRINTED_PIXELS caps the size of an image once resized for the paper.
+// A tall, narrow image grows with its width, so it is checked on its own:
+// 4 million dots is a receipt about 87 cm long on 80 mm paper.
+const MAX_PRINTED_PIXELS = 4_000_000
+
+// imageFormat returns the format named by a content type: png, jpeg or bmp
+func imageFormat(contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	switch mediaType {
+	case "image/png":
+		return "png", nil
+	case "image/jpeg", "image/jpg":
+		return "jpeg", nil
+	case "image/bmp", "image/x-bmp", "image/x-ms-bmp":
+		return "bmp", nil
+	}
+	return "", fmt.Errorf("unsupported image content type %q (must be image/png, image/jpeg or image/bmp)", mediaType)
+}
+
+// encodedImageConfig checks that data is an image of the given content type
+// small enough to decode, and returns its dimensions
+func encodedImageConfig(contentType string, data []byte) (image.Config, error) {
+	format, err := imageFormat(contentType)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	var config image.Config
+	switch format {
+	case "png":
+		config, err = png.DecodeConfig(bytes.NewReader(data))
+	case "jpeg":
+		config, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	case "bmp":
+		config, err = decodeBMPConfig(data)
+	}
+	if err != nil {
+		return image.Config{}, fmt.Errorf("invalid %s image: %w", format, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > MAX_IMAGE_PIXELS/config.Height {
+		return image.Config{}, fmt.Errorf("image of %dx%d pixels exceeds %d pixels", config.Width, config.Height, MAX_IMAGE_PIXELS)
+	}
+	return config, nil
+}
+
+// decodeEncodedImage decodes a PNG, JPEG or BMP image
+func decodeEncodedImage(contentType string, data []byte) (image.Image, error) {
+	if _, err := encodedImageConfig(contentType, data); err != nil {
+		return nil, err
+	}
+	format, _ := imageFormat(contentType)
+
+	var img image.Image
+	var err error
+	switch format {
+	case "png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "bmp":
+		img, err = decodeBMP(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s image: %w", format, err)
+	}
+	return img, nil
+}
+
+// printedImageSize returns the size in dots an <image> with a content type
+// is printed at: its width attribute, or else the full receipt width, and
+// never wider than the receipt. A receipt width of 0 means the paper is not
+// known yet and only the width attribute applies.
+func printedImageSize(img *ImageDecoded, config image.Config, receiptWidth int) (int, int, error) {
+	width := receiptWidth
+	if img.Width > 0 && (img.Width < width || width <= 0) {
+		width = img.Width
+	}
+	if width <= 0 {
+		width = config.Width
+	}
+	// Rounded to the nearest line; int64 keeps huge ratios from overflowing
+	height := max(1, (int64(config.Height)*int64(width)+int64(config.Width)/2)/int64(config.Width))
+	if height > MAX_PRINTED_PIXELS/int64(width) {
+		return 0, 0, fmt.Errorf("image of %dx%d pixels would print at %dx%d dots, more than %d dots",
+			config.Width, config.Height, width, height, MAX_PRINTED_PIXELS)
+	}
+	return width, int(height), nil
+}
+
+// imageDarkness resizes an image to width x height and returns its darkness
+// values from 0 (white) to 255 (black). Each output pixel averages the
+// pixels it covers, and transparent pixels count as white paper.
+func imageDarkness(img image.Image, width int, height int) []int {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	darkness := make([]int, width*height)
+	sums := make([]int, width)
+	counts := make([]int, width)
+	for y := range height {
+		clear(sums)
+		clear(counts)
+		top, bottom := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for sy := top; sy < bottom; sy++ {
+			for x := range width {
+				left, right := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+				for sx := left; sx < right; sx++ {
+					r, g, b, a := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					// Composite onto white: the colors are premultiplied
+					white := 0xffff - a
+					luma := (299*(r+white) + 587*(g+white) + 114*(b+white)) / 1000
+					sums[x] += 255 - int(luma>>8)
+					counts[x]++
+				}
+			}
+		}
+		for x := range width {
+			darkness[y*width+x] = sums[x] / counts[x]
+		}
+	}
+	return darkness
+}
+
+// checkEncodedImage checks that an <image> with a content type can be
+// decoded and printed on a receipt of the given width
+func checkEncodedImage(img *ImageDecoded, receiptWidth int) (image.Config, error) {
+	config, err := encodedImageConfig(img.ContentType, img.Data)
+	if err != nil {
+		return config, err
+	}
+	if _, _, err := printedImageSize(img, config, receiptWidth); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// rasterizeImage decodes an <image> with a content type, resizes it to
+// printedImageSize and dithers it to 1 bit per pixel raster data
+func rasterizeImage(img *ImageDecoded, receiptWidth int) ([]byte, int, int, error) {
+	config, err := encodedImageConfig(img.ContentType, img.Data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	width, height, err := printedImageSize(img, config, receiptWidth)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	decoded, err := decodeEncodedImage(img.ContentType, img.Data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	darkness := imageDarkness(decoded, width, height)
+	dither := img.Dither
+	if dither == "" {
+		dither = DEFAULT_DITHER
+	}
+	log.Printf("[IMAGE] Converted %dx%d %s image to %dx%d with %s dithering",
+		decoded.Bounds().Dx(), decoded.Bounds().Dy(), img.ContentType, width, height, dither)
+	return ditherImage(dither, darkness, width, height), width, height, nil
+}
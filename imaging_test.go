@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// encodeBMP builds a bottom-up BITMAPINFOHEADER bitmap from rows of
+// pixel data that are already padded to 4 bytes
+func encodeBMP(width int, height int, bpp int, palette []color.NRGBA, rows [][]byte) []byte {
+	var pixels []byte
+	for i := len(rows) - 1; i >= 0; i-- {
+		pixels = append(pixels, rows[i]...)
+	}
+	offset := 14 + 40 + 4*len(palette)
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("BM")
+	binary.Write(&buf, le, uint32(offset+len(pixels)))
+	binary.Write(&buf, le, uint32(0))
+	binary.Write(&buf, le, uint32(offset))
+	binary.Write(&buf, le, uint32(40))
+	binary.Write(&buf, le, int32(width))
+	binary.Write(&buf, le, int32(height))
+	binary.Write(&buf, le, uint16(1))
+	binary.Write(&buf, le, uint16(bpp))
+	binary.Write(&buf, le, uint32(BMP_RGB))
+	binary.Write(&buf, le, uint32(len(pixels)))
+	binary.Write(&buf, le, [4]uint32{2835, 2835, uint32(len(palette)), 0})
+	for _, c := range palette {
+		buf.Write([]byte{c.B, c.G, c.R, 0})
+	}
+	buf.Write(pixels)
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBMP_24Bit(t *testing.T) {
+	// 2x2: red, green on top; blue, white below. Rows pad from 6 to 8 bytes.
+	data := encodeBMP(2, 2, 24, nil, [][]byte{
+		{0, 0, 255, 0, 255, 0, 0, 0},
+		{255, 0, 0, 255, 255, 255, 0, 0},
+	})
+	img, err := decodeBMP(data)
+	if err != nil {
+		t.Fatalf("decodeBMP failed: %v", err)
+	}
+	expected := map[image.Point]color.NRGBA{
+		{0, 0}: {255, 0, 0, 255},
+		{1, 0}: {0, 255, 0, 255},
+		{0, 1}: {0, 0, 255, 255},
+		{1, 1}: {255, 255, 255, 255},
+	}
+	for p, c := range expected {
+		if got := color.NRGBAModel.Convert(img.At(p.X, p.Y)); got != c {
+			t.Errorf("pixel %v: expected %v, got %v", p, c, got)
+		}
+	}
+}
+
+func TestDecodeBMP_1Bit(t *testing.T) {
+	palette := []color.NRGBA{{0, 0, 0, 255}, {255, 255, 255, 255}}
+	// 10 pixels: black, white alternating, then the second row all white
+	data := encodeBMP(10, 2, 1, palette, [][]byte{
+		{0x55, 0x40, 0, 0},
+		{0xff, 0xc0, 0, 0},
+	})
+	img, err := decodeBMP(data)
+	if err != nil {
+		t.Fatalf("decodeBMP failed: %v", err)
+	}
+	for x := range 10 {
+		r, _, _, _ := img.At(x, 0).RGBA()
+		if black := r == 0; black != (x%2 == 0) {
+			t.Errorf("pixel %d of row 0: expected black=%t", x, x%2 == 0)
+		}
+		if r, _, _, _ := img.At(x, 1).RGBA(); r != 0xffff {
+			t.Errorf("pixel %d of row 1: expected white", x)
+		}
+	}
+}
+
+func TestDecodeBMP_Errors(t *testing.T) {
+	valid := encodeBMP(2, 2, 24, nil, [][]byte{make([]byte, 8), make([]byte, 8)})
+
+	rle := bytes.Clone(valid)
+	binary.LittleEndian.PutUint32(rle[30:], 1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a bitmap", []byte("GIF89a")},
+		{"truncated pixels", valid[:len(valid)-4]},
+		{"compressed", rle},
+	}
+	for _, tt := range tests {
+		if _, err := decodeBMP(tt.data); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestEncodedImageConfig(t *testing.T) {
+	small := encodePNG(t, image.NewGray(image.Rect(0, 0, 3, 2)))
+	config, err := encodedImageConfig("image/png", small)
+	if err != nil || config.Width != 3 || config.Height != 2 {
+		t.Errorf("expected a 3x2 image, got %+v, %v", config, err)
+	}
+
+	huge := encodePNG(t, image.NewGray(image.Rect(0, 0, 5000, 4000)))
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"unsupported type", "image/gif", small},
+		{"wrong type", "image/jpeg", small},
+		{"too many pixels", "image/png", huge},
+		{"garbage", "image/png", []byte("not an image")},
+	}
+	for _, tt := range tests {
+		if _, err := encodedImageConfig(tt.contentType, tt.data); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestImageDarkness(t *testing.T) {
+	// 4x2: left half black, right half transparent, halved to 2x1
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for y := range 2 {
+		for x := range 2 {
+			img.SetNRGBA(x, y, color.NRGBA{A: 255})
+		}
+	}
+	darkness := imageDarkness(img, 2, 1)
+	if darkness[0] != 255 || darkness[1] != 0 {
+		t.Errorf("expected black then white, got %v", darkness)
+	}
+}
+
+func TestPrintedImageSize(t *testing.T) {
+	// A tall, narrow image is small to decode but huge once widened
+	narrow := image.Config{Width: 4, Height: 100000}
+	if _, _, err := printedImageSize(&ImageDecoded{}, narrow, 576); err == nil {
+		t.Errorf("expected error for an image that prints at 576x14400000 dots")
+	}
+	if _, _, err := printedImageSize(&ImageDecoded{Width: 576}, narrow, 0); err == nil {
+		t.Errorf("expected error for a width attribute that makes the image too large")
+	}
+	width, height, err := printedImageSize(&ImageDecoded{}, narrow, 0)
+	if err != nil || width != 4 || height != 100000 {
+		t.Errorf("expected the image's own size without a receipt width, got %dx%d, %v", width, height, err)
+	}
+	if _, _, _, err := rasterizeImage(&ImageDecoded{ContentType: "image/png", Data: encodePNG(t, image.NewGray(image.Rect(0, 0, 4, 100000)))}, 576); err == nil {
+		t.Errorf("expected rasterizeImage to refuse an image too large to print")
+	}
+}
+
+func TestRasterizeImage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 100, 50))
+	data := encodePNG(t, img)
+
+	tests := []struct {
+		name           string
+		width          int
+		receiptWidth   int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"receipt width", 0, 40, 40, 20},
+		{"requested width", 20, 40, 20, 10},
+		{"wider than the receipt", 80, 40, 40, 20},
+	}
+	for _, tt := range tests {
+		raster, width, height, err := rasterizeImage(&ImageDecoded{ContentType: "image/png", Width: tt.width, Data: data}, tt.receiptWidth)
+		if err != nil {
+			t.Fatalf("%s: rasterizeImage failed: %v", tt.name, err)
+		}
+		if width != tt.expectedWidth || height != tt.expectedHeight {
+			t.Errorf("%s: expected %dx%d, got %dx%d", tt.name, tt.expectedWidth, tt.expectedHeight, width, height)
+		}
+		for y := range height {
+			for x := range width {
+				if !rasterPixel(raster, (width+7)/8, x, y) {
+					t.Fatalf("%s: expected a black image, pixel %d,%d is white", tt.name, x, y)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// runJob sends every instruction of a parsed request to the printer in
+// order. The context deadline is checked before each instruction, so a
+// job that runs out of time stops between instructions rather than in the
+// middle of one.
+func runJob(ctx context.Context, printer *Printer, epos *EposPrint, requestID int) error {
+	for i, inst := range epos.Instructions {
+		if err := ctx.Err(); err != nil {
+			log.Printf("[PRINT] Request #%d: Job deadline reached before instruction [%d/%d]", requestID, i+1, len(epos.Instructions))
+			return fmt.Errorf("job stopped before instruction %d: %w", i+1, err)
+		}
+
+		switch inst.Type {
+		case InstImage:
+			if inst.Image == nil {
+				log.Printf("[PRINT] Request #%d: WARNING image instruction has nil image data", requestID)
+				continue
+			}
+			log.Printf("[PRINT] Request #%d: Processing image instruction [%d/%d]: width=%d, height=%d, data_size=%d bytes",
+				requestID, i+1, len(epos.Instructions), inst.Image.Width, inst.Image.Height, len(inst.Image.Data))
+			if err := printer.PrintImage(inst.Image); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR printing image: %v", requestID, err)
+				return fmt.Errorf("failed to print image: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Image printed successfully", requestID)
+		case InstText:
+			log.Printf("[PRINT] Request #%d: Processing text instruction [%d/%d]: %d characters",
+				requestID, i+1, len(epos.Instructions), len(inst.Text.Content))
+			if err := printer.PrintText(inst.Text); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR printing text: %v", requestID, err)
+				return fmt.Errorf("failed to print text: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Text printed successfully", requestID)
+		case InstFeed:
+			log.Printf("[PRINT] Request #%d: Processing feed instruction [%d/%d]", requestID, i+1, len(epos.Instructions))
+			if err := printer.Feed(inst.Feed); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR feeding paper: %v", requestID, err)
+				return fmt.Errorf("failed to feed: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Paper fed successfully", requestID)
+		case InstBarcode:
+			log.Printf("[PRINT] Request #%d: Processing barcode instruction [%d/%d]: type=%s",
+				requestID, i+1, len(epos.Instructions), inst.Barcode.Type)
+			if err := printer.PrintBarcode(inst.Barcode); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR printing barcode: %v", requestID, err)
+				return fmt.Errorf("failed to print barcode: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Barcode printed successfully", requestID)
+		case InstSymbol:
+			log.Printf("[PRINT] Request #%d: Processing symbol instruction [%d/%d]: type=%s",
+				requestID, i+1, len(epos.Instructions), inst.Symbol.Type)
+			if err := printer.PrintSymbol(inst.Symbol); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR printing symbol: %v", requestID, err)
+				return fmt.Errorf("failed to print symbol: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Symbol printed successfully", requestID)
+		case InstCommand:
+			log.Printf("[PRINT] Request #%d: Processing raw command instruction [%d/%d]: %d bytes",
+				requestID, i+1, len(epos.Instructions), len(inst.Command))
+			if err := printer.WriteCommand(inst.Command); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR writing raw command: %v", requestID, err)
+				return fmt.Errorf("failed to write command: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Raw command written successfully", requestID)
+		case InstPulse:
+			log.Printf("[PRINT] Request #%d: Processing kick drawer (pulse) instruction [%d/%d]", requestID, i+1, len(epos.Instructions))
+			if err := printer.KickDrawer(inst.Pulse); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR kicking drawer: %v", requestID, err)
+				return fmt.Errorf("failed to kick drawer: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Drawer kicked successfully", requestID)
+		case InstCut:
+			log.Printf("[PRINT] Request #%d: Processing cut instruction [%d/%d]", requestID, i+1, len(epos.Instructions))
+			if err := printer.Cut(inst.Cut); err != nil {
+				log.Printf("[PRINT] Request #%d: ERROR cutting paper: %v", requestID, err)
+				return fmt.Errorf("failed to cut: %w", err)
+			}
+			log.Printf("[PRINT] Request #%d: Paper cut successfully", requestID)
+		default:
+			log.Printf("[PRINT] Request #%d: WARNING unknown instruction type: %v", requestID, inst.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job states reported by GET /jobs/{id}
+const (
+	JOB_QUEUED   = "queued"
+	JOB_PRINTING = "printing"
+	JOB_DONE     = "done"
+	JOB_FAILED   = "failed"
+)
+
+// DEFAULT_JOB_HISTORY is how many asynchronous jobs are remembered for
+// polling. Once exceeded, the oldest finished jobs are forgotten.
+const DEFAULT_JOB_HISTORY = 1000
+
+// jobRecord is the state of an asynchronous job as reported to clients.
+// Success, Code and ASB are the printer status captured when the job
+// finished.
+type jobRecord struct {
+	ID         string     `json:"id"`
+	DevID      string     `json:"devid"`
+	PrintJobID string     `json:"printjobid,omitempty"`
+	State      string     `json:"state"`
+	Submitted  time.Time  `json:"submitted"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Success    bool       `json:"success"`
+	Code       string     `json:"code,omitempty"`
+	ASB        uint32     `json:"asb"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// JobStore remembers asynchronous jobs so clients can poll for them
+type JobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*jobRecord
+	order   []string
+	history int
+}
+
+func NewJobStore(history int) *JobStore {
+	return &JobStore{jobs: map[string]*jobRecord{}, history: history}
+}
+
+// newJobID returns a random, URL-safe job ID
+func newJobID() string {
+	return rand.Text()
+}
+
+// Add records a queued job
+func (s *JobStore) Add(id string, devid string, printJobID string, submitted time.Time) {
+	record := &jobRecord{
+		ID:         id,
+		DevID:      devid,
+		PrintJobID: printJobID,
+		State:      JOB_QUEUED,
+		Submitted:  submitted,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[record.ID] = record
+	s.order = append(s.order, record.ID)
+	s.evict()
+}
+
+// evict forgets the oldest finished jobs beyond the history limit. Jobs
+// still queued or printing are always kept.
+func (s *JobStore) evict() {
+	excess := len(s.order) - s.history
+	if excess <= 0 {
+		return
+	}
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if excess > 0 && s.jobs[id].Finished != nil {
+			delete(s.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+// Remove forgets a job that never made it onto a printer's queue
+func (s *JobStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	for i, queued := range s.order {
+		if queued == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Started marks a job as printing
+func (s *JobStore) Started(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.jobs[id]; ok {
+		now := time.Now()
+		record.State = JOB_PRINTING
+		record.Started = &now
+	}
+}
+
+// Requeued marks a job that went back on the queue without printing
+func (s *JobStore) Requeued(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.jobs[id]; ok {
+		record.State = JOB_QUEUED
+		record.Started = nil
+	}
+}
+
+// Finish records the outcome of a job
+func (s *JobStore) Finish(id string, resp EposResponse, jobErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	record.Finished = &now
+	record.Success = resp.Success
+	record.Code = resp.Code
+	record.ASB = resp.Status
+	record.State = JOB_DONE
+	if jobErr != nil || !resp.Success {
+		record.State = JOB_FAILED
+	}
+	if jobErr != nil {
+		record.Error = jobErr.Error()
+	}
+}
+
+// Get returns a snapshot of a job
+func (s *JobStore) Get(id string) (jobRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.jobs[id]
+	if !ok {
+		return jobRecord{}, false
+	}
+	return *record, true
+}
+
+func writeJobJSON(w http.ResponseWriter, httpStatus int, record jobRecord) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(record)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getJob(t *testing.T, s *Server, id string) (int, jobRecord) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil))
+	var record jobRecord
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil {
+			t.Fatalf("invalid job JSON: %v", err)
+		}
+	}
+	return rec.Code, record
+}
+
+// waitForJob polls a job until it has finished
+func waitForJob(t *testing.T, s *Server, id string) jobRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, record := getJob(t, s, id)
+		if code != http.StatusOK {
+			t.Fatalf("expected 200 polling job, got %d", code)
+		}
+		if record.Finished != nil {
+			return record
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not finish, last state %q", id, record.State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func submitAsync(t *testing.T, s *Server, body string) jobRecord {
+	t.Helper()
+	rec := postJob(s, EPOS_SERVICE_PATH+"?async=true", body)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var record jobRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil {
+		t.Fatalf("invalid job JSON: %v", err)
+	}
+	if record.ID == "" || rec.Header().Get("Location") != "/jobs/"+record.ID {
+		t.Fatalf("expected job ID and Location header, got %+v, %q", record, rec.Header().Get("Location"))
+	}
+	return record
+}
+
+func TestServer_AsyncJob(t *testing.T) {
+	s, conn := createTestServer()
+
+	envelope := `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter>` +
+		`<printjobid>order-42</printjobid></parameter></s:Header><s:Body>` + testJob + `</s:Body></s:Envelope>`
+	accepted := submitAsync(t, s, envelope)
+	if accepted.State != JOB_QUEUED || accepted.PrintJobID != "order-42" {
+		t.Errorf("unexpected accepted job: %+v", accepted)
+	}
+
+	record := waitForJob(t, s, accepted.ID)
+	if record.State != JOB_DONE || !record.Success {
+		t.Errorf("expected job to be done, got %+v", record)
+	}
+	if record.Started == nil || record.Finished.Before(*record.Started) {
+		t.Errorf("expected start and finish timestamps, got %+v", record)
+	}
+	if record.ASB&ASB_PRINT_SUCCESS == 0 {
+		t.Errorf("expected print success status, got 0x%08x", record.ASB)
+	}
+	if len(conn.WriteRawCalls) == 0 {
+		t.Errorf("expected job to be printed")
+	}
+}
+
+func TestServer_AsyncJobFailure(t *testing.T) {
+	s, conn := createTestServer()
+	conn.WriteRawError = errors.New("write failed")
+	printer, _ := s.current().printers.Get("")
+	printer.SetRetryPolicy(RetryPolicy{Attempts: 1, Delay: Duration(time.Millisecond)})
+
+	record := waitForJob(t, s, submitAsync(t, s, testJob).ID)
+	if record.State != JOB_FAILED || record.Success {
+		t.Errorf("expected job to fail, got %+v", record)
+	}
+	if record.Code != EX_BADPORT || record.Error == "" {
+		t.Errorf("expected error details, got code=%q error=%q", record.Code, record.Error)
+	}
+}
+
+func TestServer_JobRequestErrors(t *testing.T) {
+	s, _ := createTestServer()
+
+	if code, _ := getJob(t, s, "missing"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown job, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/jobs/missing", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+
+	if rec := postJob(s, EPOS_SERVICE_PATH+"?async=maybe", testJob); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid async, got %d", rec.Code)
+	}
+}
+
+func TestJobStore_Evict(t *testing.T) {
+	store := NewJobStore(2)
+	running, first, second := newJobID(), newJobID(), newJobID()
+	store.Add(running, "a", "", time.Now())
+	store.Add(first, "a", "", time.Now())
+	store.Finish(first, EposResponse{Success: true}, nil)
+	store.Add(second, "a", "", time.Now())
+	store.Finish(second, EposResponse{Success: true}, nil)
+
+	if _, ok := store.Get(first); ok {
+		t.Errorf("expected oldest finished job to be forgotten")
+	}
+	if _, ok := store.Get(running); !ok {
+		t.Errorf("expected unfinished job to be kept")
+	}
+	if _, ok := store.Get(second); !ok {
+		t.Errorf("expected newest job to be kept")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Journal events. A job is "accepted" before it is queued, "started" when
+// it may have sent anything to the printer, "requeued" when it turns out
+// to have sent nothing and waits again, and "finished" once its outcome is
+// known, including when it never made it onto the queue.
+const (
+	JOURNAL_ACCEPTED = "accepted"
+	JOURNAL_STARTED  = "started"
+	JOURNAL_REQUEUED = "requeued"
+	JOURNAL_FINISHED = "finished"
+)
+
+// JOURNAL_COMPACT_LINES is how many lines the journal may grow by before it
+// is rewritten with only the unfinished jobs
+const JOURNAL_COMPACT_LINES = 1000
+
+// JOURNAL_MAX_ENTRY_BYTES caps an accepted job's journal line. Jobs larger
+// than this, such as ones with big images, are journaled without their
+// instructions, so they are reported rather than resumed after a restart.
+const JOURNAL_MAX_ENTRY_BYTES = 4 << 20
+
+// journalEntry is one line of the journal
+type journalEntry struct {
+	Event string    `json:"event"`
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	// DevID, Key, Fingerprint and Job are recorded when a job is accepted.
+	// Key is the job's idempotency key and Fingerprint identifies the
+	// request it came with. JobBytes is set instead of Job when the job
+	// was too large to journal.
+	DevID       string     `json:"devid,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Job         *EposPrint `json:"job,omitempty"`
+	JobBytes    int        `json:"job_bytes,omitempty"`
+	// Success, Code and Error are recorded when a job finishes
+	Success bool   `json:"success,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// recoveredJob is a job the journal accepted but never saw finish
+type recoveredJob struct {
+	accepted journalEntry
+	started  bool
+}
+
+// Journal is an append-only JSON Lines file of accepted jobs, so that jobs
+// still queued or printing when the proxy stops can be recovered on the
+// next start. Every entry is synced to disk before it is relied on.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	pending map[string]*recoveredJob
+	lines   int
+}
+
+// OpenJournal reads the journal at path, creating it if needed, and returns
+// the jobs that were accepted but never finished, oldest first.
+func OpenJournal(path string) (*Journal, []recoveredJob, error) {
+	j := &Journal{path: path, pending: map[string]*recoveredJob{}}
+	if err := j.load(); err != nil {
+		return nil, nil, err
+	}
+
+	recovered := make([]recoveredJob, 0, len(j.pending))
+	for _, job := range j.pending {
+		recovered = append(recovered, *job)
+	}
+	sort.Slice(recovered, func(a, b int) bool {
+		return recovered[a].accepted.Time.Before(recovered[b].accepted.Time)
+	})
+
+	if err := j.compact(); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[JOURNAL] Opened %s: %d unfinished job(s)", path, len(recovered))
+	return j, recovered, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+
+	// Lines are read whole, however long: an accepted job is as large as
+	// its request, which max_body_bytes may leave unbounded
+	reader := bufio.NewReader(f)
+	line := 0
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		line++
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			// A power cut can leave the last line half written
+			log.Printf("[JOURNAL] WARNING: Skipping unreadable line %d of %s: %v", line, j.path, err)
+			continue
+		}
+
+		switch entry.Event {
+		case JOURNAL_ACCEPTED:
+			j.pending[entry.ID] = &recoveredJob{accepted: entry}
+		case JOURNAL_STARTED:
+			if job, ok := j.pending[entry.ID]; ok {
+				job.started = true
+			}
+		case JOURNAL_REQUEUED:
+			if job, ok := j.pending[entry.ID]; ok {
+				job.started = false
+			}
+		case JOURNAL_FINISHED:
+			delete(j.pending, entry.ID)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the unfinished jobs and reopens it
+// for appending. The new file replaces the old one atomically.
+func (j *Journal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	ids := make([]string, 0, len(j.pending))
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return j.pending[ids[a]].accepted.Time.Before(j.pending[ids[b]].accepted.Time)
+	})
+
+	encoder := json.NewEncoder(f)
+	for _, id := range ids {
+		job := j.pending[id]
+		err = encoder.Encode(job.accepted)
+		if err == nil && job.started {
+			err = encoder.Encode(journalEntry{Event: JOURNAL_STARTED, ID: id, Time: job.accepted.Time})
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.lines = 0
+	return nil
+}
+
+// append writes an entry and syncs it to disk. Entries are encoded and
+// synced outside the lock, so a large job or a slow disk does not hold up
+// other jobs' entries; one sync covers every entry written before it.
+func (j *Journal) append(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+	if entry.Job != nil && len(data) > JOURNAL_MAX_ENTRY_BYTES {
+		log.Printf("[JOURNAL] WARNING: Job %s is too large to journal (%d bytes), it will not be resumed after a restart", entry.ID, len(data))
+		entry.Job, entry.JobBytes = nil, len(data)
+		if data, err = json.Marshal(entry); err != nil {
+			return fmt.Errorf("failed to encode journal entry: %w", err)
+		}
+	}
+
+	j.mu.Lock()
+	switch entry.Event {
+	case JOURNAL_ACCEPTED:
+		j.pending[entry.ID] = &recoveredJob{accepted: entry}
+	case JOURNAL_STARTED:
+		if job, ok := j.pending[entry.ID]; ok {
+			job.started = true
+		}
+	case JOURNAL_REQUEUED:
+		if job, ok := j.pending[entry.ID]; ok {
+			job.started = false
+		}
+	case JOURNAL_FINISHED:
+		delete(j.pending, entry.ID)
+	}
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		j.mu.Unlock()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	j.lines++
+	if j.lines >= JOURNAL_COMPACT_LINES {
+		err := j.compact()
+		j.mu.Unlock()
+		return err
+	}
+	file := j.file
+	j.mu.Unlock()
+
+	// A compaction may close the file first; it syncs the entry itself
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// Accepted records a job before it is queued. A nil journal records
+// nothing.
+func (j *Journal) Accepted(id string, devid string, key string, fingerprint string, epos *EposPrint) {
+	if j == nil {
+		return
+	}
+	entry := journalEntry{Event: JOURNAL_ACCEPTED, ID: id, Time: time.Now(), DevID: devid, Key: key, Fingerprint: fingerprint, Job: epos}
+	if err := j.append(entry); err != nil {
+		log.Printf("[JOURNAL] WARNING: Job %s will not survive a restart: %v", id, err)
+	}
+}
+
+// Started records that a job may have sent something to the printer
+func (j *Journal) Started(id string) {
+	if j == nil {
+		return
+	}
+	if err := j.append(journalEntry{Event: JOURNAL_STARTED, ID: id, Time: time.Now()}); err != nil {
+		log.Printf("[JOURNAL] WARNING: Failed to record start of job %s: %v", id, err)
+	}
+}
+
+// Requeued records that a job sent nothing and is waiting again
+func (j *Journal) Requeued(id string) {
+	if j == nil {
+		return
+	}
+	if err := j.append(journalEntry{Event: JOURNAL_REQUEUED, ID: id, Time: time.Now()}); err != nil {
+		log.Printf("[JOURNAL] WARNING: Failed to record requeue of job %s: %v", id, err)
+	}
+}
+
+// Finished records the outcome of a job
+func (j *Journal) Finished(id string, resp EposResponse, jobErr error) {
+	if j == nil {
+		return
+	}
+	entry := journalEntry{Event: JOURNAL_FINISHED, ID: id, Time: time.Now(), Success: resp.Success, Code: resp.Code}
+	if jobErr != nil {
+		entry.Error = jobErr.Error()
+	}
+	if err := j.append(entry); err != nil {
+		log.Printf("[JOURNAL] WARNING: Failed to record end of job %s: %v", id, err)
+	}
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return j.file.Close()
+}
+
+// Recover attaches the journal to the server, before it starts serving, and
+// deals with the jobs the journal recovered. Jobs that never started are queued again. Jobs interrupted
+// while printing may already have part of their receipt out, so they are
+// only queued again with resumeInterrupted; otherwise they are reported as
+// failed. Either way they can be polled under their original job IDs.
+func (s *Server) Recover(journal *Journal, recovered []recoveredJob, resumeInterrupted bool) {
+	s.journal = journal
+	limits := s.current().limits
+
+	for _, r := range recovered {
+		entry := r.accepted
+		printJobID := ""
+		if entry.Job != nil {
+			printJobID = entry.Job.PrintJobID
+		}
+		s.jobs.Add(entry.ID, entry.DevID, printJobID, entry.Time)
+
+		fail := func(resp EposResponse, err error) {
+			log.Printf("[JOURNAL] Job %s not resumed: %v", entry.ID, err)
+			s.jobs.Finish(entry.ID, resp, err)
+			s.journal.Finished(entry.ID, resp, err)
+		}
+		if entry.Job == nil && entry.JobBytes > 0 {
+			fail(EposResponse{}, fmt.Errorf("job was too large to journal (%d bytes)", entry.JobBytes))
+			continue
+		}
+		if entry.Job == nil {
+			fail(EposResponse{}, fmt.Errorf("journal entry has no job"))
+			continue
+		}
+		if r.started && !resumeInterrupted {
+			fail(EposResponse{}, fmt.Errorf("interrupted by a restart while printing"))
+			continue
+		}
+		printer, ok := s.current().printers.Get(entry.DevID)
+		if !ok {
+			fail(EposResponse{Code: DEVICE_NOT_FOUND}, fmt.Errorf("unknown device ID %q", entry.DevID))
+			continue
+		}
+
+		// Retries with the job's idempotency key get its result once it
+		// has printed again
+		var claim *idempotencyEntry
+		key := idempotencyScope(s.current().printers.resolve(entry.DevID), entry.Key)
+		if entry.Key != "" && limits.IdempotencyTTL > 0 {
+			claim, _, _ = s.idempotency.Claim(context.Background(), key, entry.Fingerprint, limits.IdempotencyKeys)
+		}
+
+		requestID := int(s.requestCount.Add(1))
+		job := newPrintJob(context.Background(), entry.Job, requestID)
+		job.accepted = entry.Time
+		id := entry.ID
+		job.onStart = func() {
+			s.journal.Started(id)
+			s.jobs.Started(id)
+		}
+		job.onRequeue = func() {
+			s.journal.Requeued(id)
+			s.jobs.Requeued(id)
+		}
+		if err := printer.SubmitRecovered(job); err != nil {
+			fail(EposResponse{}, err)
+			continue
+		}
+		log.Printf("[JOURNAL] Request #%d: Resuming job %s on %s (accepted %s)",
+			requestID, id, printer.connection_string, entry.Time.Format(time.RFC3339))
+
+		go func(key string) {
+			result := <-job.done
+			httpStatus, response := jobOutcome(result)
+			s.jobs.Finish(id, response, result.err)
+			s.journal.Finished(id, response, result.err)
+			if claim != nil {
+				if job.started.Load() {
+					s.idempotency.Complete(claim, httpStatus, response, time.Duration(limits.IdempotencyTTL))
+				} else {
+					s.idempotency.Release(key, claim)
+				}
+			}
+			log.Printf("[JOURNAL] Request #%d: Resumed job %s finished (success=%t, code=%q)",
+				requestID, id, response.Success, response.Code)
+		}(key)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestJournal(t *testing.T, path string) (*Journal, []recoveredJob) {
+	t.Helper()
+	journal, recovered, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return journal, recovered
+}
+
+func TestJournal_RecoversLargeJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	// Larger than the line buffer a scanner is given by default
+	text := strings.Repeat("x", 1<<20)
+	epos := &EposPrint{Instructions: []Instruction{{Type: InstText, Text: &TextDecoded{Content: text}}}}
+	// Too large to journal at all
+	huge := &EposPrint{Instructions: []Instruction{{Type: InstText, Text: &TextDecoded{Content: strings.Repeat("x", JOURNAL_MAX_ENTRY_BYTES)}}}}
+
+	journal, _ := openTestJournal(t, path)
+	journal.Accepted("large", "", "", "", epos)
+	journal.Accepted("huge", "", "", "", huge)
+	journal.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Size() > 2<<20 {
+		t.Errorf("expected the huge job to be left out of the journal, got %v, %v", info.Size(), err)
+	}
+	journal, recovered := openTestJournal(t, path)
+	if len(recovered) != 2 || len(recovered[0].accepted.Job.Instructions[0].Text.Content) != len(text) {
+		t.Fatalf("expected the large job to be recovered whole")
+	}
+	if recovered[1].accepted.Job != nil || recovered[1].accepted.JobBytes <= JOURNAL_MAX_ENTRY_BYTES {
+		t.Errorf("expected the huge job to be recovered without its instructions, got %d bytes", recovered[1].accepted.JobBytes)
+	}
+
+	s, _ := createTestServer()
+	s.Recover(journal, recovered, false)
+	defer journal.Close()
+	if record := waitForJob(t, s, "huge"); record.State != JOB_FAILED || !strings.Contains(record.Error, "too large") {
+		t.Errorf("expected the huge job to be reported, got %+v", record)
+	}
+	if record := waitForJob(t, s, "large"); record.State != JOB_DONE {
+		t.Errorf("expected the large job to be printed, got %+v", record)
+	}
+}
+
+func TestJournal_RecoversUnfinishedJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	epos, err := Parse([]byte(testJob))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	journal, recovered := openTestJournal(t, path)
+	if len(recovered) != 0 {
+		t.Fatalf("expected a new journal to be empty, got %d jobs", len(recovered))
+	}
+	journal.Accepted("queued", "kitchen", "order-1", "", epos)
+	// A job that sent nothing before the printer dropped waits again
+	journal.Started("queued")
+	journal.Requeued("queued")
+	journal.Accepted("printing", "", "", "", epos)
+	journal.Started("printing")
+	journal.Accepted("done", "", "", "", epos)
+	journal.Started("done")
+	journal.Finished("done", EposResponse{Success: true}, nil)
+	journal.Close()
+
+	// A power cut mid-write leaves a partial last line
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"event":"finished","id":"prin`)
+	f.Close()
+
+	journal, recovered = openTestJournal(t, path)
+	defer journal.Close()
+	if len(recovered) != 2 {
+		t.Fatalf("expected 2 unfinished jobs, got %d", len(recovered))
+	}
+	queued, printing := recovered[0], recovered[1]
+	if queued.accepted.ID != "queued" || queued.started || queued.accepted.DevID != "kitchen" || queued.accepted.Key != "order-1" {
+		t.Errorf("unexpected queued job: %+v", queued)
+	}
+	if printing.accepted.ID != "printing" || !printing.started {
+		t.Errorf("unexpected printing job: %+v", printing)
+	}
+	job := queued.accepted.Job
+	if job == nil || len(job.Instructions) != 2 || job.Instructions[0].Text.Content != "Hi" || job.Instructions[1].Type != InstCut {
+		t.Errorf("expected parsed instructions to survive a restart, got %+v", job)
+	}
+
+	// Reopening compacts the journal down to the unfinished jobs
+	data, _ := os.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Errorf("expected 3 lines after compaction, got %d:\n%s", lines, data)
+	}
+}
+
+func TestServer_Recover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	epos, _ := Parse([]byte(testJob))
+
+	journal, _ := openTestJournal(t, path)
+	journal.Accepted("queued", "", "order-1", "", epos)
+	journal.Accepted("printing", "", "", "", epos)
+	journal.Started("printing")
+	journal.Accepted("elsewhere", "bar", "", "", epos)
+	journal.Close()
+
+	journal, recovered := openTestJournal(t, path)
+	s, conn := createTestServer()
+	s.Recover(journal, recovered, false)
+
+	queued := waitForJob(t, s, "queued")
+	if queued.State != JOB_DONE || len(conn.WriteRawCalls) == 0 {
+		t.Errorf("expected job that never started to be printed, got %+v", queued)
+	}
+	printing := waitForJob(t, s, "printing")
+	if printing.State != JOB_FAILED || !strings.Contains(printing.Error, "interrupted") {
+		t.Errorf("expected interrupted job to be reported, got %+v", printing)
+	}
+	elsewhere := waitForJob(t, s, "elsewhere")
+	if elsewhere.State != JOB_FAILED || elsewhere.Code != DEVICE_NOT_FOUND {
+		t.Errorf("expected job for an unknown printer to fail, got %+v", elsewhere)
+	}
+
+	// The recovered job's idempotency key still guards against a reprint
+	writes := len(conn.WriteRawCalls)
+	if rec := postWithKey(s, EPOS_SERVICE_PATH, testJob, "order-1"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected retry of recovered job to be replayed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) != writes {
+		t.Errorf("expected no reprint of recovered job")
+	}
+	journal.Close()
+
+	_, recovered = openTestJournal(t, path)
+	if len(recovered) != 0 {
+		t.Errorf("expected every recovered job to be finished, got %d", len(recovered))
+	}
+}
+
+func TestServer_RecoverResumeInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	epos, _ := Parse([]byte(testJob))
+
+	journal, _ := openTestJournal(t, path)
+	journal.Accepted("printing", "", "", "", epos)
+	journal.Started("printing")
+	journal.Close()
+
+	journal, recovered := openTestJournal(t, path)
+	defer journal.Close()
+	s, _ := createTestServer()
+	s.Recover(journal, recovered, true)
+
+	if record := waitForJob(t, s, "printing"); record.State != JOB_DONE {
+		t.Errorf("expected interrupted job to be printed again, got %+v", record)
+	}
+}
+
+func TestServer_JournalsJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	journal, recovered := openTestJournal(t, path)
+	s, conn := createTestServer()
+	s.Recover(journal, recovered, false)
+
+	postJob(s, EPOS_SERVICE_PATH, testJob)
+	conn.WriteRawError = errors.New("write failed")
+	printer, _ := s.current().printers.Get("")
+	printer.SetRetryPolicy(RetryPolicy{Attempts: 1, Delay: Duration(1)})
+	postJob(s, EPOS_SERVICE_PATH, testJob)
+	journal.Close()
+
+	data, _ := os.ReadFile(path)
+	for _, event := range []string{JOURNAL_ACCEPTED, JOURNAL_STARTED, JOURNAL_FINISHED} {
+		if n := strings.Count(string(data), `"event":"`+event+`"`); n != 2 {
+			t.Errorf("expected 2 %s entries, got %d:\n%s", event, n, data)
+		}
+	}
+	if !strings.Contains(string(data), "write failed") {
+		t.Errorf("expected failure to be journaled:\n%s", data)
+	}
+}
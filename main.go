@@ -4,12 +4,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
 	"net"
@@ -111,16 +111,32 @@ func isOriginAllowed(origin string, allowedOrigins []string) bool {
 }
 
 func main() {
-	var (
-		printerConn    = flag.String("printer", "", "Printer connection string (required)")
-		receiptWidth   = flag.Int("receipt-width", 576, "Receipt width in pixels")
-		proto          = flag.String("proto", "", "Protocol: USB or TCP (required)")
-		host           = flag.String("host", "127.0.0.1", "Server host")
-		port           = flag.String("port", "8000", "Server port")
-		secure         = flag.Bool("secure", false, "Use HTTPS")
-		allowedOrigins = flag.String("allow-origins", "", "Comma-separated list of allowed CORS origins (empty = allow all)")
-		version        = flag.Bool("version", false, "Print version and exit")
-	)
+	var cli cliFlags
+	flag.StringVar(&cli.printer, "printer", "", "Printer connection string")
+	flag.IntVar(&cli.receiptWidth, "receipt-width", 576, "Receipt width in pixels")
+	flag.StringVar(&cli.profile, "profile", "", "Printer model profile, e.g. tm-t88vi, which sets how images are sent (empty = generic)")
+	flag.StringVar(&cli.wideImages, "wide-images", WIDE_IMAGES_SCALE, "Images wider than the receipt: scale, crop or none")
+	flag.StringVar(&cli.proto, "proto", "", "Protocol: USB or TCP (required with -printer)")
+	flag.StringVar(&cli.host, "host", "127.0.0.1", "Server host")
+	flag.StringVar(&cli.port, "port", "8000", "Server port")
+	flag.BoolVar(&cli.secure, "secure", false, "Use HTTPS")
+	flag.StringVar(&cli.tlsCert, "tls-cert", "", "TLS certificate file for -secure (empty = generate a self-signed certificate)")
+	flag.StringVar(&cli.tlsKey, "tls-key", "", "TLS private key file for -secure")
+	flag.StringVar(&cli.allowOrigins, "allow-origins", "", "Comma-separated list of allowed CORS origins (empty = allow all)")
+	flag.StringVar(&cli.commandAllow, "command-allow", "", "Comma-separated hex prefixes every command in a raw <command> must start with (empty = allow all)")
+	flag.StringVar(&cli.drawer, "drawer", "", "Default drawer for <pulse> without a drawer attribute: drawer_1 or drawer_2 (empty = drawer_1)")
+	flag.StringVar(&cli.pulseTime, "pulse-time", "", "Default pulse for <pulse> without a time attribute: pulse_100 ... pulse_500 (empty = 50ms)")
+	flag.BoolVar(&cli.asb, "asb", false, "Enable Automatic Status Back to monitor printer status continuously")
+	flag.StringVar(&cli.commandDeny, "command-deny", DEFAULT_COMMAND_DENY, "Comma-separated hex prefixes no command in a raw <command> may start with")
+	flag.StringVar(&cli.devid, "devid", DEFAULT_DEVID, "Device ID ePOS SDK clients must request in the devid parameter")
+	flag.StringVar(&cli.printers, "printers", "", "JSON file defining several printers by device ID (replaces -printer/-proto/-receipt-width/-devid/-profile/-wide-images)")
+	flag.Int64Var(&cli.maxBodyBytes, "max-body-bytes", DEFAULT_MAX_BODY_BYTES, "Largest accepted request body in bytes (0 = unlimited)")
+	flag.IntVar(&cli.queueDepth, "queue-depth", DEFAULT_QUEUE_DEPTH, "Jobs that may wait for each printer before requests get 503")
+	flag.DurationVar(&cli.spoolMaxAge, "spool-max-age", DEFAULT_SPOOL_MAX_AGE, "How long jobs wait for an offline printer before they are failed (0 = forever)")
+	flag.StringVar(&cli.journal, "journal", "", "Job journal file; jobs not finished when the proxy stops are recovered on the next start (empty = off)")
+	flag.DurationVar(&cli.idempotencyTTL, "idempotency-ttl", DEFAULT_IDEMPOTENCY_TTL, "How long job results are kept for retries with the same Idempotency-Key or printjobid (0 = off)")
+	configPath := flag.String("config", "", "JSON configuration file; flags given on the command line override its values")
+	version := flag.Bool("version", false, "Print version and exit")
 	flag.Parse()
 
 	if *version {
@@ -130,190 +146,87 @@ func main() {
 
 	log.Printf("[MAIN] Epson Proxy Server starting up...")
 
-	// Parse allowed origins
-	var originsList []string
-	if *allowedOrigins != "" {
-		originsList = strings.Split(*allowedOrigins, ",")
-		// Trim whitespace from each origin
-		for i, origin := range originsList {
-			originsList[i] = strings.TrimSpace(origin)
-		}
-		log.Printf("[MAIN] CORS whitelist configured: %v", originsList)
-	} else {
-		log.Printf("[MAIN] CORS whitelist not configured - allowing all origins")
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		log.Printf("[MAIN]   -%s: %s", f.Name, f.Value)
+	})
+	// Reloads rebuild the configuration the same way: file, then flags
+	build := func() (Config, error) {
+		return buildConfig(*configPath, set, cli)
 	}
 
-	log.Printf("[MAIN] Command-line arguments parsed:")
-	log.Printf("[MAIN]   -printer: %s", *printerConn)
-	log.Printf("[MAIN]   -receipt-width: %d pixels", *receiptWidth)
-	log.Printf("[MAIN]   -proto: %s", *proto)
-	log.Printf("[MAIN]   -host: %s", *host)
-	log.Printf("[MAIN]   -port: %s", *port)
-	log.Printf("[MAIN]   -secure: %v", *secure)
-	log.Printf("[MAIN]   -allow-origins: %s", *allowedOrigins)
-
-	if *printerConn == "" {
-		log.Printf("[MAIN] ERROR: Required flag -printer not provided")
-		fmt.Fprintf(os.Stderr, "Error: -printer flag is required\n")
-		flag.Usage()
+	cfg, err := build()
+	if err != nil {
+		log.Printf("[MAIN] ERROR: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	if *configPath != "" {
+		log.Printf("[MAIN] Loaded configuration from %s", *configPath)
+	}
 
-	if *proto == "" {
-		log.Printf("[MAIN] ERROR: Required flag -proto not provided")
-		fmt.Fprintf(os.Stderr, "Error: -proto flag is required\n")
-		flag.Usage()
-		os.Exit(1)
+	if len(cfg.AllowOrigins) > 0 {
+		log.Printf("[MAIN] CORS whitelist configured: %v", cfg.AllowOrigins)
+	} else {
+		log.Printf("[MAIN] CORS whitelist not configured - allowing all origins")
 	}
 
-	var connType ConnectionType
-	switch *proto {
-	case "TCP":
-		connType = TcpSocket
-		log.Printf("[MAIN] Selected protocol: TCP (TcpSocket)")
-	case "USB":
-		connType = UsbPath
-		log.Printf("[MAIN] Selected protocol: USB (UsbPath)")
-	default:
-		log.Printf("[MAIN] ERROR: Unknown protocol specified: %s", *proto)
-		fmt.Fprintf(os.Stderr, "Unknown protocol: %s (must be USB or TCP)\n", *proto)
+	commandFilter, err := NewCommandFilter(strings.Join(cfg.CommandAllow, ","), strings.Join(cfg.CommandDeny, ","))
+	if err != nil {
+		log.Printf("[MAIN] ERROR: Invalid raw command filter: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	log.Printf("[MAIN] Initializing printer connection to: %s", *printerConn)
-	printer, err := NewPrinter(*printerConn, *receiptWidth, connType)
+	log.Printf("[MAIN] Initializing %d printer connection(s)", len(cfg.Printers))
+	printers, err := OpenPrinterRegistry(cfg.Printers)
 	if err != nil {
 		log.Fatalf("[MAIN] FATAL: Failed to connect to printer: %v", err)
 	}
+	server := NewServer(printers, cfg.AllowOrigins, commandFilter, cfg.Limits)
 	defer func() {
-		log.Printf("[MAIN] Shutting down: closing printer connection")
-		if err := printer.Close(); err != nil {
+		log.Printf("[MAIN] Shutting down: closing printer connections")
+		if err := server.current().printers.Close(); err != nil {
 			log.Printf("[MAIN] ERROR: Failed to close printer connection: %v", err)
 		} else {
-			log.Printf("[MAIN] Printer connection closed successfully")
+			log.Printf("[MAIN] Printer connections closed successfully")
 		}
 	}()
-	log.Printf("[MAIN] Printer connected successfully: %s", printer.connection_string)
-
-	requestCount := 0
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		requestCount++
-		origin := r.Header.Get("Origin")
-		log.Printf("[HTTP] Request #%d received: %s %s from %s", requestCount, r.Method, r.URL.Path, r.RemoteAddr)
-		log.Printf("[HTTP]   Content-Type: %s", r.Header.Get("Content-Type"))
-		log.Printf("[HTTP]   Content-Length: %d", r.ContentLength)
-		log.Printf("[HTTP]   Origin: %s", origin)
-
-		// Check CORS origin
-		if !isOriginAllowed(origin, originsList) {
-			log.Printf("[HTTP] Request #%d: CORS blocked - origin '%s' not in whitelist", requestCount, origin)
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprintf(w, "CORS Error: Origin '%s' is not allowed\n", origin)
-			return
-		}
 
-		// Set CORS headers for allowed origin
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == http.MethodOptions {
-			log.Printf("[HTTP] Request #%d: CORS preflight request, returning 200", requestCount)
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	for _, id := range printers.DevIDs() {
+		printer, _ := printers.Get(id)
+		pc, _ := printers.Config(id)
+		log.Printf("[MAIN] Printer %q ready: %s", id, printer.connection_string)
 
-		if r.Method != http.MethodPost {
-			log.Printf("[HTTP] Request #%d: Method not allowed: %s", requestCount, r.Method)
-			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		data, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("[HTTP] Request #%d: ERROR reading request body: %v", requestCount, err)
-			http.Error(w, fmt.Sprintf("Failed to read body: %v", err), http.StatusBadRequest)
-			return
-		}
-		defer r.Body.Close()
-		log.Printf("[HTTP] Request #%d: Read %d bytes from request body", requestCount, len(data))
-
-		if len(data) == 0 {
-			log.Printf("[HTTP] Request #%d: ERROR empty request body", requestCount)
-			http.Error(w, "Empty request body", http.StatusBadRequest)
-			return
+		if err := configurePrinter(printer, pc, cfg); err != nil {
+			log.Printf("[MAIN] WARNING: Printer %q: %v", id, err)
+		} else if cfg.ASB {
+			log.Printf("[MAIN] Automatic Status Back enabled for %q", id)
 		}
+	}
 
-		log.Printf("[XML] Request #%d: Parsing EPOS XML data...", requestCount)
-		epos, err := Parse(data)
+	if cfg.Journal.Path != "" {
+		journal, recovered, err := OpenJournal(cfg.Journal.Path)
 		if err != nil {
-			log.Printf("[XML] Request #%d: ERROR parsing XML: %v", requestCount, err)
-			http.Error(w, fmt.Sprintf("Failed to parse XML: %v", err), http.StatusBadRequest)
-			return
-		}
-		log.Printf("[XML] Request #%d: XML parsed successfully, found %d instruction(s)", requestCount, len(epos.Instructions))
-
-		for i, inst := range epos.Instructions {
-			switch inst.Type {
-			case InstImage:
-				if inst.Image != nil {
-					log.Printf("[PRINT] Request #%d: Processing image instruction [%d/%d]: width=%d, height=%d, data_size=%d bytes",
-						requestCount, i+1, len(epos.Instructions), inst.Image.Width, inst.Image.Height, len(inst.Image.Data))
-					err = printer.PrintGraphics(inst.Image.Data, inst.Image.Width, inst.Image.Height)
-					if err != nil {
-						log.Printf("[PRINT] Request #%d: ERROR printing image: %v", requestCount, err)
-						http.Error(w, fmt.Sprintf("Failed to print image: %v", err), http.StatusInternalServerError)
-						return
-					}
-					log.Printf("[PRINT] Request #%d: Image printed successfully", requestCount)
-				} else {
-					log.Printf("[PRINT] Request #%d: WARNING image instruction has nil image data", requestCount)
-				}
-			case InstPulse:
-				log.Printf("[PRINT] Request #%d: Processing kick drawer (pulse) instruction [%d/%d]", requestCount, i+1, len(epos.Instructions))
-				err = printer.KickDrawer()
-				if err != nil {
-					log.Printf("[PRINT] Request #%d: ERROR kicking drawer: %v", requestCount, err)
-					http.Error(w, fmt.Sprintf("Failed to kick drawer: %v", err), http.StatusInternalServerError)
-					return
-				}
-				log.Printf("[PRINT] Request #%d: Drawer kicked successfully", requestCount)
-			case InstCut:
-				log.Printf("[PRINT] Request #%d: Processing cut instruction [%d/%d]", requestCount, i+1, len(epos.Instructions))
-				err = printer.Cut()
-				if err != nil {
-					log.Printf("[PRINT] Request #%d: ERROR cutting paper: %v", requestCount, err)
-					http.Error(w, fmt.Sprintf("Failed to cut: %v", err), http.StatusInternalServerError)
-					return
-				}
-				log.Printf("[PRINT] Request #%d: Paper cut successfully", requestCount)
-			default:
-				log.Printf("[PRINT] Request #%d: WARNING unknown instruction type: %v", requestCount, inst.Type)
-			}
+			log.Fatalf("[MAIN] FATAL: %v", err)
 		}
+		server.Recover(journal, recovered, cfg.Journal.ResumeInterrupted)
+	}
 
-		printer.Reset()
-
-		log.Printf("[HTTP] Request #%d: All instructions processed successfully, sending success response", requestCount)
-		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		response := `<?xml version="1.0" encoding="utf-8"?>
-<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
-<s:Body>
-<response success="true" code="" status="123456" battery="0"/>
-</s:Body>
-</s:Envelope>`
-		w.Write([]byte(response))
-		log.Printf("[HTTP] Request #%d: Response sent (200 OK)", requestCount)
-	})
+	handler := server.Handler()
 
-	addr := *host + ":" + *port
 	log.Printf("[MAIN] HTTP server configured:")
-	log.Printf("[MAIN]   Listen address: %s", addr)
-	log.Printf("[MAIN]   Secure (HTTPS): %v", *secure)
-	log.Printf("[MAIN]   Allowed Origins: %v", originsList)
+	log.Printf("[MAIN]   Listen addresses: %v", cfg.Listen)
+	log.Printf("[MAIN]   Secure (HTTPS): %v", cfg.Secure)
+	log.Printf("[MAIN]   Allowed Origins: %v", cfg.AllowOrigins)
+	log.Printf("[MAIN]   Max body size: %d bytes", cfg.Limits.MaxBodyBytes)
+	log.Printf("[MAIN]   Queue depth per printer: %d", cfg.Limits.QueueDepth)
+	log.Printf("[MAIN]   Idempotency TTL: %v", time.Duration(cfg.Limits.IdempotencyTTL))
+	log.Printf("[MAIN]   Spool max age: %v", time.Duration(cfg.Limits.SpoolMaxAge))
+	log.Printf("[MAIN]   Job journal: %q", cfg.Journal.Path)
+	log.Printf("[MAIN]   ePOS-Print endpoint: %s", EPOS_SERVICE_PATH)
+	log.Printf("[MAIN]   Device IDs: %v (default %q)", printers.DevIDs(), cfg.Printers[0].DevID)
 
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -323,26 +236,57 @@ func main() {
 		sig := <-sigChan
 		log.Printf("[MAIN] Received signal: %v", sig)
 		log.Printf("[MAIN] Initiating graceful shutdown...")
-		if err := printer.Close(); err != nil {
-			log.Printf("[MAIN] ERROR closing printer during shutdown: %v", err)
+		if err := server.current().printers.Close(); err != nil {
+			log.Printf("[MAIN] ERROR closing printers during shutdown: %v", err)
+		}
+		if err := server.journal.Close(); err != nil {
+			log.Printf("[MAIN] ERROR closing journal during shutdown: %v", err)
 		}
 		log.Printf("[MAIN] Graceful shutdown complete")
 		os.Exit(0)
 	}()
 
-	if *secure {
-		log.Printf("[MAIN] Starting HTTPS server...")
-		if err := generateCert(); err != nil {
-			log.Fatalf("[MAIN] FATAL: Certificate generation failed: %v", err)
+	var certs certStore
+	if cfg.Secure {
+		certFile, keyFile, err := certFiles(cfg)
+		if err == nil {
+			err = certs.Load(certFile, keyFile)
 		}
-		log.Printf("[MAIN] HTTPS server starting on %s", addr)
-		if err := http.ListenAndServeTLS(addr, "server.crt", "server.key", nil); err != nil {
-			log.Fatalf("[MAIN] FATAL: HTTPS server error: %v", err)
+		if err != nil {
+			log.Fatalf("[MAIN] FATAL: %v", err)
 		}
-	} else {
-		log.Printf("[MAIN] HTTP server starting on %s", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			log.Fatalf("[MAIN] FATAL: HTTP server error: %v", err)
+	}
+
+	// SIGHUP reloads the configuration without dropping the listeners
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		running := cfg
+		for range hupChan {
+			log.Printf("[MAIN] Received SIGHUP, reloading configuration...")
+			next, err := reloadConfig(server, &certs, running, build)
+			if err != nil {
+				log.Printf("[MAIN] ERROR: Reload failed, keeping the current configuration: %v", err)
+				continue
+			}
+			running = next
 		}
+	}()
+
+	serveErrs := make(chan error, len(cfg.Listen))
+	for _, addr := range cfg.Listen {
+		go func(addr string) {
+			srv := &http.Server{Addr: addr, Handler: handler}
+			if cfg.Secure {
+				srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+				log.Printf("[MAIN] HTTPS server starting on %s", addr)
+				serveErrs <- srv.ListenAndServeTLS("", "")
+			} else {
+				log.Printf("[MAIN] HTTP server starting on %s", addr)
+				serveErrs <- srv.ListenAndServe()
+			}
+		}(addr)
 	}
+	log.Fatalf("[MAIN] FATAL: HTTP server error: %v", <-serveErrs)
 }
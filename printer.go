@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,9 +13,32 @@ type Printer struct {
 	connection_string string
 	receipt_width     int
 	connection        Writable
-	retryDelay        time.Duration
+	default_pulse     PulseDecoded
+	statusTimeout     time.Duration
+	asb               asbMonitor
+	profile           PrinterProfile
+	// wideImages is what happens to images wider than the paper:
+	// WIDE_IMAGES_SCALE, WIDE_IMAGES_CROP or WIDE_IMAGES_NONE
+	wideImages string
+	// jobs is held while a job runs and while the printer is reconfigured
+	jobs    sync.Mutex
+	queueMu sync.Mutex
+	queue   jobQueue
+
+	// retryMu guards retryDelay and retryAttempts, which the queue worker
+	// reads while the printer is offline and a reload may change
+	retryMu       sync.Mutex
+	retryDelay    time.Duration
+	retryAttempts int
+	// writes counts the operations withRetry completed, so a job can tell
+	// whether anything it sent reached the printer
+	writes atomic.Uint64
 }
 
+// DEFAULT_RETRY_DELAY is the wait between attempts when no retry policy
+// sets one
+const DEFAULT_RETRY_DELAY = 2 * time.Second
+
 type ConnectionType int
 
 const (
@@ -21,22 +47,177 @@ const (
 )
 
 var CUT_CMD = []byte{0x1d, 'V', 0x00}
+
+// GS V m [n]: functions A (0, 1), B (65, 66, feed then cut) and
+// D (103, 104, feed, cut and reserve the next print start position)
+var CUT_TYPE_CMDS = map[CutType][]byte{
+	CutFullNoFeed:  {0x1d, 'V', 0},
+	CutNoFeed:      {0x1d, 'V', 1},
+	CutFullFeed:    {0x1d, 'V', 65, 0},
+	CutFeed:        {0x1d, 'V', 66, 0},
+	CutFullReserve: {0x1d, 'V', 103, 0},
+	CutReserve:     {0x1d, 'V', 104, 0},
+}
 var PRINT_RASTER_CMD = []byte{0x1d, 0x76, 0x30, 0x00}
+
+// GS ( L / GS 8 L function 112 stores a raster image of tone a at 1x1 scale
+// (bx, by) in the print buffer, followed by the color c; function 50 prints
+// it. GS ( L has a 2 byte length, GS 8 L a 4 byte one.
+var STORE_GRAPHICS_CMD = []byte{0x1d, 0x28, 0x4c}
+var STORE_GRAPHICS_LARGE_CMD = []byte{0x1d, 0x38, 0x4c}
+var STORE_GRAPHICS_PARAMS = []byte{0x30, 0x70}
+var GRAPHICS_SCALE = []byte{0x01, 0x01}
+
+// a for GS ( L function 112: monochrome, or multiple tone, where the planes
+// stored as colors c = 49 to 52 are the bits of each dot's shade
+const (
+	GRAPHICS_TONE_MONO  = 0x30
+	GRAPHICS_TONE_MULTI = 0x34
+)
+
+// c for GS ( L function 112: the ink an image is printed in
+var GRAPHICS_COLOR_CODES = map[string]byte{
+	"color_1": 49,
+	"color_2": 50,
+	"color_3": 51,
+	"color_4": 52,
+}
+var PRINT_GRAPHICS_CMD = []byte{0x1d, 0x28, 0x4c, 0x02, 0x00, 0x30, 0x32}
 var FEED_N_CMD = func(n int) []byte {
 	return []byte{0x1b, 0x64, byte(n)}
 }
 var RESET_CMD = []byte{0x1b, 0x40}
 
+// ESC p m t1 t2: m selects the drawer kick connector pin, t1/t2 are the on
+// and off times in 2ms units. Without a configured or requested time the
+// proxy keeps its historical 50ms pulse.
+var PULSE_DRAWER_CODES = map[string]byte{
+	"drawer_1": 0,
+	"drawer_2": 1,
+}
+var PULSE_TIME_CODES = map[string]byte{
+	"pulse_100": 50,
+	"pulse_200": 100,
+	"pulse_300": 150,
+	"pulse_400": 200,
+	"pulse_500": 250,
+}
+
+const DEFAULT_PULSE_TIME_CODE = 25
+
+var LINE_FEED_CMD = []byte{0x0a}
+var FEED_UNITS_CMD = func(n int) []byte {
+	return []byte{0x1b, 0x4a, byte(n)}
+}
+var LINE_SPACING_CMD = func(n int) []byte {
+	return []byte{0x1b, 0x33, byte(n)}
+}
+
+// FS ( L functions 66-68: feed to label peeling, cutting and top of form positions
+var FEED_POSITION_CMDS = map[string][]byte{
+	"peeling":     {0x1c, 0x28, 0x4c, 0x02, 0x00, 0x42, 0x30},
+	"cutting":     {0x1c, 0x28, 0x4c, 0x02, 0x00, 0x43, 0x30},
+	"current-tof": {0x1c, 0x28, 0x4c, 0x02, 0x00, 0x44, 0x30},
+	"next-tof":    {0x1c, 0x28, 0x4c, 0x02, 0x00, 0x44, 0x31},
+}
+
+var TEXT_LANG_CODES = map[string]byte{
+	"en":    0,
+	"ja":    8,
+	"ko":    13,
+	"zh-cn": 15,
+	"zh-tw": 15,
+	"vi":    16,
+}
+
+var TEXT_FONT_CODES = map[string]byte{
+	"font_a":    0,
+	"font_b":    1,
+	"font_c":    2,
+	"font_d":    3,
+	"font_e":    4,
+	"special_a": 97,
+	"special_b": 98,
+}
+
+var TEXT_ALIGN_CODES = map[string]byte{
+	"left":   0,
+	"center": 1,
+	"right":  2,
+}
+
+var TEXT_COLOR_CODES = map[string]byte{
+	"color_1": 0,
+	"color_2": 1,
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// textStyleCommands builds the ESC/POS sequence that puts the printer into
+// the given text style. Every attribute is sent each time so the printer
+// state always matches the resolved style, regardless of what came before.
+func textStyleCommands(style TextStyle) []byte {
+	buf := []byte{}
+
+	// ESC R n: international character set
+	buf = append(buf, 0x1b, 'R', TEXT_LANG_CODES[style.Lang])
+
+	// ESC ! n: double width (bit 5) / double height (bit 4). This also
+	// resets font, emphasis and underline, so it must come first.
+	mode := byte(0)
+	if style.DoubleWidth {
+		mode |= 0x20
+	}
+	if style.DoubleHeight {
+		mode |= 0x10
+	}
+	buf = append(buf, 0x1b, '!', mode)
+
+	// ESC M n: character font
+	buf = append(buf, 0x1b, 'M', TEXT_FONT_CODES[style.Font])
+
+	// GS ! n: character size. Only sent when scaling beyond 1x so it does
+	// not cancel the double width/height selected by ESC !.
+	if style.Width > 1 || style.Height > 1 {
+		buf = append(buf, 0x1d, '!', byte((style.Width-1)<<4|(style.Height-1)))
+	}
+
+	// ESC E n: emphasis, ESC - n: underline, GS B n: reverse, GS b n: smoothing
+	buf = append(buf, 0x1b, 'E', boolByte(style.Emphasis))
+	buf = append(buf, 0x1b, '-', boolByte(style.Underline))
+	buf = append(buf, 0x1d, 'B', boolByte(style.Reverse))
+	buf = append(buf, 0x1d, 'b', boolByte(style.Smooth))
+
+	// ESC r n: print color. none and no color select color 1, so text
+	// after color_2 does not stay in it.
+	buf = append(buf, 0x1b, 'r', TEXT_COLOR_CODES[style.Color])
+
+	// ESC a n: justification
+	buf = append(buf, 0x1b, 'a', TEXT_ALIGN_CODES[style.Align])
+
+	return buf
+}
+
 func withRetry[T any](p *Printer, maxRetries int, fn func() (T, error)) (T, error) {
 	var result T
 	var err error
 
+	attempts, delay := p.retryPolicy()
+	if attempts > 0 {
+		maxRetries = attempts
+	}
 	log.Printf("[RETRY] Starting operation with max %d retries", maxRetries)
 
 	for i := range maxRetries {
 		log.Printf("[RETRY] Attempt %d/%d: Executing operation...", i+1, maxRetries)
 		result, err = fn()
 		if err == nil {
+			p.writes.Add(1)
 			if i == 0 {
 				log.Printf("[RETRY] Operation succeeded on first attempt")
 			} else {
@@ -59,8 +240,8 @@ func withRetry[T any](p *Printer, maxRetries int, fn func() (T, error)) (T, erro
 		}
 
 		if i < maxRetries-1 {
-			log.Printf("[RETRY] Waiting %v before retry attempt %d/%d...", p.retryDelay, i+2, maxRetries)
-			time.Sleep(p.retryDelay)
+			log.Printf("[RETRY] Waiting %v before retry attempt %d/%d...", delay, i+2, maxRetries)
+			time.Sleep(delay)
 
 			log.Printf("[RETRY] Attempting to reopen connection...")
 			if openErr := p.connection.Open(); openErr != nil {
@@ -68,6 +249,7 @@ func withRetry[T any](p *Printer, maxRetries int, fn func() (T, error)) (T, erro
 				err = openErr
 				continue
 			}
+			p.afterOpen()
 			log.Printf("[RETRY] Connection reopened successfully, will retry operation")
 		}
 	}
@@ -85,7 +267,8 @@ func NewPrinter(connection_string string, receipt_width int, con_type Connection
 	p := &Printer{
 		connection_string: connection_string,
 		receipt_width:     receipt_width,
-		retryDelay:        2 * time.Second,
+		retryDelay:        DEFAULT_RETRY_DELAY,
+		statusTimeout:     DEFAULT_STATUS_TIMEOUT,
 	}
 
 	switch con_type {
@@ -98,74 +281,185 @@ func NewPrinter(connection_string string, receipt_width int, con_type Connection
 	}
 
 	log.Printf("[PRINTER] Establishing initial connection...")
-	for {
-		err := p.connection.Open()
-		if err == nil {
-			log.Printf("[PRINTER] Successfully connected to printer: %s", connection_string)
-			return p, nil
-		}
-
+	if err := p.connection.Open(); err != nil {
+		// The server starts anyway; jobs are spooled until the printer
+		// can be reached
 		log.Printf("[PRINTER] Initial connection attempt failed: %v", err)
-		log.Printf("[PRINTER] Retrying in 2 seconds...")
-		time.Sleep(2 * time.Second)
+		log.Printf("[PRINTER] Printer %s is offline, jobs will be spooled", connection_string)
+		p.queue.offline = true
+		return p, nil
 	}
+	log.Printf("[PRINTER] Successfully connected to printer: %s", connection_string)
+	p.afterOpen()
+	return p, nil
 }
 
+// SetRetryPolicy sets how failed writes are retried. A zero Attempts uses
+// each operation's own attempt count and a zero Delay the default delay.
+func (p *Printer) SetRetryPolicy(policy RetryPolicy) {
+	delay := DEFAULT_RETRY_DELAY
+	if policy.Delay > 0 {
+		delay = time.Duration(policy.Delay)
+	}
+	p.retryMu.Lock()
+	p.retryAttempts = policy.Attempts
+	p.retryDelay = delay
+	p.retryMu.Unlock()
+	log.Printf("[PRINTER] Retry policy for %s: attempts=%d (0 = per operation), delay=%v",
+		p.connection_string, policy.Attempts, delay)
+}
+
+// retryPolicy returns the attempts and delay set by SetRetryPolicy
+func (p *Printer) retryPolicy() (int, time.Duration) {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	return p.retryAttempts, p.retryDelay
+}
+
+// PrintImage prints an <image>, aligned as it asks
+func (p *Printer) PrintImage(image *ImageDecoded) error {
+	data, width, height := image.Data, image.Width, image.Height
+	switch {
+	case image.ContentType != "":
+		var err error
+		data, width, height, err = rasterizeImage(image, p.receipt_width)
+		if err != nil {
+			return err
+		}
+	case image.Mode == IMAGE_GRAY16:
+		_, required_bytes, err := grayDataSize(image.Width, image.Height)
+		if err != nil {
+			return err
+		}
+		if len(data) < required_bytes {
+			return fmt.Errorf("data too short: got %d bytes, need %d bytes", len(data), required_bytes)
+		}
+		if p.raster() == RASTER_GRAPHICS && p.gray() == GRAY_MULTI_TONE {
+			return p.printMultiTone(data, width, height, image.Align)
+		}
+		log.Printf("[PRINTER] Dithering %dx%d gray16 image to monochrome", image.Width, image.Height)
+		data = ditherImage(image.Dither, gray16Darkness(data, image.Width, image.Height), image.Width, image.Height)
+	}
+	return p.printGraphics(data, width, height, image.Align, image.Color)
+}
+
+// PrintGraphics prints a raster image centered on the paper
 func (p *Printer) PrintGraphics(data []byte, width int, height int) error {
-	log.Printf("[PRINTER] PrintGraphics called: width=%d, height=%d, data_size=%d bytes", width, height, len(data))
+	return p.printGraphics(data, width, height, "center", "")
+}
+
+func (p *Printer) printGraphics(data []byte, width int, height int, align string, color string) error {
+	log.Printf("[PRINTER] PrintGraphics called: width=%d, height=%d, align=%q, data_size=%d bytes", width, height, align, len(data))
+
+	raster_data, width_bytes, height, err := p.fitRaster(data, width, height, align)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	if p.raster() == RASTER_GRAPHICS {
+		buf = graphicsBands(raster_data, width_bytes, height, p.bandHeight(), p.graphicsColor(color))
+	} else {
+		buf = rasterBands(raster_data, width_bytes, height, p.bandHeight())
+	}
+	return p.sendGraphics(buf, height)
+}
 
+// printMultiTone prints gray16 data as multi-tone graphics. Each bit of the
+// 4 bit pixels becomes a plane of 1 bit raster data, fitted to the paper
+// like any other image; scaling thins each plane on its own, so a scaled
+// image keeps its shades only roughly. The planes take up the colors, so
+// multi-tone images always print in color 1.
+func (p *Printer) printMultiTone(data []byte, width int, height int, align string) error {
+	log.Printf("[PRINTER] PrintMultiTone called: width=%d, height=%d, align=%q, data_size=%d bytes", width, height, align, len(data))
+
+	var planes [][]byte
+	var width_bytes, fitted_height int
+	for _, plane := range grayPlanes(data, width, height) {
+		fitted, w_b, h, err := p.fitRaster(plane, width, height, align)
+		if err != nil {
+			return err
+		}
+		planes = append(planes, fitted)
+		width_bytes, fitted_height = w_b, h
+	}
+	return p.sendGraphics(multiToneBands(planes, width_bytes, fitted_height, p.bandHeight()), fitted_height)
+}
+
+// fitRaster checks 1 bit per pixel raster data and fits it to the paper:
+// images wider than the paper are handled as wide_images says, and
+// narrower ones are aligned. It returns the data with its bytes per line
+// and height.
+func (p *Printer) fitRaster(data []byte, width int, height int, align string) ([]byte, int, int, error) {
 	width_bytes, required_bytes, err := rasterDataSize(width, height)
 	if err != nil {
 		log.Printf("[PRINTER] ERROR: Invalid raster dimensions: %v", err)
-		return err
+		return nil, 0, 0, err
 	}
 	log.Printf("[PRINTER] Calculated: width_bytes=%d, required_bytes=%d", width_bytes, required_bytes)
 
 	if len(data) < required_bytes {
 		log.Printf("[PRINTER] ERROR: Image data too short: got %d bytes, need %d bytes", len(data), required_bytes)
-		return fmt.Errorf("data too short: got %d bytes, need %d bytes", len(data), required_bytes)
+		return nil, 0, 0, fmt.Errorf("data too short: got %d bytes, need %d bytes", len(data), required_bytes)
+	}
+
+	if height == 0 {
+		log.Printf("[PRINTER] Image has no lines, nothing to fit")
+		return nil, width_bytes, 0, nil
 	}
 
 	raster_data := data[:required_bytes]
 	paper_width_bytes, err := rasterWidthBytes(p.receipt_width)
 	if err != nil {
 		log.Printf("[PRINTER] ERROR: Invalid receipt width: %v", err)
-		return err
+		return nil, 0, 0, err
 	}
 	log.Printf("[PRINTER] Paper width: %d pixels (%d bytes)", p.receipt_width, paper_width_bytes)
 
+	if width > p.receipt_width && p.receipt_width > 0 {
+		switch p.wideImages {
+		case WIDE_IMAGES_CROP:
+			log.Printf("[PRINTER] Image width (%d) > paper width (%d), cropping image (align=%q)...", width, p.receipt_width, align)
+			raster_data = cropRaster(raster_data, width, height, cropOffset(width, p.receipt_width, align), p.receipt_width)
+			width = p.receipt_width
+			width_bytes = paper_width_bytes
+		case WIDE_IMAGES_NONE:
+			log.Printf("[PRINTER] Image width (%d) > paper width (%d), sending unchanged", width, p.receipt_width)
+		default:
+			log.Printf("[PRINTER] Image width (%d) > paper width (%d), scaling image...", width, p.receipt_width)
+			raster_data, height = scaleRaster(raster_data, width, height, p.receipt_width)
+			width = p.receipt_width
+			width_bytes = paper_width_bytes
+		}
+		log.Printf("[PRINTER] Image now %dx%d (%d bytes per line)", width, height, width_bytes)
+	}
+
 	if width < p.receipt_width {
-		log.Printf("[PRINTER] Image width (%d) < paper width (%d), centering image...", width, p.receipt_width)
-		centered, err := center(raster_data, width_bytes, paper_width_bytes, height)
+		log.Printf("[PRINTER] Image width (%d) < paper width (%d), aligning image %q...", width, p.receipt_width, align)
+		aligned, err := alignRaster(raster_data, width, p.receipt_width, height, align)
 		if err != nil {
-			log.Printf("[PRINTER] ERROR: Centering failed: %v", err)
-			return err
+			log.Printf("[PRINTER] ERROR: Aligning failed: %v", err)
+			return nil, 0, 0, err
 		}
-		raster_data = centered
+		raster_data = aligned
 		width = p.receipt_width
 		width_bytes = paper_width_bytes
-		log.Printf("[PRINTER] Image centered successfully, new width: %d bytes", width_bytes)
+		log.Printf("[PRINTER] Image aligned successfully, new width: %d bytes", width_bytes)
 	} else {
-		log.Printf("[PRINTER] Image width (%d) >= paper width (%d), no centering needed", width, p.receipt_width)
+		log.Printf("[PRINTER] Image width (%d) >= paper width (%d), no alignment needed", width, p.receipt_width)
 	}
 
-	xL := byte(width_bytes & 0xFF)
-	xH := byte((width_bytes >> 8) & 0xFF)
-	yL := byte(height & 0xFF)
-	yH := byte((height >> 8) & 0xff)
-	log.Printf("[PRINTER] Raster command parameters: xL=%d, xH=%d, yL=%d, yH=%d", xL, xH, yL, yH)
-
-	totalLen := 4 + 4 + len(raster_data) + 3
-	buf := make([]byte, 0, totalLen)
+	return raster_data, width_bytes, height, nil
+}
 
-	buf = append(buf, PRINT_RASTER_CMD...)
-	buf = append(buf, xL, xH, yL, yH)
-	buf = append(buf, raster_data...)
+// sendGraphics sends the commands for an image, then feeds past it
+func (p *Printer) sendGraphics(buf []byte, height int) error {
 	buf = append(buf, FEED_N_CMD(12)...)
-	log.Printf("[PRINTER] Command buffer prepared: %d bytes total", len(buf))
+	log.Printf("[PRINTER] Command buffer prepared: %d bytes total (%d %s band(s) of up to %d lines)",
+		len(buf), (height+p.bandHeight()-1)/p.bandHeight(), p.raster(), p.bandHeight())
 
 	log.Printf("[PRINTER] Sending raster print command with retry...")
-	_, err = withRetry(p, 3, func() (any, error) {
+	_, err := withRetry(p, 3, func() (any, error) {
 		return nil, p.connection.WriteRaw(buf)
 	})
 
@@ -178,12 +472,178 @@ func (p *Printer) PrintGraphics(data []byte, width int, height int) error {
 	return err
 }
 
-func (p *Printer) KickDrawer() error {
+func (p *Printer) PrintText(text *TextDecoded) error {
+	log.Printf("[PRINTER] PrintText called: %d characters, style=%+v", len(text.Content), text.Style)
+
+	buf := textStyleCommands(text.Style)
+	buf = append(buf, encodeText(text.Content, text.Style.Lang, p.encoding())...)
+	log.Printf("[PRINTER] Text command buffer prepared: %d bytes total", len(buf))
+
+	_, err := withRetry(p, 3, func() (any, error) {
+		return nil, p.connection.WriteRaw(buf)
+	})
+
+	if err != nil {
+		log.Printf("[PRINTER] ERROR: PrintText failed after retries: %v", err)
+	} else {
+		log.Printf("[PRINTER] PrintText completed successfully")
+	}
+
+	return err
+}
+
+func feedCommands(feed *FeedDecoded) []byte {
+	buf := []byte{}
+	if feed.SetLineSpacing {
+		buf = append(buf, LINE_SPACING_CMD(feed.LineSpacing)...)
+	}
+
+	switch feed.Mode {
+	case FeedLineFeed:
+		buf = append(buf, LINE_FEED_CMD...)
+	case FeedLines:
+		buf = append(buf, FEED_N_CMD(feed.Amount)...)
+	case FeedUnits:
+		buf = append(buf, FEED_UNITS_CMD(feed.Amount)...)
+	case FeedPosition:
+		buf = append(buf, FEED_POSITION_CMDS[feed.Pos]...)
+	}
+
+	return buf
+}
+
+func (p *Printer) Feed(feed *FeedDecoded) error {
+	log.Printf("[PRINTER] Feed called: %+v", *feed)
+
+	buf := feedCommands(feed)
+	_, err := withRetry(p, 8, func() (any, error) {
+		log.Printf("[PRINTER] Sending feed command (%d bytes)", len(buf))
+		return nil, p.connection.WriteRaw(buf)
+	})
+
+	if err != nil {
+		log.Printf("[PRINTER] ERROR: Feed failed: %v", err)
+	} else {
+		log.Printf("[PRINTER] Feed completed successfully")
+	}
+
+	return err
+}
+
+func (p *Printer) FeedLines(n int) error {
+	return p.Feed(&FeedDecoded{Mode: FeedLines, Amount: n})
+}
+
+func (p *Printer) FeedUnits(n int) error {
+	return p.Feed(&FeedDecoded{Mode: FeedUnits, Amount: n})
+}
+
+func barcodeCommands(barcode *BarcodeDecoded) []byte {
+	buf := []byte{}
+	buf = append(buf, 0x1d, 'h', byte(barcode.Height))
+	buf = append(buf, 0x1d, 'w', byte(barcode.Width))
+	buf = append(buf, 0x1d, 'H', BARCODE_HRI_CODES[barcode.HRI])
+	buf = append(buf, 0x1d, 'f', BARCODE_FONT_CODES[barcode.Font])
+	buf = append(buf, 0x1d, 'k', barcodeSymbologies[barcode.Type].code, byte(len(barcode.Data)))
+	buf = append(buf, barcode.Data...)
+	return buf
+}
+
+func (p *Printer) PrintBarcode(barcode *BarcodeDecoded) error {
+	log.Printf("[PRINTER] PrintBarcode called: type=%s, hri=%s, font=%s, width=%d, height=%d, data_size=%d bytes",
+		barcode.Type, barcode.HRI, barcode.Font, barcode.Width, barcode.Height, len(barcode.Data))
+
+	buf := barcodeCommands(barcode)
+	log.Printf("[PRINTER] Barcode command buffer prepared: %d bytes total", len(buf))
+
+	_, err := withRetry(p, 3, func() (any, error) {
+		return nil, p.connection.WriteRaw(buf)
+	})
+
+	if err != nil {
+		log.Printf("[PRINTER] ERROR: PrintBarcode failed after retries: %v", err)
+	} else {
+		log.Printf("[PRINTER] PrintBarcode completed successfully")
+	}
+
+	return err
+}
+
+func (p *Printer) PrintSymbol(symbol *SymbolDecoded) error {
+	log.Printf("[PRINTER] PrintSymbol called: type=%s, level=%s, width=%d, height=%d, size=%d, data_size=%d bytes",
+		symbol.Type, symbol.Level, symbol.Width, symbol.Height, symbol.Size, len(symbol.Data))
+
+	buf := symbolCommands(symbol)
+	log.Printf("[PRINTER] Symbol command buffer prepared: %d bytes total", len(buf))
+
+	_, err := withRetry(p, 3, func() (any, error) {
+		return nil, p.connection.WriteRaw(buf)
+	})
+
+	if err != nil {
+		log.Printf("[PRINTER] ERROR: PrintSymbol failed after retries: %v", err)
+	} else {
+		log.Printf("[PRINTER] PrintSymbol completed successfully")
+	}
+
+	return err
+}
+
+func (p *Printer) WriteCommand(command []byte) error {
+	log.Printf("[PRINTER] WriteCommand called: %d bytes", len(command))
+
+	_, err := withRetry(p, 3, func() (any, error) {
+		return nil, p.connection.WriteRaw(command)
+	})
+
+	if err != nil {
+		log.Printf("[PRINTER] ERROR: WriteCommand failed after retries: %v", err)
+	} else {
+		log.Printf("[PRINTER] WriteCommand completed successfully")
+	}
+
+	return err
+}
+
+// SetDefaultPulse sets the drawer and pulse time used when a <pulse> element
+// does not specify them. Empty values keep drawer_1 and the 50ms pulse.
+func (p *Printer) SetDefaultPulse(drawer string, pulseTime string) error {
+	if _, ok := PULSE_DRAWER_CODES[drawer]; drawer != "" && !ok {
+		return fmt.Errorf("invalid default drawer %q: must be one of %s", drawer, strings.Join(pulseDrawers, ", "))
+	}
+	if _, ok := PULSE_TIME_CODES[pulseTime]; pulseTime != "" && !ok {
+		return fmt.Errorf("invalid default pulse time %q: must be one of %s", pulseTime, strings.Join(pulseTimes, ", "))
+	}
+
+	p.default_pulse = PulseDecoded{Drawer: drawer, Time: pulseTime}
+	log.Printf("[PRINTER] Default pulse set: drawer=%q, time=%q", drawer, pulseTime)
+	return nil
+}
+
+// pulseCommand resolves the requested pulse against the printer defaults
+func (p *Printer) pulseCommand(pulse *PulseDecoded) []byte {
+	drawer := p.default_pulse.Drawer
+	pulseTime := p.default_pulse.Time
+	if pulse != nil && pulse.Drawer != "" {
+		drawer = pulse.Drawer
+	}
+	if pulse != nil && pulse.Time != "" {
+		pulseTime = pulse.Time
+	}
+
+	t := byte(DEFAULT_PULSE_TIME_CODE)
+	if code, ok := PULSE_TIME_CODES[pulseTime]; ok {
+		t = code
+	}
+	return []byte{0x1B, 0x70, PULSE_DRAWER_CODES[drawer], t, t}
+}
+
+func (p *Printer) KickDrawer(pulse *PulseDecoded) error {
 	log.Printf("[PRINTER] KickDrawer called - sending drawer kick command")
 
+	KICK_CMD := p.pulseCommand(pulse)
 	_, err := withRetry(p, 8, func() (any, error) {
-		var KICK_CMD = []byte{0x1B, 0x70, 0, 25, 25}
-		log.Printf("[PRINTER] Sending drawer kick command (ESC p 0 25 25)")
+		log.Printf("[PRINTER] Sending drawer kick command (ESC p %d %d %d)", KICK_CMD[2], KICK_CMD[3], KICK_CMD[4])
 		err := p.connection.WriteRaw(KICK_CMD)
 		if err != nil {
 			return nil, err
@@ -200,10 +660,19 @@ func (p *Printer) KickDrawer() error {
 	return err
 }
 
-func (p *Printer) Cut() error {
-	log.Printf("[PRINTER] Cut called - executing paper cut sequence")
+func (p *Printer) Cut(cutType CutType) error {
+	log.Printf("[PRINTER] Cut called - executing paper cut sequence (type=%d)", cutType)
 
 	_, err := withRetry(p, 8, func() (any, error) {
+		if cmd, ok := CUT_TYPE_CMDS[cutType]; ok {
+			log.Printf("[PRINTER] Sending cut command (GS V %d)", cmd[2])
+			if err := p.connection.WriteRaw(cmd); err != nil {
+				return nil, fmt.Errorf("cut command failed: %w", err)
+			}
+			log.Printf("[PRINTER] Cut command sent successfully")
+			return nil, nil
+		}
+
 		log.Printf("[PRINTER] Sending cut command (GS V 0)")
 		err := p.connection.WriteRaw(CUT_CMD)
 		if err != nil {
@@ -276,9 +745,58 @@ func center(d []byte, w_b int, p_w_b int, h int) ([]byte, error) {
 	return centered_data, nil
 }
 
+// graphicsColor is the GS ( L color code for an image's color. Colors the
+// printer's profile doesn't have print in color 1.
+func (p *Printer) graphicsColor(color string) byte {
+	code, ok := GRAPHICS_COLOR_CODES[color]
+	if !ok || int(code-GRAPHICS_COLOR_CODES["color_1"]) >= p.profile.Colors {
+		return GRAPHICS_COLOR_CODES["color_1"]
+	}
+	return code
+}
+
+// alignRaster pads each row of an image w dots wide out to the paper width
+// of p_w dots, placing the image at the left, center or right. An empty align
+// centers, as the proxy always has. Right-aligned images are shifted bit by
+// bit, so that their last dot lands on the paper's last dot.
+func alignRaster(d []byte, w int, p_w int, h int, align string) ([]byte, error) {
+	w_b := (w + 7) / 8
+	p_w_b := (p_w + 7) / 8
+	switch align {
+	case "", "center":
+		return center(d, w_b, p_w_b, h)
+	case "left", "right":
+	default:
+		return nil, fmt.Errorf("align: unknown alignment %q", align)
+	}
+	if len(d) < w_b*h {
+		return nil, fmt.Errorf("align: data too short: got %d bytes, need %d bytes", len(d), w_b*h)
+	}
+
+	aligned := make([]byte, p_w_b*h)
+	if align == "left" {
+		for y := range h {
+			copy(aligned[y*p_w_b:], d[y*w_b:(y+1)*w_b])
+		}
+		return aligned, nil
+	}
+
+	offset := p_w - w
+	for y := range h {
+		for x := range w {
+			if rasterPixel(d, w_b, x, y) {
+				setRasterPixel(aligned, p_w_b, x+offset, y)
+			}
+		}
+	}
+	return aligned, nil
+}
+
 func (p *Printer) Close() error {
 	log.Printf("[PRINTER] Close called for printer: %s", p.connection_string)
 
+	p.stopASB()
+
 	if p.connection == nil {
 		log.Printf("[PRINTER] WARNING: Connection is nil, nothing to close")
 		return nil
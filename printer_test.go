@@ -3,8 +3,12 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 // MockWritable for testing error conditions
@@ -32,6 +36,76 @@ func (m *MockWritable) Close() error {
 	return m.CloseError
 }
 
+// FakeConnection is an in-memory bidirectional printer connection. Every
+// write is recorded, and Respond (when set) returns the bytes the printer
+// would send back for that write. With nothing pending, reads wait briefly
+// and fail with a deadline error.
+type FakeConnection struct {
+	mu      sync.Mutex
+	Written []byte
+	Respond func(data []byte) []byte
+	MaxRead int
+	pending []byte
+}
+
+func (f *FakeConnection) WriteRaw(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Written = append(f.Written, data...)
+	if f.Respond != nil {
+		f.pending = append(f.pending, f.Respond(data)...)
+	}
+	return nil
+}
+
+func (f *FakeConnection) ReadRaw(buf []byte, timeout time.Duration) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.pending) == 0 {
+		f.mu.Unlock()
+		time.Sleep(min(timeout, 5*time.Millisecond))
+		f.mu.Lock()
+		return 0, fmt.Errorf("fake read: %w", os.ErrDeadlineExceeded)
+	}
+	n := len(buf)
+	if f.MaxRead > 0 && n > f.MaxRead {
+		n = f.MaxRead
+	}
+	n = copy(buf[:n], f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// Feed queues bytes as if the printer had sent them unprompted
+func (f *FakeConnection) Feed(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, data...)
+}
+
+func (f *FakeConnection) Open() error  { return nil }
+func (f *FakeConnection) Close() error { return nil }
+
+// statusResponder answers DLE EOT 1-4 with the given status bytes
+func statusResponder(status [4]byte) func([]byte) []byte {
+	return func(data []byte) []byte {
+		if len(data) == 3 && data[0] == 0x10 && data[1] == 0x04 && data[2] >= 1 && data[2] <= 4 {
+			return []byte{status[data[2]-1]}
+		}
+		return nil
+	}
+}
+
+func createFakePrinter(conn *FakeConnection) *Printer {
+	return &Printer{
+		connection_string: "fake",
+		receipt_width:     576,
+		connection:        conn,
+		retryDelay:        0,
+		statusTimeout:     10 * time.Millisecond,
+	}
+}
+
 func createMockPrinter() (*Printer, string) {
 	f, err := os.CreateTemp("/tmp/", "epsonproxytest")
 	if err != nil {
@@ -70,7 +144,7 @@ func TestKickDrawer_Bytes(t *testing.T) {
 	printer, path := createMockPrinter()
 	defer os.Remove(path)
 
-	err := printer.KickDrawer()
+	err := printer.KickDrawer(nil)
 	if err != nil {
 		t.Fatalf("KickDrawer failed: %v", err)
 	}
@@ -97,7 +171,7 @@ func TestKickDrawer_WriteRawFailure(t *testing.T) {
 		retryDelay:        0,
 	}
 
-	err := printer.KickDrawer()
+	err := printer.KickDrawer(nil)
 	if err == nil {
 		t.Error("expected error when WriteRaw fails, got nil")
 	}
@@ -107,7 +181,7 @@ func TestCut_Bytes(t *testing.T) {
 	printer, path := createMockPrinter()
 	defer os.Remove(path)
 
-	err := printer.Cut()
+	err := printer.Cut(CutDefault)
 	if err != nil {
 		t.Fatalf("Cut failed: %v", err)
 	}
@@ -150,7 +224,7 @@ func TestCut_WriteRawFailure(t *testing.T) {
 		connection:        mock,
 	}
 
-	err := printer.Cut()
+	err := printer.Cut(CutDefault)
 	if err == nil {
 		t.Error("expected error when WriteRaw fails on feed, got nil")
 	}
@@ -312,6 +386,93 @@ func TestPrintGraphics_DataTooShort(t *testing.T) {
 	}
 }
 
+func TestPrintGraphics_Bands(t *testing.T) {
+	mock := &MockWritable{}
+	printer := &Printer{connection_string: "/test", receipt_width: 576, connection: mock}
+	printer.SetProfile(PrinterProfile{Name: "test", MaxBandHeight: 4})
+
+	widthBytes, height := 72, 10
+	data := make([]byte, widthBytes*height)
+	for i := range data {
+		data[i] = byte(i / widthBytes)
+	}
+	if err := printer.PrintGraphics(data, 576, height); err != nil {
+		t.Fatalf("PrintGraphics failed: %v", err)
+	}
+
+	// Bands of 4, 4 and 2 lines, each with its own header and in order
+	buf := mock.WriteRawCalls[0]
+	line := 0
+	for _, lines := range []int{4, 4, 2} {
+		header := append(append([]byte{}, PRINT_RASTER_CMD...), byte(widthBytes), 0, byte(lines), 0)
+		if !bytes.HasPrefix(buf, header) {
+			t.Fatalf("expected band header %v, got %v", header, buf[:min(len(buf), len(header))])
+		}
+		buf = buf[len(header):]
+		for range lines {
+			if buf[0] != byte(line) {
+				t.Errorf("expected line %d, got line %d", line, buf[0])
+			}
+			buf = buf[widthBytes:]
+			line++
+		}
+	}
+	if !bytes.Equal(buf, FEED_N_CMD(12)) {
+		t.Errorf("expected feed after the last band, got %v", buf)
+	}
+}
+
+func TestPrintGraphics_GraphicsCommand(t *testing.T) {
+	mock := &MockWritable{}
+	printer := &Printer{connection_string: "/test", receipt_width: 576, connection: mock}
+	printer.SetProfile(PrinterProfile{Name: "test", MaxBandHeight: 1000, Raster: RASTER_GRAPHICS})
+
+	// 72 bytes x 1000 lines is too long for GS ( L, the last 2 lines are not
+	widthBytes, height := 72, 1002
+	data := make([]byte, widthBytes*height)
+	if err := printer.PrintGraphics(data, 576, height); err != nil {
+		t.Fatalf("PrintGraphics failed: %v", err)
+	}
+
+	buf := mock.WriteRawCalls[0]
+	large := 10 + widthBytes*1000
+	expected := append([]byte{0x1d, 0x38, 0x4c, byte(large), byte(large >> 8), byte(large >> 16), 0},
+		0x30, 0x70, 0x30, 0x01, 0x01, 0x31, 0x40, 0x02, 0xe8, 0x03)
+	if !bytes.HasPrefix(buf, expected) {
+		t.Fatalf("expected GS 8 L header %v, got %v", expected, buf[:len(expected)])
+	}
+	buf = buf[len(expected)+widthBytes*1000:]
+	if !bytes.HasPrefix(buf, PRINT_GRAPHICS_CMD) {
+		t.Fatalf("expected print after the first band, got %v", buf[:len(PRINT_GRAPHICS_CMD)])
+	}
+	buf = buf[len(PRINT_GRAPHICS_CMD):]
+
+	small := 10 + widthBytes*2
+	expected = []byte{0x1d, 0x28, 0x4c, byte(small), 0, 0x30, 0x70, 0x30, 0x01, 0x01, 0x31, 0x40, 0x02, 0x02, 0x00}
+	if !bytes.HasPrefix(buf, expected) {
+		t.Fatalf("expected GS ( L header %v, got %v", expected, buf[:len(expected)])
+	}
+	buf = buf[len(expected)+widthBytes*2:]
+	if !bytes.Equal(buf, append(append([]byte{}, PRINT_GRAPHICS_CMD...), FEED_N_CMD(12)...)) {
+		t.Errorf("expected print and feed after the last band, got %v", buf)
+	}
+}
+
+func TestStoreGraphics_Spec(t *testing.T) {
+	// GS ( L function 112, as laid out in the ESC/POS command reference:
+	// GS ( L pL pH m fn a bx by c xL xH yL yH d1...dk, with m = 48,
+	// fn = 112, a = 48 for monochrome, bx = by = 1, c = 49 for the first
+	// ink and (pL + pH*256) = 10 + k. Function 50 is GS ( L 2 0 48 50.
+	got := graphicsBands([]byte{0xff, 0x00, 0x0f, 0xf0}, 2, 2, 256, 49)
+	expected := []byte{
+		0x1d, 0x28, 0x4c, 14, 0, 48, 112, 48, 1, 1, 49, 16, 0, 2, 0, 0xff, 0x00, 0x0f, 0xf0,
+		0x1d, 0x28, 0x4c, 2, 0, 48, 50,
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
 func TestPrintGraphics_WriteRawFailure(t *testing.T) {
 	mock := &MockWritable{
 		WriteRawError: errors.New("write failed"),
@@ -434,6 +595,223 @@ func TestCenter_ExactSize(t *testing.T) {
 	}
 }
 
+func TestAlignRaster(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	tests := []struct {
+		align    string
+		expected []byte
+	}{
+		{"", []byte{0, 1, 2, 0, 0, 3, 4, 0}},
+		{"center", []byte{0, 1, 2, 0, 0, 3, 4, 0}},
+		{"left", []byte{1, 2, 0, 0, 3, 4, 0, 0}},
+		{"right", []byte{0, 0, 1, 2, 0, 0, 3, 4}},
+	}
+	for _, tt := range tests {
+		result, err := alignRaster(data, 16, 32, 2, tt.align)
+		if err != nil {
+			t.Fatalf("align %q failed: %v", tt.align, err)
+		}
+		if !bytes.Equal(result, tt.expected) {
+			t.Errorf("align %q: got %v, expected %v", tt.align, result, tt.expected)
+		}
+	}
+	if _, err := alignRaster(data, 16, 32, 2, "middle"); err == nil {
+		t.Errorf("expected error for unknown alignment")
+	}
+
+	// 12 dots on 30 dot paper end on the paper's last dot, not a byte edge
+	result, err := alignRaster([]byte{0xff, 0xf0}, 12, 30, 1, "right")
+	if err != nil {
+		t.Fatalf("align right failed: %v", err)
+	}
+	if expected := []byte{0, 0, 0x3f, 0xfc}; !bytes.Equal(result, expected) {
+		t.Errorf("align right: got %x, expected %x", result, expected)
+	}
+}
+
+func TestCropRaster(t *testing.T) {
+	// 16 pixels wide, cropped to the 8 starting at column 4
+	data := []byte{0x0f, 0xf0, 0xff, 0x00}
+	tests := []struct {
+		align    string
+		expected []byte
+	}{
+		{"left", []byte{0x0f, 0xff}},
+		{"center", []byte{0xff, 0xf0}},
+		{"right", []byte{0xf0, 0x00}},
+	}
+	for _, tt := range tests {
+		result := cropRaster(data, 16, 2, cropOffset(16, 8, tt.align), 8)
+		if !bytes.Equal(result, tt.expected) {
+			t.Errorf("crop %q: got %08b, expected %08b", tt.align, result, tt.expected)
+		}
+	}
+}
+
+func TestScaleRaster(t *testing.T) {
+	// A 16x2 image halved to 8x1: each output pixel covers a 2x2 block
+	data := []byte{0xf0, 0xcc, 0xf0, 0x00}
+	result, height := scaleRaster(data, 16, 2, 8)
+	if height != 1 {
+		t.Fatalf("expected height 1, got %d", height)
+	}
+	if !bytes.Equal(result, []byte{0xca}) {
+		t.Errorf("got %08b, expected %08b", result, []byte{0xca})
+	}
+}
+
+func TestPrintImage_WideImages(t *testing.T) {
+	tests := []struct {
+		wideImages string
+		width      int
+		height     int
+	}{
+		{WIDE_IMAGES_SCALE, 64, 1},
+		{WIDE_IMAGES_CROP, 64, 2},
+		{WIDE_IMAGES_NONE, 128, 2},
+	}
+	for _, tt := range tests {
+		mock := &MockWritable{}
+		printer := &Printer{connection_string: "/test", receipt_width: 64, connection: mock, wideImages: tt.wideImages}
+		image := &ImageDecoded{Width: 128, Height: 2, Data: make([]byte, 32)}
+		if err := printer.PrintImage(image); err != nil {
+			t.Fatalf("%s: PrintImage failed: %v", tt.wideImages, err)
+		}
+		widthBytes := tt.width / 8
+		header := append(append([]byte{}, PRINT_RASTER_CMD...), byte(widthBytes), 0, byte(tt.height), 0)
+		if !bytes.HasPrefix(mock.WriteRawCalls[0], header) {
+			t.Errorf("%s: expected header %v, got %v", tt.wideImages, header, mock.WriteRawCalls[0][:len(header)])
+		}
+	}
+}
+
+func TestPrintImage_WideImagesNoLines(t *testing.T) {
+	for _, wideImages := range []string{WIDE_IMAGES_SCALE, WIDE_IMAGES_CROP} {
+		for _, mode := range []string{IMAGE_MONO, IMAGE_GRAY16} {
+			mock := &MockWritable{}
+			printer := &Printer{connection_string: "/test", receipt_width: 64, connection: mock, wideImages: wideImages}
+			image := &ImageDecoded{Width: 1000, Height: 0, Mode: mode}
+			if err := printer.PrintImage(image); err != nil {
+				t.Errorf("%s %s: PrintImage failed: %v", wideImages, mode, err)
+			}
+		}
+	}
+	if result, height := scaleRaster(nil, 1000, 0, 64); len(result) != 0 || height != 0 {
+		t.Errorf("expected an empty image to scale to nothing, got %d bytes, height %d", len(result), height)
+	}
+}
+
+func TestDitherFloydSteinberg(t *testing.T) {
+	// 16x2 pixels: a black row, then a mid gray one
+	data := append(bytes.Repeat([]byte{0xff}, 8), bytes.Repeat([]byte{0x88}, 8)...)
+	result := ditherFloydSteinberg(gray16Darkness(data, 16, 2), 16, 2)
+	if !bytes.Equal(result[:2], []byte{0xff, 0xff}) {
+		t.Errorf("expected black row to stay black, got %08b", result[:2])
+	}
+	black := 0
+	for x := range 16 {
+		if rasterPixel(result, 2, x, 1) {
+			black++
+		}
+	}
+	if black < 6 || black > 10 {
+		t.Errorf("expected about half of a mid gray row to be black, got %d of 16", black)
+	}
+}
+
+func TestDitherImage_Methods(t *testing.T) {
+	// 8x8: a white row, six rows ramping from white to black, a black row
+	ramp := func() []int {
+		darkness := make([]int, 64)
+		for i := 8; i < 56; i++ {
+			darkness[i] = (i - 8) * 255 / 47
+		}
+		for i := 56; i < 64; i++ {
+			darkness[i] = 255
+		}
+		return darkness
+	}
+
+	for _, method := range []string{DITHER_THRESHOLD, DITHER_FLOYD_STEINBERG, DITHER_ATKINSON, DITHER_BAYER} {
+		result := ditherImage(method, ramp(), 8, 8)
+		if result[0] != 0x00 || result[7] != 0xff {
+			t.Errorf("%s: expected a white top row and a black bottom row, got %08b", method, result)
+		}
+		black := 0
+		for _, b := range result {
+			for ; b != 0; b &= b - 1 {
+				black++
+			}
+		}
+		if black < 24 || black > 40 {
+			t.Errorf("%s: expected about half of a ramp to be black, got %d of 64", method, black)
+		}
+	}
+
+	if err := parseDither("halftone"); err == nil {
+		t.Errorf("expected error for unknown dither")
+	}
+}
+
+func TestPrintImage_Gray16(t *testing.T) {
+	mock := &MockWritable{}
+	printer := &Printer{connection_string: "/test", receipt_width: 16, connection: mock}
+	printer.SetProfile(PrinterProfile{Name: "test", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 2})
+
+	image := &ImageDecoded{Width: 16, Height: 1, Mode: IMAGE_GRAY16, Color: "color_2", Data: bytes.Repeat([]byte{0xff}, 8)}
+	if err := printer.PrintImage(image); err != nil {
+		t.Fatalf("PrintImage failed: %v", err)
+	}
+	expected := []byte{0x1d, 0x28, 0x4c, 12, 0, 0x30, 0x70, 0x30, 0x01, 0x01, 50, 16, 0, 1, 0, 0xff, 0xff}
+	if !bytes.HasPrefix(mock.WriteRawCalls[0], expected) {
+		t.Errorf("expected dithered image in color 2 %v, got %v", expected, mock.WriteRawCalls[0])
+	}
+
+	// Inks the profile lacks fall back to color 1
+	printer.SetProfile(PrinterProfile{Name: "test", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1})
+	if code := printer.graphicsColor("color_2"); code != 49 {
+		t.Errorf("expected color 1 on a one color printer, got %d", code)
+	}
+}
+
+func TestPrintImage_MultiTone(t *testing.T) {
+	mock := &MockWritable{}
+	printer := &Printer{connection_string: "/test", receipt_width: 8, connection: mock}
+	printer.SetProfile(PrinterProfile{Name: "test", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 2, Gray: GRAY_MULTI_TONE})
+
+	// Shades 15, 10, 5 and 0, then white; each plane holds one bit of them
+	image := &ImageDecoded{Width: 8, Height: 1, Mode: IMAGE_GRAY16, Color: "color_2", Data: []byte{0xfa, 0x50, 0, 0}}
+	if err := printer.PrintImage(image); err != nil {
+		t.Fatalf("PrintImage failed: %v", err)
+	}
+	buf := mock.WriteRawCalls[0]
+	for i, plane := range []byte{0xc0, 0xa0, 0xc0, 0xa0} {
+		expected := []byte{0x1d, 0x28, 0x4c, 11, 0, 0x30, 0x70, 0x34, 0x01, 0x01, byte(49 + i), 8, 0, 1, 0, plane}
+		if !bytes.HasPrefix(buf, expected) {
+			t.Fatalf("plane %d: expected %v, got %v", i, expected, buf[:min(len(buf), len(expected))])
+		}
+		buf = buf[len(expected):]
+	}
+	if !bytes.HasPrefix(buf, PRINT_GRAPHICS_CMD) {
+		t.Errorf("expected print after the planes, got %v", buf)
+	}
+
+	// Printers without multi-tone dither, and so does GS v 0
+	for _, profile := range []PrinterProfile{
+		{Name: "test", MaxBandHeight: 256, Raster: RASTER_GRAPHICS},
+		{Name: "test", MaxBandHeight: 256, Raster: RASTER_GS_V_0, Gray: GRAY_MULTI_TONE},
+	} {
+		mock.WriteRawCalls = nil
+		printer.SetProfile(profile)
+		if err := printer.PrintImage(image); err != nil {
+			t.Fatalf("PrintImage failed: %v", err)
+		}
+		if bytes.Contains(mock.WriteRawCalls[0], []byte{0x30, 0x70, 0x34}) {
+			t.Errorf("%+v: expected a dithered image, got multi-tone graphics", profile)
+		}
+	}
+}
+
 func TestClose(t *testing.T) {
 	printer, path := createMockPrinter()
 	defer os.Remove(path)
@@ -704,3 +1082,444 @@ func TestReset_WriteRawFailure(t *testing.T) {
 		t.Error("expected error when WriteRaw fails, got nil")
 	}
 }
+
+func TestPrintText_Bytes(t *testing.T) {
+	printer, path := createMockPrinter()
+	defer os.Remove(path)
+
+	style := defaultTextStyle()
+	style.DoubleHeight = true
+	style.Width = 2
+	style.Height = 2
+	style.Emphasis = true
+	style.Align = "center"
+
+	err := printer.PrintText(&TextDecoded{Content: "Hi\n", Style: style})
+	if err != nil {
+		t.Fatalf("PrintText failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	expected := []byte{
+		0x1b, 'R', 0,
+		0x1b, '!', 0x10,
+		0x1b, 'M', 0,
+		0x1d, '!', 0x11,
+		0x1b, 'E', 1,
+		0x1b, '-', 0,
+		0x1d, 'B', 0,
+		0x1d, 'b', 0,
+		0x1b, 'r', 0,
+		0x1b, 'a', 1,
+		'H', 'i', '\n',
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("PrintText sent wrong bytes. Got %v, expected %v", data, expected)
+	}
+}
+
+func TestEncodeText(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		lang     string
+		encoding string
+		expected []byte
+	}{
+		{"ascii", "Hi\r\n", "en", TEXT_ENCODING_CODE_PAGE, []byte("Hi\n")},
+		{"latin", "Crème €5", "en", TEXT_ENCODING_CODE_PAGE, []byte{'C', 'r', 0x1b, 't', 16, 0xe8, 'm', 'e', ' ', 0x80, '5'}},
+		{"cyrillic then latin", "Щи é", "en", TEXT_ENCODING_CODE_PAGE, []byte{0x1b, 't', 17, 0x99, 0xa8, ' ', 0x1b, 't', 16, 0xe9}},
+		{"stays on the current page", "Ж°", "en", TEXT_ENCODING_CODE_PAGE, []byte{0x1b, 't', 17, 0x86, 0xf8}},
+		{"no code page", "寿司\x07", "ja", TEXT_ENCODING_CODE_PAGE, []byte("???")},
+		{"utf-8", "寿司\r\n", "ja", TEXT_ENCODING_UTF8,
+			append(append(bytes.Clone(UTF8_ENCODING_CMD), FONT_PRIORITY_CMD(11)...), "寿司\n"...)},
+		{"utf-8 without a font", "é", "en", TEXT_ENCODING_UTF8, append(bytes.Clone(UTF8_ENCODING_CMD), "é"...)},
+	}
+	for _, tt := range tests {
+		if got := encodeText(tt.content, tt.lang, tt.encoding); !bytes.Equal(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestPrintText_ColorNone(t *testing.T) {
+	mock := &MockWritable{}
+	printer := &Printer{connection_string: "/test", connection: mock}
+
+	style := defaultTextStyle()
+	style.Color = "color_2"
+	printer.PrintText(&TextDecoded{Content: "red", Style: style})
+	style.Color = "none"
+	printer.PrintText(&TextDecoded{Content: "black", Style: style})
+
+	if !bytes.Contains(mock.WriteRawCalls[0], []byte{0x1b, 'r', 1}) {
+		t.Errorf("expected color 2 to be selected, got %v", mock.WriteRawCalls[0])
+	}
+	if !bytes.Contains(mock.WriteRawCalls[1], []byte{0x1b, 'r', 0}) {
+		t.Errorf("expected color none to select color 1 again, got %v", mock.WriteRawCalls[1])
+	}
+}
+
+func TestFeed_Bytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		feed     FeedDecoded
+		expected []byte
+	}{
+		{name: "line feed", feed: FeedDecoded{Mode: FeedLineFeed}, expected: []byte{0x0a}},
+		{name: "lines", feed: FeedDecoded{Mode: FeedLines, Amount: 4}, expected: []byte{0x1b, 0x64, 4}},
+		{name: "units", feed: FeedDecoded{Mode: FeedUnits, Amount: 90}, expected: []byte{0x1b, 0x4a, 90}},
+		{name: "next tof", feed: FeedDecoded{Mode: FeedPosition, Pos: "next-tof"}, expected: []byte{0x1c, 0x28, 0x4c, 0x02, 0x00, 0x44, 0x31}},
+		{
+			name:     "line spacing then lines",
+			feed:     FeedDecoded{Mode: FeedLines, Amount: 2, LineSpacing: 30, SetLineSpacing: true},
+			expected: []byte{0x1b, 0x33, 30, 0x1b, 0x64, 2},
+		},
+		{name: "line spacing only", feed: FeedDecoded{Mode: FeedNone, LineSpacing: 30, SetLineSpacing: true}, expected: []byte{0x1b, 0x33, 30}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			printer, path := createMockPrinter()
+			defer os.Remove(path)
+
+			if err := printer.Feed(&tt.feed); err != nil {
+				t.Fatalf("Feed failed: %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+
+			if !bytes.Equal(data, tt.expected) {
+				t.Errorf("Feed sent wrong bytes. Got %v, expected %v", data, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPrintBarcode_Bytes(t *testing.T) {
+	printer, path := createMockPrinter()
+	defer os.Remove(path)
+
+	barcode := &BarcodeDecoded{
+		Type:   "code39",
+		Data:   []byte("AB1"),
+		HRI:    "below",
+		Font:   "font_b",
+		Width:  2,
+		Height: 80,
+	}
+
+	err := printer.PrintBarcode(barcode)
+	if err != nil {
+		t.Fatalf("PrintBarcode failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	expected := []byte{
+		0x1d, 'h', 80,
+		0x1d, 'w', 2,
+		0x1d, 'H', 2,
+		0x1d, 'f', 1,
+		0x1d, 'k', 69, 3, 'A', 'B', '1',
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("PrintBarcode sent wrong bytes. Got %v, expected %v", data, expected)
+	}
+}
+
+func TestPrintSymbol_QRCodeBytes(t *testing.T) {
+	printer, path := createMockPrinter()
+	defer os.Remove(path)
+
+	symbol := &SymbolDecoded{
+		Type:  "qrcode_model_2",
+		Level: "level_h",
+		Width: 4,
+		Data:  []byte("AB"),
+	}
+
+	err := printer.PrintSymbol(symbol)
+	if err != nil {
+		t.Fatalf("PrintSymbol failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	expected := []byte{
+		0x1d, 0x28, 0x6b, 0x04, 0x00, 0x31, 0x41, 50, 0,
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x31, 0x43, 4,
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x31, 0x45, 51,
+		0x1d, 0x28, 0x6b, 0x05, 0x00, 0x31, 0x50, 0x30, 'A', 'B',
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x31, 0x51, 0x30,
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("PrintSymbol sent wrong bytes. Got %v, expected %v", data, expected)
+	}
+}
+
+func TestSymbolCommands_PDF417(t *testing.T) {
+	symbol := &SymbolDecoded{
+		Type:   "pdf417_truncated",
+		Level:  "level_5",
+		Width:  2,
+		Height: 4,
+		Size:   6,
+		Data:   []byte("X"),
+	}
+
+	got := symbolCommands(symbol)
+	expected := []byte{
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x30, 0x41, 6,
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x30, 0x42, 0,
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x30, 0x43, 2,
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x30, 0x44, 4,
+		0x1d, 0x28, 0x6b, 0x04, 0x00, 0x30, 0x45, 0x30, 0x35,
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x30, 0x46, 1,
+		0x1d, 0x28, 0x6b, 0x04, 0x00, 0x30, 0x50, 0x30, 'X',
+		0x1d, 0x28, 0x6b, 0x03, 0x00, 0x30, 0x51, 0x30,
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("symbolCommands result incorrect. Got %v, expected %v", got, expected)
+	}
+}
+
+func TestWriteCommand_Bytes(t *testing.T) {
+	printer, path := createMockPrinter()
+	defer os.Remove(path)
+
+	command := []byte{0x1b, 0x61, 0x01}
+	if err := printer.WriteCommand(command); err != nil {
+		t.Fatalf("WriteCommand failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	if !bytes.Equal(data, command) {
+		t.Errorf("WriteCommand sent wrong bytes. Got %v, expected %v", data, command)
+	}
+}
+
+func TestCut_TypeBytes(t *testing.T) {
+	tests := []struct {
+		cutType  CutType
+		expected []byte
+	}{
+		{CutNoFeed, []byte{0x1d, 'V', 1}},
+		{CutFeed, []byte{0x1d, 'V', 66, 0}},
+		{CutReserve, []byte{0x1d, 'V', 104, 0}},
+		{CutFullNoFeed, []byte{0x1d, 'V', 0}},
+		{CutFullFeed, []byte{0x1d, 'V', 65, 0}},
+		{CutFullReserve, []byte{0x1d, 'V', 103, 0}},
+	}
+
+	for _, tt := range tests {
+		printer, path := createMockPrinter()
+		defer os.Remove(path)
+
+		if err := printer.Cut(tt.cutType); err != nil {
+			t.Fatalf("Cut(%d) failed: %v", tt.cutType, err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		if !bytes.Equal(data, tt.expected) {
+			t.Errorf("Cut(%d) sent wrong bytes. Got %v, expected %v", tt.cutType, data, tt.expected)
+		}
+	}
+}
+
+func TestKickDrawer_Attributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		drawer   string
+		time     string
+		pulse    *PulseDecoded
+		expected []byte
+	}{
+		{name: "request overrides", pulse: &PulseDecoded{Drawer: "drawer_2", Time: "pulse_300"}, expected: []byte{0x1B, 0x70, 1, 150, 150}},
+		{name: "printer default drawer", drawer: "drawer_2", pulse: &PulseDecoded{}, expected: []byte{0x1B, 0x70, 1, 25, 25}},
+		{name: "printer default time", time: "pulse_100", pulse: &PulseDecoded{Drawer: "drawer_1"}, expected: []byte{0x1B, 0x70, 0, 50, 50}},
+		{name: "request beats default", drawer: "drawer_2", time: "pulse_500", pulse: &PulseDecoded{Drawer: "drawer_1"}, expected: []byte{0x1B, 0x70, 0, 250, 250}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			printer, path := createMockPrinter()
+			defer os.Remove(path)
+
+			if err := printer.SetDefaultPulse(tt.drawer, tt.time); err != nil {
+				t.Fatalf("SetDefaultPulse failed: %v", err)
+			}
+			if err := printer.KickDrawer(tt.pulse); err != nil {
+				t.Fatalf("KickDrawer failed: %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+
+			if !bytes.Equal(data, tt.expected) {
+				t.Errorf("KickDrawer sent wrong bytes. Got %v, expected %v", data, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetDefaultPulse_Invalid(t *testing.T) {
+	printer := &Printer{connection_string: "/test", connection: &MockWritable{}}
+
+	if err := printer.SetDefaultPulse("drawer_3", ""); err == nil {
+		t.Error("expected error for unknown drawer")
+	}
+	if err := printer.SetDefaultPulse("", "pulse_50"); err == nil {
+		t.Error("expected error for unknown pulse time")
+	}
+}
+
+func TestReadFull_AssemblesChunks(t *testing.T) {
+	conn := &FakeConnection{MaxRead: 1}
+	conn.Feed([]byte{1, 2, 3, 4})
+
+	buf := make([]byte, 4)
+	n, err := ReadFull(conn, buf, time.Second)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	if n != 4 || !bytes.Equal(buf, []byte{1, 2, 3, 4}) {
+		t.Errorf("ReadFull result incorrect. Got %d bytes %v", n, buf)
+	}
+}
+
+func TestReadFull_Timeout(t *testing.T) {
+	conn := &FakeConnection{}
+	conn.Feed([]byte{1})
+
+	buf := make([]byte, 2)
+	n, err := ReadFull(conn, buf, time.Second)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 byte read before timeout, got %d", n)
+	}
+}
+
+func TestQueryStatus_FakeConnection(t *testing.T) {
+	conn := &FakeConnection{Respond: statusResponder([4]byte{0x1a, 0x32, 0x12, 0x72})}
+	printer := createFakePrinter(conn)
+
+	status, err := printer.QueryStatus()
+	if err != nil {
+		t.Fatalf("QueryStatus failed: %v", err)
+	}
+	if !status.ReceiptEnd || !status.Offline {
+		t.Errorf("expected paper end while offline, got %+v", status)
+	}
+
+	expectedQueries := []byte{0x10, 0x04, 1, 0x10, 0x04, 2, 0x10, 0x04, 3, 0x10, 0x04, 4}
+	if !bytes.Equal(conn.Written, expectedQueries) {
+		t.Errorf("QueryStatus sent wrong bytes. Got %v, expected %v", conn.Written, expectedQueries)
+	}
+
+	resp := printer.JobResponse(nil)
+	if resp.Success || resp.Code != EPTR_REC_EMPTY {
+		t.Errorf("expected failed response with EPTR_REC_EMPTY, got %+v", resp)
+	}
+	if resp.Status&ASB_RECEIPT_END == 0 || resp.Status&ASB_PRINT_SUCCESS != 0 {
+		t.Errorf("expected receipt end without print success, got 0x%08x", resp.Status)
+	}
+}
+
+func TestQueryStatus_Healthy(t *testing.T) {
+	conn := &FakeConnection{Respond: statusResponder([4]byte{0x12, 0x12, 0x12, 0x12})}
+	printer := createFakePrinter(conn)
+
+	resp := printer.JobResponse(nil)
+	if !resp.Success || resp.Code != "" || resp.Status != ASB_PRINT_SUCCESS {
+		t.Errorf("expected clean success, got %+v", resp)
+	}
+}
+
+func TestQueryStatus_NoResponse(t *testing.T) {
+	printer := createFakePrinter(&FakeConnection{})
+
+	_, err := printer.QueryStatus()
+	if !errors.Is(err, ErrStatusTimeout) {
+		t.Fatalf("expected ErrStatusTimeout, got %v", err)
+	}
+
+	// The job was sent, so it is not reported as failed
+	resp := printer.JobResponse(nil)
+	if !resp.Success || resp.Code != ASB_NO_RESPONSE_CODE || resp.Status != ASB_PRINT_SUCCESS|ASB_NO_RESPONSE {
+		t.Errorf("expected success with an unknown status, got %+v", resp)
+	}
+}
+
+func TestQueryStatus_UnexpectedResponse(t *testing.T) {
+	conn := &FakeConnection{Respond: func([]byte) []byte { return []byte{0xff} }}
+	printer := createFakePrinter(conn)
+
+	if _, err := printer.QueryStatus(); err == nil {
+		t.Fatal("expected error for malformed status byte, got nil")
+	}
+}
+
+func TestUsbWriter_ReadRawRegularFile(t *testing.T) {
+	printer, path := createMockPrinter()
+	defer os.Remove(path)
+
+	reader, ok := printer.connection.(Readable)
+	if !ok {
+		t.Fatal("expected UsbWriter to implement Readable")
+	}
+
+	_, err := reader.ReadRaw(make([]byte, 1), 10*time.Millisecond)
+	if !errors.Is(err, ErrReadUnsupported) {
+		t.Errorf("expected ErrReadUnsupported for a regular file, got %v", err)
+	}
+}
+
+func TestTcpWriter_ReadRaw(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writer := &TcpWriter{address: "pipe", conn: client}
+
+	go server.Write([]byte{0x12})
+
+	buf := make([]byte, 1)
+	n, err := writer.ReadRaw(buf, time.Second)
+	if err != nil {
+		t.Fatalf("ReadRaw failed: %v", err)
+	}
+	if n != 1 || buf[0] != 0x12 {
+		t.Errorf("ReadRaw result incorrect. Got %d bytes %v", n, buf)
+	}
+
+	_, err = writer.ReadRaw(buf, 10*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline error with no data, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// PrinterProfile describes what a printer model can handle. Commands are
+// shaped to fit the profile, so a model with tighter limits is not sent
+// more than it can take.
+type PrinterProfile struct {
+	Name string
+	// MaxBandHeight is the most raster lines sent in one command; taller
+	// images are split into bands
+	MaxBandHeight int
+	// Raster selects the command images are sent with: RASTER_GS_V_0 or
+	// RASTER_GRAPHICS
+	Raster string
+	// Colors is how many inks the printer has; images in other colors
+	// print in color 1. Colors are only selectable with RASTER_GRAPHICS.
+	Colors int
+	// Gray selects how gray16 images are printed: GRAY_DITHER, or
+	// GRAY_MULTI_TONE on models that print shades with RASTER_GRAPHICS
+	Gray string
+	// Encoding selects how text is sent: TEXT_ENCODING_CODE_PAGE, or
+	// TEXT_ENCODING_UTF8 on models that accept UTF-8
+	Encoding string
+}
+
+// Raster image commands. GS v 0 is obsolete but understood by every model;
+// GS ( L stores the image in the print buffer and then prints it.
+const (
+	RASTER_GS_V_0   = "gs_v_0"
+	RASTER_GRAPHICS = "graphics"
+	DEFAULT_RASTER  = RASTER_GS_V_0
+)
+
+// How gray16 images are printed. Dithering reduces them to black and white
+// dots on any printer; multi-tone sends the shades as they are, for models
+// with multiple tone graphics.
+const (
+	GRAY_DITHER     = "dither"
+	GRAY_MULTI_TONE = "multi_tone"
+	DEFAULT_GRAY    = GRAY_DITHER
+)
+
+// DEFAULT_PROFILE is used when a printer's model is not configured. Its
+// band height is small enough for models with little receive buffer.
+const DEFAULT_PROFILE = "generic"
+
+// MAX_BAND_HEIGHT is the most lines a raster header can describe
+const MAX_BAND_HEIGHT = 0xFFFF
+
+// PRINTER_PROFILES are the known models, by lowercase name. The TM models
+// take GS ( L graphics; their bands are kept as short as the generic
+// profile's until taller ones are measured to fit each model's receive
+// buffer. The TM-T88VII and TM-m30II also take UTF-8 text.
+var PRINTER_PROFILES = map[string]PrinterProfile{
+	"generic":   {Name: "generic", MaxBandHeight: 256, Raster: RASTER_GS_V_0, Colors: 1},
+	"tm-t20ii":  {Name: "tm-t20ii", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1},
+	"tm-t20iii": {Name: "tm-t20iii", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1},
+	"tm-t88v":   {Name: "tm-t88v", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1},
+	"tm-t88vi":  {Name: "tm-t88vi", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1},
+	"tm-t88vii": {Name: "tm-t88vii", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1, Encoding: TEXT_ENCODING_UTF8},
+	"tm-m30":    {Name: "tm-m30", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1},
+	"tm-m30ii":  {Name: "tm-m30ii", MaxBandHeight: 256, Raster: RASTER_GRAPHICS, Colors: 1, Encoding: TEXT_ENCODING_UTF8},
+}
+
+// LookupProfile returns the profile for a model name; an empty name selects
+// DEFAULT_PROFILE
+func LookupProfile(name string) (PrinterProfile, error) {
+	if name == "" {
+		name = DEFAULT_PROFILE
+	}
+	profile, ok := PRINTER_PROFILES[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(PRINTER_PROFILES))
+		for known := range PRINTER_PROFILES {
+			names = append(names, known)
+		}
+		slices.Sort(names)
+		return PrinterProfile{}, fmt.Errorf("unknown printer profile %q (must be one of %s)", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// SetProfile sets the model profile commands are shaped for
+func (p *Printer) SetProfile(profile PrinterProfile) {
+	p.profile = profile
+	log.Printf("[PRINTER] Profile for %s: %s (max band height %d, raster %s, %d color(s), gray %s, encoding %s)",
+		p.connection_string, profile.Name, profile.MaxBandHeight, profile.Raster, profile.Colors, p.gray(), p.encoding())
+}
+
+// bandHeight is the most raster lines to send in one command. Printers
+// without a profile use DEFAULT_PROFILE's.
+func (p *Printer) bandHeight() int {
+	if p.profile.MaxBandHeight > 0 {
+		return p.profile.MaxBandHeight
+	}
+	return PRINTER_PROFILES[DEFAULT_PROFILE].MaxBandHeight
+}
+
+// raster is the command images are sent with. Printers without a profile
+// use DEFAULT_RASTER.
+func (p *Printer) raster() string {
+	if p.profile.Raster != "" {
+		return p.profile.Raster
+	}
+	return DEFAULT_RASTER
+}
+
+// parseRaster checks a raster command name; an empty name is allowed and
+// keeps the profile's command
+func parseRaster(raster string) error {
+	switch raster {
+	case "", RASTER_GS_V_0, RASTER_GRAPHICS:
+		return nil
+	}
+	return fmt.Errorf("unknown raster command %q (must be %s or %s)", raster, RASTER_GS_V_0, RASTER_GRAPHICS)
+}
+
+// gray is how gray16 images are printed. Printers without a profile use
+// DEFAULT_GRAY.
+func (p *Printer) gray() string {
+	if p.profile.Gray != "" {
+		return p.profile.Gray
+	}
+	return DEFAULT_GRAY
+}
+
+// parseGray checks how gray16 images are printed; an empty name is allowed
+// and keeps the profile's setting
+func parseGray(gray string) error {
+	switch gray {
+	case "", GRAY_DITHER, GRAY_MULTI_TONE:
+		return nil
+	}
+	return fmt.Errorf("unknown gray %q (must be %s or %s)", gray, GRAY_DITHER, GRAY_MULTI_TONE)
+}
+
+// encoding is how text is sent. Printers without a profile use
+// DEFAULT_TEXT_ENCODING.
+func (p *Printer) encoding() string {
+	if p.profile.Encoding != "" {
+		return p.profile.Encoding
+	}
+	return DEFAULT_TEXT_ENCODING
+}
+
+// parseEncoding checks a text encoding name; an empty name is allowed and
+// keeps the profile's encoding
+func parseEncoding(encoding string) error {
+	switch encoding {
+	case "", TEXT_ENCODING_CODE_PAGE, TEXT_ENCODING_UTF8:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q (must be %s or %s)", encoding, TEXT_ENCODING_CODE_PAGE, TEXT_ENCODING_UTF8)
+}
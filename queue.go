@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_QUEUE_DEPTH is how many jobs may wait for a printer before new
+// ones are turned away
+const DEFAULT_QUEUE_DEPTH = 16
+
+// ErrQueueFull is returned by Submit when the printer already has as many
+// jobs waiting as its queue allows.
+var ErrQueueFull = errors.New("print queue is full")
+
+// errPrinterRetired is returned by Submit once a reload has replaced the
+// printer; the job should be submitted to its replacement instead.
+var errPrinterRetired = errors.New("printer has been retired")
+
+// DEFAULT_SPOOL_MAX_AGE is how long a job may wait for an offline printer
+// before it is failed instead of printed
+const DEFAULT_SPOOL_MAX_AGE = 15 * time.Minute
+
+// MAX_RECONNECT_DELAY caps the wait between attempts to reach an offline
+// printer
+const MAX_RECONNECT_DELAY = 30 * time.Second
+
+// printJob is one parsed ePOS-Print request waiting for its printer
+type printJob struct {
+	ctx       context.Context
+	epos      *EposPrint
+	requestID int
+	// accepted is when the proxy took the job, which spooled jobs age from
+	accepted time.Time
+	done     chan jobResult
+	// onStart, when set, is called as the job starts printing, and
+	// onRequeue when it goes back on the queue without having sent anything
+	onStart   func()
+	onRequeue func()
+	// started is set once the job may have sent anything to the printer
+	started atomic.Bool
+}
+
+type jobResult struct {
+	response EposResponse
+	err      error
+}
+
+func newPrintJob(ctx context.Context, epos *EposPrint, requestID int) *printJob {
+	return &printJob{ctx: ctx, epos: epos, requestID: requestID, accepted: time.Now(), done: make(chan jobResult, 1)}
+}
+
+// jobQueue holds a printer's pending jobs. A single worker runs them one at
+// a time, so the commands of two receipts are never interleaved. The worker
+// only runs while there is work, which lets a retired printer close once
+// its queue has drained.
+//
+// While the printer is offline the queue is a spool: jobs wait, in order,
+// until the worker reconnects or they are older than maxAge.
+type jobQueue struct {
+	pending []*printJob
+	depth   int
+	maxAge  time.Duration
+	running bool
+	retired bool
+	offline bool
+}
+
+// SetQueueDepth sets how many jobs may wait for the printer; zero selects
+// DEFAULT_QUEUE_DEPTH
+func (p *Printer) SetQueueDepth(depth int) {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	p.queue.depth = depth
+}
+
+// SetSpoolMaxAge sets how long a job may wait before it is failed instead
+// of printed; zero lets jobs wait for as long as the printer is offline
+func (p *Printer) SetSpoolMaxAge(maxAge time.Duration) {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	p.queue.maxAge = maxAge
+}
+
+// Submit queues a job for the printer. The result is delivered on the
+// job's done channel once the job has run.
+func (p *Printer) Submit(job *printJob) error {
+	return p.submit(job, true)
+}
+
+// SubmitRecovered queues a job recovered from the journal. It ignores the
+// queue depth so that no recovered job is turned away.
+func (p *Printer) SubmitRecovered(job *printJob) error {
+	return p.submit(job, false)
+}
+
+func (p *Printer) submit(job *printJob, bounded bool) error {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+
+	if p.queue.retired {
+		return errPrinterRetired
+	}
+	depth := p.queue.depth
+	if depth <= 0 {
+		depth = DEFAULT_QUEUE_DEPTH
+	}
+	if bounded && len(p.queue.pending) >= depth {
+		log.Printf("[QUEUE] Request #%d: Queue for %s is full (%d jobs waiting)", job.requestID, p.connection_string, depth)
+		return ErrQueueFull
+	}
+
+	p.queue.pending = append(p.queue.pending, job)
+	log.Printf("[QUEUE] Request #%d: Queued for %s (%d waiting)", job.requestID, p.connection_string, len(p.queue.pending))
+	if !p.queue.running {
+		p.queue.running = true
+		go p.work()
+	}
+	return nil
+}
+
+// work runs queued jobs until the queue is empty. While the printer is
+// offline it keeps trying to reconnect, backing off up to
+// MAX_RECONNECT_DELAY, and fails the jobs that have waited too long.
+func (p *Printer) work() {
+	delay := time.Duration(0)
+	for {
+		p.queueMu.Lock()
+		if len(p.queue.pending) == 0 {
+			p.queue.running = false
+			retired := p.queue.retired
+			p.queueMu.Unlock()
+			if retired {
+				p.closeRetired()
+			}
+			return
+		}
+		job := p.queue.pending[0]
+		err := p.spoolError(job)
+		offline := p.queue.offline
+		if err == nil && offline {
+			p.queueMu.Unlock()
+			if p.reconnect() {
+				delay = 0
+				continue
+			}
+			_, retryDelay := p.retryPolicy()
+			delay = min(max(2*delay, retryDelay, time.Millisecond), MAX_RECONNECT_DELAY)
+			time.Sleep(delay)
+			continue
+		}
+		p.queue.pending[0] = nil
+		p.queue.pending = p.queue.pending[1:]
+		p.queueMu.Unlock()
+
+		if err != nil {
+			log.Printf("[QUEUE] Request #%d: Dropping spooled job: %v", job.requestID, err)
+			job.done <- jobResult{err: err}
+			continue
+		}
+
+		result, sent := p.runQueued(job)
+		// withRetry has already given up on the connection; if it cannot
+		// be reopened either, spool the jobs behind this one, and this job
+		// too when nothing of it reached the printer. A printer that can
+		// be reopened but still fails the job fails it for good.
+		if result.err != nil && job.started.Load() && !errors.Is(result.err, context.DeadlineExceeded) {
+			if !p.reconnect() && !sent {
+				p.requeue(job)
+				continue
+			}
+		}
+		job.done <- result
+	}
+}
+
+// spoolError reports why a job at the head of the queue should be failed
+// without printing, if it should
+func (p *Printer) spoolError(job *printJob) error {
+	if p.queue.maxAge > 0 && time.Since(job.accepted) > p.queue.maxAge {
+		return fmt.Errorf("job waited longer than the spool max age of %v: %w", p.queue.maxAge, context.DeadlineExceeded)
+	}
+	if !p.queue.offline {
+		return nil
+	}
+	if err := job.ctx.Err(); err != nil {
+		return err
+	}
+	if p.queue.retired {
+		return fmt.Errorf("printer was removed while offline")
+	}
+	return nil
+}
+
+// reconnect opens the printer's connection and records whether the printer
+// is online
+func (p *Printer) reconnect() bool {
+	p.jobs.Lock()
+	err := p.connection.Open()
+	if err == nil {
+		p.afterOpen()
+	}
+	p.jobs.Unlock()
+
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	wasOffline := p.queue.offline
+	p.queue.offline = err != nil
+	switch {
+	case err != nil && !wasOffline:
+		log.Printf("[QUEUE] Printer %s is offline, spooling jobs: %v", p.connection_string, err)
+	case err == nil && wasOffline:
+		log.Printf("[QUEUE] Printer %s is back online, delivering %d spooled job(s)", p.connection_string, len(p.queue.pending))
+	}
+	return err == nil
+}
+
+// runQueued runs one job and reads back the printer status for its
+// response while no other job can touch the printer. It also reports
+// whether any of the job's writes succeeded.
+func (p *Printer) runQueued(job *printJob) (jobResult, bool) {
+	p.jobs.Lock()
+	defer p.jobs.Unlock()
+
+	// The client may have given up while the job was waiting
+	if err := job.ctx.Err(); err != nil {
+		log.Printf("[QUEUE] Request #%d: Job deadline reached while queued, skipping", job.requestID)
+		return jobResult{err: err}, false
+	}
+	job.started.Store(true)
+	if job.onStart != nil {
+		job.onStart()
+	}
+
+	// A job that failed or ran out of time partway leaves its modes set,
+	// such as emphasis or alignment, so every job starts from a reset
+	// printer. The reset alone does not count as the job sending anything.
+	if err := p.Reset(); err != nil {
+		err = fmt.Errorf("failed to reset printer: %w", err)
+		return jobResult{response: p.JobResponse(err), err: err}, false
+	}
+
+	writes := p.writes.Load()
+	err := runJob(job.ctx, p, job.epos, job.requestID)
+	sent := p.writes.Load() != writes
+	if errors.Is(err, context.DeadlineExceeded) {
+		return jobResult{err: err}, sent
+	}
+	return jobResult{response: p.JobResponse(err), err: err}, sent
+}
+
+// requeue puts a job that failed before any of its writes succeeded back
+// at the head of the queue, so that it is spooled for the offline printer
+// instead of failed
+func (p *Printer) requeue(job *printJob) {
+	job.started.Store(false)
+	if job.onRequeue != nil {
+		job.onRequeue()
+	}
+
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	p.queue.pending = append([]*printJob{job}, p.queue.pending...)
+	log.Printf("[QUEUE] Request #%d: Nothing was sent, spooling job again (%d waiting)", job.requestID, len(p.queue.pending))
+}
+
+// Retire stops the printer accepting jobs and closes it once the jobs
+// already queued have run.
+func (p *Printer) Retire() {
+	p.queueMu.Lock()
+	p.queue.retired = true
+	running := p.queue.running
+	p.queueMu.Unlock()
+
+	log.Printf("[PRINTER] Retiring printer: %s", p.connection_string)
+	if !running {
+		p.closeRetired()
+	}
+}
+
+func (p *Printer) closeRetired() {
+	p.jobs.Lock()
+	defer p.jobs.Unlock()
+	if err := p.Close(); err != nil {
+		log.Printf("[PRINTER] WARNING: Failed to close retired printer: %v", err)
+	}
+}
+
+func (p *Printer) isRetired() bool {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	return p.queue.retired
+}
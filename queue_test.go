@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedWritable records writes from the job worker. Each write pauses
+// briefly so that jobs running side by side would interleave, and waits
+// for gate when one is set.
+type gatedWritable struct {
+	mu      sync.Mutex
+	writes  [][]byte
+	gate    chan struct{}
+	started chan struct{}
+}
+
+func (g *gatedWritable) WriteRaw(data []byte) error {
+	if g.started != nil {
+		select {
+		case g.started <- struct{}{}:
+		default:
+		}
+	}
+	if g.gate != nil {
+		<-g.gate
+	}
+	time.Sleep(100 * time.Microsecond)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writes = append(g.writes, data)
+	return nil
+}
+
+func (g *gatedWritable) Open() error  { return nil }
+func (g *gatedWritable) Close() error { return nil }
+
+func createQueueTestServer(conn Writable, depth int) *Server {
+	printer := &Printer{connection_string: "/test", receipt_width: 576, connection: conn}
+	printer.SetQueueDepth(depth)
+	printers := NewPrinterRegistry(DEFAULT_DEVID)
+	printers.Add(DEFAULT_DEVID, printer)
+	return NewServer(printers, nil, nil, DefaultConfig().Limits)
+}
+
+func TestServer_SerializesConcurrentJobs(t *testing.T) {
+	conn := &gatedWritable{}
+	s := createQueueTestServer(conn, 16)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			job := fmt.Sprintf(`<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">`+
+				`<text>job-%d</text><feed line="2"/><cut/></epos-print>`, i)
+			if rec := postJob(s, EPOS_SERVICE_PATH, job); rec.Code != http.StatusOK {
+				t.Errorf("job %d: expected 200, got %d: %s", i, rec.Code, rec.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every receipt's text must be followed by its own cut before the next
+	// receipt starts.
+	texts, cuts := 0, 0
+	for _, w := range conn.writes {
+		switch {
+		case bytes.Contains(w, []byte("job-")):
+			if texts != cuts {
+				t.Fatalf("receipt started before the previous one was cut: %q", w)
+			}
+			texts++
+		case bytes.HasPrefix(w, []byte{0x1d, 'V'}):
+			cuts++
+		}
+	}
+	if texts != 8 || cuts != 8 {
+		t.Errorf("expected 8 receipts and 8 cuts, got %d and %d", texts, cuts)
+	}
+}
+
+func TestServer_QueueFull(t *testing.T) {
+	conn := &gatedWritable{gate: make(chan struct{}), started: make(chan struct{}, 1)}
+	s := createQueueTestServer(conn, 1)
+	printer, _ := s.current().printers.Get("")
+
+	codes := make(chan int, 2)
+	post := func() { codes <- postJob(s, EPOS_SERVICE_PATH, testJob).Code }
+
+	// The first job holds the worker, the second fills the queue
+	go post()
+	<-conn.started
+	go post()
+	for {
+		printer.queueMu.Lock()
+		waiting := len(printer.queue.pending)
+		printer.queueMu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := postJob(s, EPOS_SERVICE_PATH, testJob)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with a full queue, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected Retry-After header")
+	}
+	if !strings.Contains(rec.Body.String(), "queue is full") {
+		t.Errorf("unexpected body: %s", rec.Body.String())
+	}
+
+	close(conn.gate)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected queued jobs to complete, got %d", code)
+		}
+	}
+}
+
+// switchableWritable is a printer connection that can be unplugged and
+// plugged back in while jobs run
+type switchableWritable struct {
+	mu      sync.Mutex
+	offline bool
+	writes  [][]byte
+}
+
+func (c *switchableWritable) setOffline(offline bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offline = offline
+}
+
+func (c *switchableWritable) received(text string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.writes {
+		if bytes.Contains(w, []byte(text)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *switchableWritable) WriteRaw(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.offline {
+		return fmt.Errorf("printer unplugged")
+	}
+	c.writes = append(c.writes, data)
+	return nil
+}
+
+func (c *switchableWritable) Open() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.offline {
+		return fmt.Errorf("printer unplugged")
+	}
+	return nil
+}
+
+func (c *switchableWritable) Close() error { return nil }
+
+func TestPrinter_ResetsBeforeEachJob(t *testing.T) {
+	conn := &gatedWritable{}
+	printer := &Printer{connection_string: "/test", receipt_width: 576, connection: conn}
+
+	// The first job sets emphasis, then fails on an image too short for
+	// its size, leaving emphasis on
+	failing := &EposPrint{Instructions: []Instruction{
+		{Type: InstText, Text: &TextDecoded{Content: "bold", Style: TextStyle{Emphasis: true}}},
+		{Type: InstImage, Image: &ImageDecoded{Width: 8, Height: 8, Data: []byte{0xff}}},
+	}}
+	plain := &EposPrint{Instructions: []Instruction{{Type: InstText, Text: &TextDecoded{Content: "plain"}}}}
+	for i, epos := range []*EposPrint{failing, plain} {
+		job := newPrintJob(context.Background(), epos, i+1)
+		if err := printer.Submit(job); err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+		<-job.done
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var resets []int
+	for i, w := range conn.writes {
+		if bytes.Equal(w, RESET_CMD) {
+			resets = append(resets, i)
+		}
+	}
+	if len(resets) != 2 || resets[0] != 0 || !bytes.Contains(conn.writes[resets[1]+1], []byte("plain")) {
+		t.Errorf("expected a reset before each job, got writes %q", conn.writes)
+	}
+}
+
+func TestNewPrinter_StartsOffline(t *testing.T) {
+	printer, err := NewPrinter(filepath.Join(t.TempDir(), "missing"), 576, UsbPath)
+	if err != nil {
+		t.Fatalf("expected an unreachable printer not to block startup, got %v", err)
+	}
+	if !printer.queue.offline {
+		t.Errorf("expected printer to start offline")
+	}
+}
+
+func TestServer_SpoolsWhileOffline(t *testing.T) {
+	conn := &switchableWritable{}
+	s := createQueueTestServer(conn, 16)
+	printer, _ := s.current().printers.Get("")
+	printer.SetRetryPolicy(RetryPolicy{Attempts: 1, Delay: Duration(time.Millisecond)})
+
+	// The job that finds the printer gone sent nothing, so it waits with
+	// the ones after it
+	conn.setOffline(true)
+	first := submitAsync(t, s, strings.Replace(testJob, "Hi", "first", 1))
+	spooled := submitAsync(t, s, strings.Replace(testJob, "Hi", "spooled", 1))
+	time.Sleep(20 * time.Millisecond)
+	for _, id := range []string{first.ID, spooled.ID} {
+		if _, record := getJob(t, s, id); record.State != JOB_QUEUED {
+			t.Errorf("expected job to wait for the printer, got %+v", record)
+		}
+	}
+
+	conn.setOffline(false)
+	for _, id := range []string{first.ID, spooled.ID} {
+		if record := waitForJob(t, s, id); record.State != JOB_DONE {
+			t.Errorf("expected spooled job to print once the printer is back, got %+v", record)
+		}
+	}
+	if !conn.received("first") || !conn.received("spooled") {
+		t.Errorf("expected spooled jobs to reach the printer")
+	}
+}
+
+func TestServer_SpoolMaxAge(t *testing.T) {
+	conn := &switchableWritable{offline: true}
+	s := createQueueTestServer(conn, 16)
+	printer, _ := s.current().printers.Get("")
+	printer.retryDelay = time.Millisecond
+	printer.queue.offline = true
+	printer.SetSpoolMaxAge(10 * time.Millisecond)
+
+	rec := postJob(s, EPOS_SERVICE_PATH, testJob)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `code="EX_TIMEOUT"`) {
+		t.Errorf("expected EX_TIMEOUT for an expired job, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	conn.setOffline(false)
+	time.Sleep(20 * time.Millisecond)
+	if conn.received("Hi") {
+		t.Errorf("expected expired job never to print")
+	}
+}
+
+func TestPrinter_RetryPolicyChangedWhileOffline(t *testing.T) {
+	conn := &switchableWritable{offline: true}
+	s := createQueueTestServer(conn, 16)
+	printer, _ := s.current().printers.Get("")
+	printer.SetRetryPolicy(RetryPolicy{Delay: Duration(time.Millisecond)})
+	printer.queue.offline = true
+
+	// A reload changes the retry policy while the worker waits to reconnect
+	spooled := submitAsync(t, s, testJob)
+	for range 20 {
+		printer.jobs.Lock()
+		printer.SetRetryPolicy(RetryPolicy{Attempts: 2, Delay: Duration(time.Millisecond)})
+		printer.jobs.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.setOffline(false)
+	if record := waitForJob(t, s, spooled.ID); record.State != JOB_DONE {
+		t.Errorf("expected spooled job to print once the printer is back, got %+v", record)
+	}
+	if attempts, delay := printer.retryPolicy(); attempts != 2 || delay != time.Millisecond {
+		t.Errorf("expected the new retry policy, got attempts=%d delay=%v", attempts, delay)
+	}
+}
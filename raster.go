@@ -12,6 +12,31 @@ func rasterWidthBytes(width int) (int, error) {
 	return (width + 7) / 8, nil
 }
 
+// imageDataSize is rasterDataSize for an <image> of the given mode
+func imageDataSize(mode string, width int, height int) (int, int, error) {
+	if mode == IMAGE_GRAY16 {
+		return grayDataSize(width, height)
+	}
+	return rasterDataSize(width, height)
+}
+
+// grayDataSize returns the bytes per row and in total of 4 bits per pixel
+// image data
+func grayDataSize(width int, height int) (int, int, error) {
+	if width < 0 || height < 0 {
+		return 0, 0, fmt.Errorf("width and height must be >= 0: %dx%d", width, height)
+	}
+	rowBytes := (width + 1) / 2
+	if rowBytes == 0 || height == 0 {
+		return rowBytes, 0, nil
+	}
+	maxInt := int(^uint(0) >> 1)
+	if rowBytes > maxInt/height {
+		return 0, 0, fmt.Errorf("image dimensions too large: width=%d height=%d", width, height)
+	}
+	return rowBytes, rowBytes * height, nil
+}
+
 func rasterDataSize(width int, height int) (int, int, error) {
 	if height < 0 {
 		return 0, 0, fmt.Errorf("height must be >= 0: %d", height)
@@ -32,3 +57,175 @@ func rasterDataSize(width int, height int) (int, int, error) {
 
 	return widthBytes, widthBytes * height, nil
 }
+
+// rasterBands builds GS v 0 commands for raster data, one per band of at
+// most bandHeight lines. Printers cap how tall a single raster image may be,
+// and consecutive bands print without a gap.
+func rasterBands(data []byte, widthBytes int, height int, bandHeight int) []byte {
+	buf := make([]byte, 0, len(data)+8*((height+bandHeight-1)/bandHeight))
+	for top := 0; top < height; top += bandHeight {
+		lines := min(bandHeight, height-top)
+		buf = append(buf, PRINT_RASTER_CMD...)
+		buf = append(buf, byte(widthBytes), byte(widthBytes>>8), byte(lines), byte(lines>>8))
+		buf = append(buf, data[top*widthBytes:(top+lines)*widthBytes]...)
+	}
+	return buf
+}
+
+// graphicsBands builds GS ( L commands that store each band of raster data
+// in the print buffer and print it
+func graphicsBands(data []byte, widthBytes int, height int, bandHeight int, color byte) []byte {
+	buf := make([]byte, 0, len(data)+27*((height+bandHeight-1)/bandHeight))
+	for top := 0; top < height; top += bandHeight {
+		lines := min(bandHeight, height-top)
+		band := data[top*widthBytes : (top+lines)*widthBytes]
+		buf = storeGraphics(buf, band, widthBytes*8, lines, GRAPHICS_TONE_MONO, color)
+		buf = append(buf, PRINT_GRAPHICS_CMD...)
+	}
+	return buf
+}
+
+// multiToneBands builds GS ( L commands that store each band of a
+// multi-tone image, one plane per bit of its shades, and print it
+func multiToneBands(planes [][]byte, widthBytes int, height int, bandHeight int) []byte {
+	buf := make([]byte, 0, len(planes)*(widthBytes*height+27*((height+bandHeight-1)/bandHeight)))
+	for top := 0; top < height; top += bandHeight {
+		lines := min(bandHeight, height-top)
+		for i, plane := range planes {
+			band := plane[top*widthBytes : (top+lines)*widthBytes]
+			buf = storeGraphics(buf, band, widthBytes*8, lines, GRAPHICS_TONE_MULTI, GRAPHICS_COLOR_CODES["color_1"]+byte(i))
+		}
+		buf = append(buf, PRINT_GRAPHICS_CMD...)
+	}
+	return buf
+}
+
+// grayPlanes splits 4 bit per pixel gray16 data into 4 planes of 1 bit
+// raster data, the most significant bit first
+func grayPlanes(data []byte, width int, height int) [][]byte {
+	rowBytes := (width + 1) / 2
+	widthBytes := (width + 7) / 8
+	planes := make([][]byte, 4)
+	for i := range planes {
+		planes[i] = make([]byte, widthBytes*height)
+	}
+	for y := range height {
+		for x := range width {
+			b := data[y*rowBytes+x/2]
+			if x%2 == 0 {
+				b >>= 4
+			}
+			for i, plane := range planes {
+				if b&(0x08>>i) != 0 {
+					setRasterPixel(plane, widthBytes, x, y)
+				}
+			}
+		}
+	}
+	return planes
+}
+
+// storeGraphics appends a GS ( L function 112 command storing an image in
+// the print buffer. Images too large for GS ( L's 2 byte length use GS 8 L.
+func storeGraphics(buf []byte, data []byte, widthDots int, lines int, tone byte, color byte) []byte {
+	// The length covers the parameters from m on, then the data
+	length := len(STORE_GRAPHICS_PARAMS) + 1 + len(GRAPHICS_SCALE) + 5 + len(data)
+	if length <= 0xFFFF {
+		buf = append(buf, STORE_GRAPHICS_CMD...)
+		buf = append(buf, byte(length), byte(length>>8))
+	} else {
+		buf = append(buf, STORE_GRAPHICS_LARGE_CMD...)
+		buf = append(buf, byte(length), byte(length>>8), byte(length>>16), byte(length>>24))
+	}
+	buf = append(buf, STORE_GRAPHICS_PARAMS...)
+	buf = append(buf, tone)
+	buf = append(buf, GRAPHICS_SCALE...)
+	buf = append(buf, color, byte(widthDots), byte(widthDots>>8), byte(lines), byte(lines>>8))
+	return append(buf, data...)
+}
+
+// What happens to images wider than the paper. Scaling keeps the whole
+// image, cropping keeps its size and drops the sides that don't fit, and
+// none sends it as it is, which most printers clip or wrap.
+const (
+	WIDE_IMAGES_SCALE = "scale"
+	WIDE_IMAGES_CROP  = "crop"
+	WIDE_IMAGES_NONE  = "none"
+)
+
+func parseWideImages(wideImages string) error {
+	switch wideImages {
+	case "", WIDE_IMAGES_SCALE, WIDE_IMAGES_CROP, WIDE_IMAGES_NONE:
+		return nil
+	}
+	return fmt.Errorf("unknown wide_images %q (must be %s, %s or %s)", wideImages, WIDE_IMAGES_SCALE, WIDE_IMAGES_CROP, WIDE_IMAGES_NONE)
+}
+
+// rasterPixel reports whether the pixel at x, y of 1 bit per pixel raster
+// data is black
+func rasterPixel(data []byte, widthBytes int, x int, y int) bool {
+	return data[y*widthBytes+x/8]&(0x80>>(x%8)) != 0
+}
+
+func setRasterPixel(data []byte, widthBytes int, x int, y int) {
+	data[y*widthBytes+x/8] |= 0x80 >> (x % 8)
+}
+
+// cropOffset is the first column kept when cropping an image to width:
+// the left edge, the middle or the right edge, following align
+func cropOffset(imageWidth int, width int, align string) int {
+	switch align {
+	case "left":
+		return 0
+	case "right":
+		return imageWidth - width
+	}
+	return (imageWidth - width) / 2
+}
+
+// cropRaster keeps width columns of an image starting at column left
+func cropRaster(data []byte, imageWidth int, height int, left int, width int) []byte {
+	srcWidthBytes := (imageWidth + 7) / 8
+	dstWidthBytes := (width + 7) / 8
+	cropped := make([]byte, dstWidthBytes*height)
+	for y := range height {
+		for x := range width {
+			if rasterPixel(data, srcWidthBytes, left+x, y) {
+				setRasterPixel(cropped, dstWidthBytes, x, y)
+			}
+		}
+	}
+	return cropped
+}
+
+// scaleRaster shrinks an image to width, keeping its aspect ratio. Each
+// output pixel is black when at least half of the pixels it covers are, so
+// thin lines survive better than with nearest-neighbour sampling.
+func scaleRaster(data []byte, imageWidth int, height int, width int) ([]byte, int) {
+	if height == 0 || imageWidth == 0 {
+		return nil, 0
+	}
+	srcWidthBytes := (imageWidth + 7) / 8
+	dstWidthBytes := (width + 7) / 8
+	scaledHeight := max(1, height*width/imageWidth)
+	scaled := make([]byte, dstWidthBytes*scaledHeight)
+	for y := range scaledHeight {
+		top, bottom := y*height/scaledHeight, max((y+1)*height/scaledHeight, y*height/scaledHeight+1)
+		for x := range width {
+			left, right := x*imageWidth/width, max((x+1)*imageWidth/width, x*imageWidth/width+1)
+			black, total := 0, 0
+			for sy := top; sy < bottom; sy++ {
+				for sx := left; sx < right; sx++ {
+					if rasterPixel(data, srcWidthBytes, sx, sy) {
+						black++
+					}
+					total++
+				}
+			}
+			if 2*black >= total {
+				setRasterPixel(scaled, dstWidthBytes, x, y)
+			}
+		}
+	}
+	return scaled, scaledHeight
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Duration is a time.Duration that reads from JSON as a Go duration string
+// such as "2s" or "500ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RetryPolicy controls how a printer recovers from failed writes
+type RetryPolicy struct {
+	Attempts int      `json:"attempts"`
+	Delay    Duration `json:"delay"`
+}
+
+// PrinterConfig describes one printer served by the proxy
+type PrinterConfig struct {
+	DevID        string      `json:"devid"`
+	Proto        string      `json:"proto"`
+	Connection   string      `json:"connection"`
+	ReceiptWidth int         `json:"receipt_width"`
+	Retry        RetryPolicy `json:"retry"`
+	// Profile names the printer model; BandHeight, Raster, Colors, Gray
+	// and Encoding, when set, override the profile's maximum raster band
+	// height, image command, number of inks, how gray16 images are printed
+	// and how text is sent
+	Profile    string `json:"profile"`
+	BandHeight int    `json:"band_height"`
+	Raster     string `json:"raster"`
+	Colors     int    `json:"colors"`
+	Gray       string `json:"gray"`
+	Encoding   string `json:"encoding"`
+	// WideImages is what happens to images wider than receipt_width:
+	// scale (the default), crop or none
+	WideImages string `json:"wide_images"`
+	// Drawer and PulseTime are the defaults for <pulse> elements without
+	// them; when empty, the global drawer and pulse_time apply
+	Drawer    string `json:"drawer"`
+	PulseTime string `json:"pulse_time"`
+}
+
+// printerProfile returns the profile for the configured model with any
+// overrides applied
+func (c PrinterConfig) printerProfile() (PrinterProfile, error) {
+	profile, err := LookupProfile(c.Profile)
+	if err != nil {
+		return PrinterProfile{}, err
+	}
+	if c.BandHeight > 0 {
+		profile.MaxBandHeight = c.BandHeight
+	}
+	if c.Raster != "" {
+		profile.Raster = c.Raster
+	}
+	if c.Colors > 0 {
+		profile.Colors = c.Colors
+	}
+	if c.Gray != "" {
+		profile.Gray = c.Gray
+	}
+	if c.Encoding != "" {
+		profile.Encoding = c.Encoding
+	}
+	return profile, nil
+}
+
+type printersFile struct {
+	Printers []PrinterConfig `json:"printers"`
+}
+
+func parseProto(proto string) (ConnectionType, error) {
+	switch proto {
+	case "TCP":
+		return TcpSocket, nil
+	case "USB":
+		return UsbPath, nil
+	}
+	return 0, fmt.Errorf("unknown protocol %q (must be USB or TCP)", proto)
+}
+
+// validate checks a printer entry and fills in the default receipt width
+func (c *PrinterConfig) validate() []error {
+	name := c.DevID
+	if name == "" {
+		name = "(missing devid)"
+	}
+
+	var errs []error
+	if c.DevID == "" {
+		errs = append(errs, fmt.Errorf("printer is missing devid"))
+	}
+	if _, err := parseProto(c.Proto); err != nil {
+		errs = append(errs, fmt.Errorf("printer %q: %w", name, err))
+	}
+	if c.Connection == "" {
+		errs = append(errs, fmt.Errorf("printer %q is missing connection", name))
+	}
+	if c.ReceiptWidth == 0 {
+		c.ReceiptWidth = 576
+	}
+	if c.ReceiptWidth < 0 {
+		errs = append(errs, fmt.Errorf("printer %q: receipt_width must be positive, got %d", name, c.ReceiptWidth))
+	}
+	if c.Retry.Attempts < 0 {
+		errs = append(errs, fmt.Errorf("printer %q: retry attempts must not be negative, got %d", name, c.Retry.Attempts))
+	}
+	if c.Retry.Delay < 0 {
+		errs = append(errs, fmt.Errorf("printer %q: retry delay must not be negative, got %v", name, time.Duration(c.Retry.Delay)))
+	}
+	if _, err := LookupProfile(c.Profile); err != nil {
+		errs = append(errs, fmt.Errorf("printer %q: %w", name, err))
+	}
+	if err := parseWideImages(c.WideImages); err != nil {
+		errs = append(errs, fmt.Errorf("printer %q: %w", name, err))
+	}
+	if err := parseRaster(c.Raster); err != nil {
+		errs = append(errs, fmt.Errorf("printer %q: %w", name, err))
+	}
+	if err := parseGray(c.Gray); err != nil {
+		errs = append(errs, fmt.Errorf("printer %q: %w", name, err))
+	}
+	if err := parseEncoding(c.Encoding); err != nil {
+		errs = append(errs, fmt.Errorf("printer %q: %w", name, err))
+	}
+	if c.Colors < 0 || c.Colors > len(GRAPHICS_COLOR_CODES) {
+		errs = append(errs, fmt.Errorf("printer %q: colors must be between 0 and %d, got %d", name, len(GRAPHICS_COLOR_CODES), c.Colors))
+	}
+	if _, ok := PULSE_DRAWER_CODES[c.Drawer]; c.Drawer != "" && !ok {
+		errs = append(errs, fmt.Errorf("printer %q: drawer: invalid value %q (must be drawer_1 or drawer_2)", name, c.Drawer))
+	}
+	if _, ok := PULSE_TIME_CODES[c.PulseTime]; c.PulseTime != "" && !ok {
+		errs = append(errs, fmt.Errorf("printer %q: pulse_time: invalid value %q (must be pulse_100 ... pulse_500)", name, c.PulseTime))
+	}
+	if c.BandHeight < 0 || c.BandHeight > MAX_BAND_HEIGHT {
+		errs = append(errs, fmt.Errorf("printer %q: band_height must be between 0 and %d, got %d", name, MAX_BAND_HEIGHT, c.BandHeight))
+	}
+	return errs
+}
+
+// validatePrinters checks every printer entry and that device IDs are unique
+func validatePrinters(configs []PrinterConfig) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for i := range configs {
+		errs = append(errs, configs[i].validate()...)
+		devid := configs[i].DevID
+		if devid != "" && seen[devid] {
+			errs = append(errs, fmt.Errorf("duplicate printer devid %q", devid))
+		}
+		seen[devid] = true
+	}
+	return errs
+}
+
+// LoadPrinterConfigs reads a JSON printers file:
+//
+//	{"printers": [{"devid": "kitchen", "proto": "TCP", "connection": "192.168.1.20:9100",
+//	  "receipt_width": 576, "retry": {"attempts": 5, "delay": "1s"}, "profile": "tm-t88vi"}]}
+func LoadPrinterConfigs(path string) ([]PrinterConfig, error) {
+	var file printersFile
+	if err := decodeJSONFile(path, &file); err != nil {
+		return nil, err
+	}
+
+	if len(file.Printers) == 0 {
+		return nil, fmt.Errorf("printers file %s does not define any printers", path)
+	}
+
+	if errs := validatePrinters(file.Printers); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s:\n%w", path, errors.Join(errs...))
+	}
+
+	return file.Printers, nil
+}
+
+// PrinterRegistry maps ePOS device IDs to printers. Requests that do not
+// name a device go to the default printer.
+type PrinterRegistry struct {
+	printers  map[string]*Printer
+	configs   map[string]PrinterConfig
+	defaultID string
+}
+
+func NewPrinterRegistry(defaultID string) *PrinterRegistry {
+	return &PrinterRegistry{
+		printers:  map[string]*Printer{},
+		configs:   map[string]PrinterConfig{},
+		defaultID: defaultID,
+	}
+}
+
+func openPrinter(cfg PrinterConfig) (*Printer, error) {
+	connType, err := parseProto(cfg.Proto)
+	if err != nil {
+		return nil, fmt.Errorf("printer %q: %w", cfg.DevID, err)
+	}
+
+	log.Printf("[REGISTRY] Opening printer %q: %s %s, width=%d", cfg.DevID, cfg.Proto, cfg.Connection, cfg.ReceiptWidth)
+	printer, err := NewPrinter(cfg.Connection, cfg.ReceiptWidth, connType)
+	if err != nil {
+		return nil, fmt.Errorf("printer %q: %w", cfg.DevID, err)
+	}
+	printer.SetRetryPolicy(cfg.Retry)
+	return printer, nil
+}
+
+// OpenPrinterRegistry connects to every configured printer. The first entry
+// is the default printer.
+func OpenPrinterRegistry(configs []PrinterConfig) (*PrinterRegistry, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no printers configured")
+	}
+
+	registry := NewPrinterRegistry(configs[0].DevID)
+	for _, cfg := range configs {
+		printer, err := openPrinter(cfg)
+		if err != nil {
+			registry.Close()
+			return nil, err
+		}
+
+		if err := registry.Add(cfg.DevID, printer); err != nil {
+			printer.Close()
+			registry.Close()
+			return nil, err
+		}
+		registry.configs[cfg.DevID] = cfg
+	}
+	return registry, nil
+}
+
+// Reload builds a registry for a new set of printer definitions. Printers
+// whose protocol and connection are unchanged are carried over with their
+// open connection; the rest are opened anew. The printers the new registry
+// no longer uses are returned so the caller can retire them once it has
+// switched over.
+func (r *PrinterRegistry) Reload(configs []PrinterConfig) (*PrinterRegistry, []*Printer, error) {
+	if len(configs) == 0 {
+		return nil, nil, fmt.Errorf("no printers configured")
+	}
+
+	next := NewPrinterRegistry(configs[0].DevID)
+	var opened []*Printer
+	for _, cfg := range configs {
+		old, exists := r.printers[cfg.DevID]
+		prev := r.configs[cfg.DevID]
+		if exists && prev.Proto == cfg.Proto && prev.Connection == cfg.Connection {
+			log.Printf("[REGISTRY] Keeping connection for printer %q: %s", cfg.DevID, cfg.Connection)
+			next.printers[cfg.DevID] = old
+			next.configs[cfg.DevID] = cfg
+			continue
+		}
+
+		printer, err := openPrinter(cfg)
+		if err != nil {
+			for _, p := range opened {
+				p.Close()
+			}
+			return nil, nil, err
+		}
+		opened = append(opened, printer)
+		next.printers[cfg.DevID] = printer
+		next.configs[cfg.DevID] = cfg
+	}
+
+	var retired []*Printer
+	for devid, printer := range r.printers {
+		if next.printers[devid] != printer {
+			retired = append(retired, printer)
+		}
+	}
+	return next, retired, nil
+}
+
+// Config returns the definition a printer was opened with; an empty ID
+// selects the default printer.
+func (r *PrinterRegistry) Config(devid string) (PrinterConfig, bool) {
+	if devid == "" {
+		devid = r.defaultID
+	}
+	cfg, ok := r.configs[devid]
+	return cfg, ok
+}
+
+func (r *PrinterRegistry) Add(devid string, printer *Printer) error {
+	if _, exists := r.printers[devid]; exists {
+		return fmt.Errorf("duplicate printer devid %q", devid)
+	}
+	r.printers[devid] = printer
+	return nil
+}
+
+// resolve returns the device ID a request for devid is served by; an empty
+// ID names the default printer
+func (r *PrinterRegistry) resolve(devid string) string {
+	if devid == "" {
+		return r.defaultID
+	}
+	return devid
+}
+
+// Get returns the printer for a device ID; an empty ID selects the default
+// printer.
+func (r *PrinterRegistry) Get(devid string) (*Printer, bool) {
+	if devid == "" {
+		devid = r.defaultID
+	}
+	printer, ok := r.printers[devid]
+	return printer, ok
+}
+
+// DevIDs returns the registered device IDs in sorted order
+func (r *PrinterRegistry) DevIDs() []string {
+	ids := make([]string, 0, len(r.printers))
+	for id := range r.printers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close closes every printer, returning the first error
+func (r *PrinterRegistry) Close() error {
+	var firstErr error
+	for _, devid := range r.DevIDs() {
+		log.Printf("[REGISTRY] Closing printer %q", devid)
+		if err := r.printers[devid].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
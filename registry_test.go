@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTempFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadPrinterConfigs(t *testing.T) {
+	path := writeTempFile(t, "printers.json", `{"printers": [
+		{"devid": "counter", "proto": "USB", "connection": "/dev/usb/lp0"},
+		{"devid": "kitchen", "proto": "TCP", "connection": "192.168.1.20:9100", "receipt_width": 384,
+		 "retry": {"attempts": 5, "delay": "500ms"}, "profile": "TM-T88VI", "band_height": 1024}
+	]}`)
+
+	configs, err := LoadPrinterConfigs(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("expected 2 printers, got %d", len(configs))
+	}
+	if configs[0].ReceiptWidth != 576 {
+		t.Errorf("expected default receipt width 576, got %d", configs[0].ReceiptWidth)
+	}
+	kitchen := configs[1]
+	if kitchen.DevID != "kitchen" || kitchen.Proto != "TCP" || kitchen.Connection != "192.168.1.20:9100" || kitchen.ReceiptWidth != 384 {
+		t.Errorf("unexpected kitchen printer: %+v", kitchen)
+	}
+	if kitchen.Retry.Attempts != 5 || time.Duration(kitchen.Retry.Delay) != 500*time.Millisecond {
+		t.Errorf("unexpected kitchen retry policy: %+v", kitchen.Retry)
+	}
+	if profile, err := kitchen.printerProfile(); err != nil || profile.Name != "tm-t88vi" || profile.MaxBandHeight != 1024 {
+		t.Errorf("expected tm-t88vi profile with band height override, got %+v, %v", profile, err)
+	}
+	if profile, _ := configs[0].printerProfile(); profile.Name != DEFAULT_PROFILE {
+		t.Errorf("expected default profile, got %+v", profile)
+	}
+}
+
+func TestLoadPrinterConfigs_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not JSON", `printers: []`},
+		{"no printers", `{"printers": []}`},
+		{"unknown key", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "speed": 9600}]}`},
+		{"missing devid", `{"printers": [{"proto": "USB", "connection": "/dev/usb/lp0"}]}`},
+		{"bad proto", `{"printers": [{"devid": "a", "proto": "SERIAL", "connection": "/dev/ttyS0"}]}`},
+		{"missing connection", `{"printers": [{"devid": "a", "proto": "TCP"}]}`},
+		{"negative width", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "receipt_width": -1}]}`},
+		{"unknown profile", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "profile": "tm-u220"}]}`},
+		{"unknown wide_images", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "wide_images": "wrap"}]}`},
+		{"too many colors", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "colors": 5}]}`},
+		{"unknown raster", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "raster": "escape"}]}`},
+		{"unknown gray", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "gray": "sepia"}]}`},
+		{"bad drawer", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "drawer": "drawer_3"}]}`},
+		{"bad pulse_time", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "pulse_time": "pulse_50"}]}`},
+		{"unknown encoding", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "encoding": "shift_jis"}]}`},
+		{"negative band height", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "band_height": -1}]}`},
+		{"bad delay", `{"printers": [{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0", "retry": {"delay": 2}}]}`},
+		{"duplicate devid", `{"printers": [
+			{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp0"},
+			{"devid": "a", "proto": "USB", "connection": "/dev/usb/lp1"}]}`},
+	}
+
+	for _, tt := range tests {
+		path := writeTempFile(t, "printers.json", tt.content)
+		if _, err := LoadPrinterConfigs(path); err == nil {
+			t.Errorf("%s: expected error, got nil", tt.name)
+		}
+	}
+
+	if _, err := LoadPrinterConfigs(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing file, got nil")
+	}
+}
+
+func TestPrinterRegistry_Get(t *testing.T) {
+	counter := &Printer{connection_string: "counter"}
+	kitchen := &Printer{connection_string: "kitchen"}
+
+	registry := NewPrinterRegistry("counter")
+	registry.Add("counter", counter)
+	registry.Add("kitchen", kitchen)
+
+	if p, ok := registry.Get(""); !ok || p != counter {
+		t.Errorf("expected empty devid to select the default printer")
+	}
+	if p, ok := registry.Get("kitchen"); !ok || p != kitchen {
+		t.Errorf("expected kitchen printer")
+	}
+	if _, ok := registry.Get("bar"); ok {
+		t.Errorf("expected unknown devid to be rejected")
+	}
+	if err := registry.Add("kitchen", kitchen); err == nil {
+		t.Errorf("expected duplicate devid to be rejected")
+	}
+	if ids := registry.DevIDs(); len(ids) != 2 || ids[0] != "counter" || ids[1] != "kitchen" {
+		t.Errorf("unexpected device IDs: %v", ids)
+	}
+}
+
+func TestSetRetryPolicy(t *testing.T) {
+	mock := &MockWritable{WriteRawError: errors.New("write failed")}
+	printer := &Printer{connection_string: "/test", connection: mock}
+
+	printer.SetRetryPolicy(RetryPolicy{Attempts: 2, Delay: Duration(time.Millisecond)})
+	printer.Cut(CutDefault)
+
+	if len(mock.WriteRawCalls) != 2 {
+		t.Errorf("expected 2 attempts, got %d", len(mock.WriteRawCalls))
+	}
+
+	printer.SetRetryPolicy(RetryPolicy{Delay: Duration(time.Millisecond)})
+	if printer.retryAttempts != 0 || printer.retryDelay != time.Millisecond {
+		t.Errorf("expected per-operation attempts and updated delay, got attempts=%d delay=%v",
+			printer.retryAttempts, printer.retryDelay)
+	}
+
+	printer.SetRetryPolicy(RetryPolicy{})
+	if printer.retryDelay != DEFAULT_RETRY_DELAY {
+		t.Errorf("expected default delay, got %v", printer.retryDelay)
+	}
+}
+
+func TestServer_RoutesByDevID(t *testing.T) {
+	counterConn := &MockWritable{}
+	kitchenConn := &MockWritable{}
+
+	registry := NewPrinterRegistry("counter")
+	registry.Add("counter", &Printer{connection_string: "counter", receipt_width: 576, connection: counterConn})
+	registry.Add("kitchen", &Printer{connection_string: "kitchen", receipt_width: 576, connection: kitchenConn})
+	s := NewServer(registry, nil, nil, DefaultConfig().Limits)
+
+	rec := postJob(s, EPOS_SERVICE_PATH+"?devid=kitchen", testJob)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `success="true"`) {
+		t.Fatalf("expected success, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(kitchenConn.WriteRawCalls) == 0 || len(counterConn.WriteRawCalls) != 0 {
+		t.Errorf("expected job on kitchen printer only, got kitchen=%d counter=%d writes",
+			len(kitchenConn.WriteRawCalls), len(counterConn.WriteRawCalls))
+	}
+
+	kitchenConn.WriteRawCalls = nil
+	envelope := `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter>` +
+		`<devid>counter</devid></parameter></s:Header><s:Body>` + testJob + `</s:Body></s:Envelope>`
+	postJob(s, EPOS_SERVICE_PATH, envelope)
+	if len(counterConn.WriteRawCalls) == 0 || len(kitchenConn.WriteRawCalls) != 0 {
+		t.Errorf("expected SOAP header devid to route to counter, got kitchen=%d counter=%d writes",
+			len(kitchenConn.WriteRawCalls), len(counterConn.WriteRawCalls))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/status?devid=bar", nil)
+	status := httptest.NewRecorder()
+	s.Handler().ServeHTTP(status, req)
+	if status.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown status devid, got %d", status.Code)
+	}
+}
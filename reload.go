@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// certStore serves the current TLS certificate so it can be replaced
+// without restarting the listeners.
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func (c *certStore) Load(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert.Store(&cert)
+	log.Printf("[TLS] Serving certificate %s", certFile)
+	return nil
+}
+
+func (c *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// certFiles returns the certificate pair to serve, generating a self-signed
+// one when none is configured.
+func certFiles(cfg Config) (string, string, error) {
+	if cfg.TLS.Cert != "" {
+		return cfg.TLS.Cert, cfg.TLS.Key, nil
+	}
+	if err := generateCert(); err != nil {
+		return "", "", fmt.Errorf("certificate generation failed: %w", err)
+	}
+	return "server.crt", "server.key", nil
+}
+
+// configurePrinter applies the settings that do not need the connection to
+// be reopened. It waits for jobs running on the printer to finish first.
+func configurePrinter(p *Printer, pc PrinterConfig, cfg Config) error {
+	p.jobs.Lock()
+	defer p.jobs.Unlock()
+
+	p.receipt_width = pc.ReceiptWidth
+	profile, err := pc.printerProfile()
+	if err != nil {
+		return err
+	}
+	p.SetProfile(profile)
+	p.wideImages = pc.WideImages
+	p.SetRetryPolicy(pc.Retry)
+	p.SetQueueDepth(cfg.Limits.QueueDepth)
+	p.SetSpoolMaxAge(time.Duration(cfg.Limits.SpoolMaxAge))
+	drawer, pulseTime := pc.Drawer, pc.PulseTime
+	if drawer == "" {
+		drawer = cfg.Drawer
+	}
+	if pulseTime == "" {
+		pulseTime = cfg.PulseTime
+	}
+	if err := p.SetDefaultPulse(drawer, pulseTime); err != nil {
+		return err
+	}
+
+	switch {
+	case cfg.ASB && !p.asbEnabled():
+		if err := p.EnableASB(); err != nil {
+			return fmt.Errorf("Automatic Status Back unavailable: %w", err)
+		}
+	case !cfg.ASB && p.asbEnabled():
+		if err := p.DisableASB(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadConfig builds the configuration again and applies it to the running
+// server: CORS origins, raw command filter, limits, printer definitions and
+// the TLS certificate. Printers whose connection is unchanged keep it, and
+// jobs already queued finish on the printers they were queued on. Listen
+// addresses, HTTPS on/off and the journal cannot change without a restart.
+//
+// On error the running configuration is left untouched and returned.
+func reloadConfig(server *Server, certs *certStore, running Config, build func() (Config, error)) (Config, error) {
+	cfg, err := build()
+	if err != nil {
+		return running, err
+	}
+
+	if !slices.Equal(cfg.Listen, running.Listen) || cfg.Secure != running.Secure {
+		log.Printf("[RELOAD] WARNING: listen and secure changes need a restart, keeping %v (secure=%v)", running.Listen, running.Secure)
+		cfg.Listen = running.Listen
+		cfg.Secure = running.Secure
+	}
+	if cfg.Journal != running.Journal {
+		log.Printf("[RELOAD] WARNING: journal changes need a restart, keeping %q", running.Journal.Path)
+		cfg.Journal = running.Journal
+	}
+
+	commandFilter, err := NewCommandFilter(strings.Join(cfg.CommandAllow, ","), strings.Join(cfg.CommandDeny, ","))
+	if err != nil {
+		return running, err
+	}
+
+	printers, retired, err := server.current().printers.Reload(cfg.Printers)
+	if err != nil {
+		return running, err
+	}
+	for _, id := range printers.DevIDs() {
+		printer, _ := printers.Get(id)
+		pc, _ := printers.Config(id)
+		if err := configurePrinter(printer, pc, cfg); err != nil {
+			log.Printf("[RELOAD] WARNING: Printer %q: %v", id, err)
+		}
+	}
+
+	if cfg.Secure {
+		certFile, keyFile, err := certFiles(cfg)
+		if err == nil {
+			err = certs.Load(certFile, keyFile)
+		}
+		if err != nil {
+			log.Printf("[RELOAD] WARNING: Keeping the current TLS certificate: %v", err)
+		}
+	}
+
+	server.Update(printers, cfg.AllowOrigins, commandFilter, cfg.Limits)
+	for _, printer := range retired {
+		printer.Retire()
+	}
+
+	log.Printf("[RELOAD] Configuration reloaded: printers=%v, allowed origins=%v", printers.DevIDs(), cfg.AllowOrigins)
+	return cfg, nil
+}
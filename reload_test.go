@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func reloadTestConfig(t *testing.T, counter string, kitchen string) Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Printers = []PrinterConfig{
+		{DevID: "counter", Proto: "USB", Connection: counter},
+		{DevID: "kitchen", Proto: "USB", Connection: kitchen},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	return cfg
+}
+
+func TestReloadConfig(t *testing.T) {
+	counterPath := writeTempFile(t, "counter", "")
+	kitchenPath := writeTempFile(t, "kitchen", "")
+	newKitchenPath := writeTempFile(t, "kitchen2", "")
+
+	running := reloadTestConfig(t, counterPath, kitchenPath)
+	printers, err := OpenPrinterRegistry(running.Printers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := NewServer(printers, nil, nil, running.Limits)
+	defer func() { server.current().printers.Close() }()
+
+	oldCounter, _ := printers.Get("counter")
+	oldKitchen, _ := printers.Get("kitchen")
+
+	next := reloadTestConfig(t, counterPath, newKitchenPath)
+	next.AllowOrigins = []string{"https://pos.example.com"}
+	next.Printers[0].ReceiptWidth = 384
+	next.Drawer, next.PulseTime = "drawer_2", "pulse_300"
+	next.Printers[1].Drawer, next.Printers[1].PulseTime = "drawer_1", "pulse_500"
+
+	cfg, err := reloadConfig(server, &certStore{}, running, func() (Config, error) { return next, nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.AllowOrigins) != 1 {
+		t.Errorf("expected reloaded config to be returned, got %+v", cfg)
+	}
+
+	state := server.current()
+	if len(state.allowedOrigins) != 1 || state.allowedOrigins[0] != "https://pos.example.com" {
+		t.Errorf("expected new allowed origins, got %v", state.allowedOrigins)
+	}
+
+	counter, _ := state.printers.Get("counter")
+	if counter != oldCounter {
+		t.Errorf("expected unchanged counter printer to keep its connection")
+	}
+	if counter.receipt_width != 384 {
+		t.Errorf("expected counter receipt width to be updated, got %d", counter.receipt_width)
+	}
+	if counter.default_pulse != (PulseDecoded{Drawer: "drawer_2", Time: "pulse_300"}) {
+		t.Errorf("expected counter to use the global pulse, got %+v", counter.default_pulse)
+	}
+
+	kitchen, _ := state.printers.Get("kitchen")
+	if kitchen == oldKitchen || kitchen.connection_string != newKitchenPath {
+		t.Errorf("expected kitchen printer to be reopened on %s", newKitchenPath)
+	}
+	if kitchen.default_pulse != (PulseDecoded{Drawer: "drawer_1", Time: "pulse_500"}) {
+		t.Errorf("expected kitchen to use its own pulse, got %+v", kitchen.default_pulse)
+	}
+
+	if !oldKitchen.isRetired() {
+		t.Errorf("expected old kitchen printer to be retired")
+	}
+	if err := oldKitchen.Submit(newPrintJob(context.Background(), &EposPrint{}, 1)); !errors.Is(err, errPrinterRetired) {
+		t.Errorf("expected retired printer to refuse jobs, got %v", err)
+	}
+}
+
+func TestReloadConfig_KeepsRunningConfigOnError(t *testing.T) {
+	running := reloadTestConfig(t, writeTempFile(t, "counter", ""), writeTempFile(t, "kitchen", ""))
+	printers, err := OpenPrinterRegistry(running.Printers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer printers.Close()
+	server := NewServer(printers, []string{"https://pos.example.com"}, nil, running.Limits)
+
+	cfg, err := reloadConfig(server, &certStore{}, running, func() (Config, error) {
+		return Config{}, errors.New("invalid configuration")
+	})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if len(cfg.Printers) != 2 {
+		t.Errorf("expected running config to be returned, got %+v", cfg)
+	}
+	if state := server.current(); state.printers != printers || len(state.allowedOrigins) != 1 {
+		t.Errorf("expected server state to be left untouched")
+	}
+}
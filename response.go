@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EposResponse is the result reported back to ePOS-Print clients
+type EposResponse struct {
+	Success bool
+	Code    string
+	Status  uint32
+	// PrintJobID echoes the printjobid from the request's SOAP header
+	PrintJobID string
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeEposResponse(w http.ResponseWriter, httpStatus int, resp EposResponse) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(httpStatus)
+	response := fmt.Sprintf(`<response success="%t" code="%s" status="%d" battery="0"/>`,
+		resp.Success, xmlEscape(resp.Code), resp.Status)
+	if resp.PrintJobID != "" {
+		response = fmt.Sprintf(`<response success="%t" code="%s" status="%d" battery="0"><printjobid>%s</printjobid></response>`,
+			resp.Success, xmlEscape(resp.Code), resp.Status, xmlEscape(resp.PrintJobID))
+	}
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+<s:Body>
+%s
+</s:Body>
+</s:Envelope>`, response)
+	w.Write([]byte(body))
+}
+
+// JobResponse builds the response for a finished job from the printer's
+// real-time status. Printers whose connection cannot be read from report
+// print success without any further status bits. A job that was written in
+// full has printed as far as the proxy can tell, so a status query that
+// then fails still reports success, with ASB_NO_RESPONSE_CODE; reporting a
+// failure would make clients print the receipt again.
+func (p *Printer) JobResponse(jobErr error) EposResponse {
+	if jobErr != nil {
+		return EposResponse{Success: false, Code: EX_BADPORT, Status: ASB_NO_RESPONSE}
+	}
+
+	status, err := p.QueryStatus()
+	switch {
+	case errors.Is(err, ErrStatusUnsupported):
+		log.Printf("[STATUS] Status unavailable for %s, reporting print success only", p.connection_string)
+		return EposResponse{Success: true, Status: ASB_PRINT_SUCCESS}
+	case err != nil:
+		log.Printf("[STATUS] Job sent to %s but its status is unknown: %v", p.connection_string, err)
+		return EposResponse{Success: true, Code: ASB_NO_RESPONSE_CODE, Status: ASB_PRINT_SUCCESS | ASB_NO_RESPONSE}
+	}
+
+	code := status.Code()
+	asb := status.ASB()
+	if code == "" {
+		asb |= ASB_PRINT_SUCCESS
+	}
+	return EposResponse{Success: code == "", Code: code, Status: asb}
+}
+
+type statusJSON struct {
+	Source  string        `json:"source"`
+	Updated *time.Time    `json:"updated,omitempty"`
+	Status  PrinterStatus `json:"status"`
+	ASB     uint32        `json:"asb"`
+	Code    string        `json:"code"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// writeStatusJSON reports the printer's live state: the cached ASB status
+// when Automatic Status Back is on, otherwise a fresh DLE EOT query once
+// the running job, if any, has finished.
+func writeStatusJSON(w http.ResponseWriter, p *Printer) {
+	resp := statusJSON{}
+	httpStatus := http.StatusOK
+
+	if p.asbEnabled() {
+		resp.Source = "asb"
+		status, updated, ok := p.CachedStatus()
+		if ok {
+			resp.Status = status
+			resp.Updated = &updated
+		} else {
+			resp.Error = ErrStatusTimeout.Error()
+			httpStatus = http.StatusServiceUnavailable
+		}
+	} else {
+		resp.Source = "query"
+		status, err := p.LiveStatus()
+		if err != nil {
+			resp.Error = err.Error()
+			httpStatus = http.StatusServiceUnavailable
+		} else {
+			now := time.Now()
+			resp.Status = status
+			resp.Updated = &now
+		}
+	}
+	resp.ASB = resp.Status.ASB()
+	resp.Code = resp.Status.Code()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// EPOS_SERVICE_PATH is where Epson's ePOS SDK posts print jobs
+const EPOS_SERVICE_PATH = "/cgi-bin/epos/service.cgi"
+
+// DEFAULT_DEVID is the device ID ePOS SDK clients use for the printer they
+// are attached to.
+const DEFAULT_DEVID = "local_printer"
+
+// Server handles ePOS-Print requests, routing each job to the printer named
+// by its device ID.
+type Server struct {
+	state        atomic.Pointer[serverState]
+	jobs         *JobStore
+	idempotency  *IdempotencyStore
+	journal      *Journal
+	requestCount atomic.Int64
+}
+
+// serverState is the reloadable part of the server. Each request works
+// with the state that was current when it arrived.
+type serverState struct {
+	printers       *PrinterRegistry
+	allowedOrigins []string
+	commandFilter  *CommandFilter
+	limits         Limits
+}
+
+func NewServer(printers *PrinterRegistry, allowedOrigins []string, commandFilter *CommandFilter, limits Limits) *Server {
+	s := &Server{jobs: NewJobStore(DEFAULT_JOB_HISTORY), idempotency: NewIdempotencyStore()}
+	s.Update(printers, allowedOrigins, commandFilter, limits)
+	return s
+}
+
+// Update swaps in new printers and settings. Requests already running keep
+// the ones they started with.
+func (s *Server) Update(printers *PrinterRegistry, allowedOrigins []string, commandFilter *CommandFilter, limits Limits) {
+	s.state.Store(&serverState{
+		printers:       printers,
+		allowedOrigins: allowedOrigins,
+		commandFilter:  commandFilter,
+		limits:         limits,
+	})
+}
+
+func (s *Server) current() *serverState {
+	return s.state.Load()
+}
+
+// submitJob queues a job on the printer for devid. If a reload retired
+// the printer in the meantime, the job goes to its replacement.
+func (s *Server) submitJob(printer *Printer, devid string, job *printJob) (*Printer, error) {
+	for {
+		err := printer.Submit(job)
+		if !errors.Is(err, errPrinterRetired) {
+			return printer, err
+		}
+		var ok bool
+		if printer, ok = s.current().printers.Get(devid); !ok {
+			return nil, err
+		}
+	}
+}
+
+// Handler returns the HTTP routes served by the proxy. Jobs are accepted
+// both on the ePOS-Print service path and on "/" for existing clients.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(EPOS_SERVICE_PATH, s.handlePrint)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/jobs/{id}", s.handleJob)
+	mux.HandleFunc("/image", s.handleImage)
+	mux.HandleFunc("/", s.handlePrint)
+	return mux
+}
+
+// checkOrigin rejects requests from origins outside the CORS whitelist and
+// sets the CORS response headers for allowed ones.
+func (s *Server) checkOrigin(w http.ResponseWriter, r *http.Request, methods string) bool {
+	origin := r.Header.Get("Origin")
+	if !isOriginAllowed(origin, s.current().allowedOrigins) {
+		log.Printf("[HTTP] CORS blocked - origin '%s' not in whitelist", origin)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "CORS Error: Origin '%s' is not allowed\n", origin)
+		return false
+	}
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	return true
+}
+
+// jobTimeout reads the ePOS-Print "timeout" query parameter (milliseconds).
+// Zero means the query did not set a deadline.
+func jobTimeout(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("timeout")
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must be a positive number of milliseconds", value)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// asyncMode reads the "async" query parameter that asks for the job to be
+// acknowledged before it prints
+func asyncMode(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("async")
+	if value == "" {
+		return false, nil
+	}
+	async, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid async %q: must be true or false", value)
+	}
+	return async, nil
+}
+
+// jobParser turns a request body into the job to print
+type jobParser func(r *http.Request, data []byte) (*EposPrint, error)
+
+func (s *Server) handlePrint(w http.ResponseWriter, r *http.Request) {
+	s.serveJob(w, r, func(_ *http.Request, data []byte) (*EposPrint, error) {
+		return Parse(data)
+	})
+}
+
+// handleImage prints an uploaded PNG, JPEG or BMP file, named by the
+// Content-Type header, as a single image. The query sets how it is printed:
+// dither, align, width in dots and cut=true to cut the paper after it.
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	s.serveJob(w, r, parseImageUpload)
+}
+
+func parseImageUpload(r *http.Request, data []byte) (*EposPrint, error) {
+	query := r.URL.Query()
+	image := &ImageDecoded{
+		ContentType: r.Header.Get("Content-Type"),
+		Mode:        IMAGE_MONO,
+		Align:       query.Get("align"),
+		Dither:      query.Get("dither"),
+		Data:        data,
+	}
+	if err := parseDither(image.Dither); err != nil {
+		return nil, err
+	}
+	switch image.Align {
+	case "", "left", "center", "right":
+	default:
+		return nil, fmt.Errorf("invalid align %q: must be left, center or right", image.Align)
+	}
+	if value := query.Get("width"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid width %q: must be a positive number of dots", value)
+		}
+		image.Width = width
+	}
+	cut := false
+	if value := query.Get("cut"); value != "" {
+		var err error
+		if cut, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid cut %q: must be true or false", value)
+		}
+	}
+
+	config, err := checkEncodedImage(image, 0)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[IMAGE] Uploaded %dx%d %s image, %d bytes", config.Width, config.Height, image.ContentType, len(data))
+
+	epos := &EposPrint{Instructions: []Instruction{{Type: InstImage, Image: image}}}
+	if cut {
+		epos.Instructions = append(epos.Instructions, Instruction{Type: InstCut, Cut: CutFeed})
+	}
+	return epos, nil
+}
+
+// serveJob reads a job from the request body with parse and prints it,
+// answering with an ePOS-Print response
+func (s *Server) serveJob(w http.ResponseWriter, r *http.Request, parse jobParser) {
+	requestID := int(s.requestCount.Add(1))
+	log.Printf("[HTTP] Request #%d received: %s %s from %s", requestID, r.Method, r.URL.RequestURI(), r.RemoteAddr)
+	log.Printf("[HTTP]   Content-Type: %s", r.Header.Get("Content-Type"))
+	log.Printf("[HTTP]   Content-Length: %d", r.ContentLength)
+	log.Printf("[HTTP]   Origin: %s", r.Header.Get("Origin"))
+
+	if !s.checkOrigin(w, r, "POST, OPTIONS") {
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		log.Printf("[HTTP] Request #%d: CORS preflight request, returning 200", requestID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		log.Printf("[HTTP] Request #%d: Method not allowed: %s", requestID, r.Method)
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := s.current()
+	devid := r.URL.Query().Get("devid")
+	if _, ok := state.printers.Get(devid); devid != "" && !ok {
+		log.Printf("[HTTP] Request #%d: Unknown device ID %q (serving %v)", requestID, devid, state.printers.DevIDs())
+		writeEposResponse(w, http.StatusOK, EposResponse{Success: false, Code: DEVICE_NOT_FOUND})
+		return
+	}
+
+	timeout, err := jobTimeout(r)
+	if err != nil {
+		log.Printf("[HTTP] Request #%d: ERROR %v", requestID, err)
+		writeEposResponse(w, http.StatusBadRequest, EposResponse{Success: false, Code: SCHEMA_ERROR})
+		return
+	}
+
+	async, err := asyncMode(r)
+	if err != nil {
+		log.Printf("[HTTP] Request #%d: ERROR %v", requestID, err)
+		writeEposResponse(w, http.StatusBadRequest, EposResponse{Success: false, Code: SCHEMA_ERROR})
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > MAX_IDEMPOTENCY_KEY_LENGTH {
+		log.Printf("[HTTP] Request #%d: ERROR Idempotency-Key longer than %d characters", requestID, MAX_IDEMPOTENCY_KEY_LENGTH)
+		writeEposResponse(w, http.StatusBadRequest, EposResponse{Success: false, Code: SCHEMA_ERROR})
+		return
+	}
+
+	if state.limits.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, state.limits.MaxBodyBytes)
+	}
+	data, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Printf("[HTTP] Request #%d: ERROR request body exceeds %d bytes", requestID, tooLarge.Limit)
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("[HTTP] Request #%d: ERROR reading request body: %v", requestID, err)
+		http.Error(w, fmt.Sprintf("Failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	log.Printf("[HTTP] Request #%d: Read %d bytes from request body", requestID, len(data))
+
+	if len(data) == 0 {
+		log.Printf("[HTTP] Request #%d: ERROR empty request body", requestID)
+		writeEposResponse(w, http.StatusBadRequest, EposResponse{Success: false, Code: SCHEMA_ERROR})
+		return
+	}
+
+	log.Printf("[XML] Request #%d: Parsing job...", requestID)
+	epos, err := parse(r, data)
+	if err != nil {
+		log.Printf("[XML] Request #%d: ERROR parsing job: %v", requestID, err)
+		writeEposResponse(w, http.StatusBadRequest, EposResponse{Success: false, Code: SCHEMA_ERROR})
+		return
+	}
+	log.Printf("[XML] Request #%d: Job parsed successfully, found %d instruction(s)", requestID, len(epos.Instructions))
+
+	// Every response from here on belongs to a parsed job, so it echoes the
+	// client's printjobid.
+	respond := func(httpStatus int, resp EposResponse) {
+		resp.PrintJobID = epos.PrintJobID
+		writeEposResponse(w, httpStatus, resp)
+	}
+
+	// The query's devid wins over one in the SOAP header
+	if devid == "" {
+		devid = epos.DevID
+	}
+	printer, ok := state.printers.Get(devid)
+	if !ok {
+		log.Printf("[HTTP] Request #%d: Unknown device ID %q (serving %v)", requestID, devid, state.printers.DevIDs())
+		respond(http.StatusOK, EposResponse{Success: false, Code: DEVICE_NOT_FOUND})
+		return
+	}
+	log.Printf("[HTTP] Request #%d: Routing job to printer %s", requestID, printer.connection_string)
+	if timeout == 0 {
+		timeout = epos.Timeout
+	}
+
+	// With ASB the printer tells us about problems as they happen, so
+	// jobs that cannot print are refused before sending anything.
+	if status, _, ok := printer.CachedStatus(); ok && status.Code() != "" {
+		log.Printf("[PRINT] Request #%d: Printer not ready (%s), rejecting job", requestID, status.Code())
+		respond(http.StatusOK, EposResponse{Success: false, Code: status.Code(), Status: status.ASB()})
+		return
+	}
+
+	// Check every raw command before anything is printed so a rejected
+	// job never leaves a partial receipt behind. They are checked together
+	// so that a command cannot be smuggled through in pieces.
+	var commands [][]byte
+	for _, inst := range epos.Instructions {
+		if inst.Type == InstCommand {
+			commands = append(commands, inst.Command)
+		}
+	}
+	if err := state.commandFilter.Check(commands...); err != nil {
+		log.Printf("[XML] Request #%d: Raw command rejected: %v", requestID, err)
+		http.Error(w, fmt.Sprintf("Raw command not allowed: %v", err), http.StatusForbidden)
+		return
+	}
+
+	// Image files are resized to the paper, so a narrow one that was small
+	// enough to upload can still be too large once printed on this printer
+	if pc, ok := state.printers.Config(devid); ok {
+		for _, inst := range epos.Instructions {
+			if inst.Type != InstImage || inst.Image.ContentType == "" {
+				continue
+			}
+			if _, err := checkEncodedImage(inst.Image, pc.ReceiptWidth); err != nil {
+				log.Printf("[XML] Request #%d: ERROR %v", requestID, err)
+				respond(http.StatusBadRequest, EposResponse{Success: false, Code: SCHEMA_ERROR})
+				return
+			}
+		}
+	}
+
+	// A job resubmitted with the same key (the Idempotency-Key header, or
+	// else the ePOS printjobid) gets the first submission's result instead
+	// of printing again. A duplicate of a job still printing waits for it.
+	// Keys are scoped to the printer, and reusing one for a different job
+	// is refused rather than answered with the other job's result.
+	if idempotencyKey == "" {
+		idempotencyKey = epos.PrintJobID
+	}
+	var claim *idempotencyEntry
+	var scopedKey, fingerprint string
+	if idempotencyKey != "" && state.limits.IdempotencyTTL > 0 {
+		scopedKey = idempotencyScope(state.printers.resolve(devid), idempotencyKey)
+		fingerprint = requestFingerprint(r, data)
+		entry, owner, ok := s.idempotency.Claim(r.Context(), scopedKey, fingerprint, state.limits.IdempotencyKeys)
+		if !ok {
+			log.Printf("[IDEMPOTENCY] Request #%d: Client went away while waiting for key %q", requestID, idempotencyKey)
+			return
+		}
+		if !owner && !entry.matches(fingerprint) {
+			log.Printf("[IDEMPOTENCY] Request #%d: Key %q already used for a different job", requestID, idempotencyKey)
+			http.Error(w, fmt.Sprintf("Idempotency key %q was already used for a different job", idempotencyKey), http.StatusUnprocessableEntity)
+			return
+		}
+		if !owner {
+			s.replay(w, requestID, idempotencyKey, entry, respond)
+			return
+		}
+		claim = entry
+	}
+	idempotencyTTL := time.Duration(state.limits.IdempotencyTTL)
+
+	// The job deadline is deliberately not tied to the request context: a
+	// client hanging up mid-job should not leave half a receipt behind.
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		log.Printf("[PRINT] Request #%d: Job deadline set to %v", requestID, timeout)
+	}
+
+	// Jobs wait their turn on the printer's queue; time spent waiting
+	// counts against the job deadline. They are journaled first so that a
+	// restart does not lose them.
+	jobID := newJobID()
+	job := newPrintJob(ctx, epos, requestID)
+	job.onStart = func() {
+		s.journal.Started(jobID)
+		s.jobs.Started(jobID)
+	}
+	job.onRequeue = func() {
+		s.journal.Requeued(jobID)
+		s.jobs.Requeued(jobID)
+	}
+	if async {
+		s.jobs.Add(jobID, devid, epos.PrintJobID, time.Now())
+	}
+	journalKey := ""
+	if claim != nil {
+		journalKey = idempotencyKey
+	}
+	s.journal.Accepted(jobID, devid, journalKey, fingerprint, epos)
+
+	printer, err = s.submitJob(printer, devid, job)
+	if err != nil {
+		cancel()
+		s.journal.Finished(jobID, EposResponse{}, err)
+		if async {
+			s.jobs.Remove(jobID)
+		}
+		if claim != nil {
+			s.idempotency.Release(scopedKey, claim)
+		}
+		if errors.Is(err, ErrQueueFull) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Printer queue is full, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("[HTTP] Request #%d: Device %q is no longer served", requestID, devid)
+		respond(http.StatusOK, EposResponse{Success: false, Code: DEVICE_NOT_FOUND})
+		return
+	}
+
+	// Asynchronous jobs are acknowledged straight away and report their
+	// outcome through GET /jobs/{id}
+	if async {
+		// Accepted before the job can be released below
+		if claim != nil {
+			s.idempotency.Accept(claim, jobID, idempotencyTTL)
+		}
+		go func() {
+			defer cancel()
+			result := <-job.done
+			_, response := jobOutcome(result)
+			s.jobs.Finish(jobID, response, result.err)
+			s.journal.Finished(jobID, response, result.err)
+			if claim != nil && !job.started.Load() {
+				s.idempotency.Release(scopedKey, claim)
+			}
+			log.Printf("[HTTP] Request #%d: Job %s finished (success=%t, code=%q)",
+				requestID, jobID, response.Success, response.Code)
+		}()
+		record, _ := s.jobs.Get(jobID)
+		log.Printf("[HTTP] Request #%d: Accepted as job %s", requestID, jobID)
+		w.Header().Set("Location", "/jobs/"+jobID)
+		writeJobJSON(w, http.StatusAccepted, record)
+		return
+	}
+	defer cancel()
+
+	var result jobResult
+	select {
+	case result = <-job.done:
+	case <-ctx.Done():
+		result = jobResult{err: ctx.Err()}
+	}
+
+	httpStatus, response := jobOutcome(result)
+	switch {
+	case errors.Is(result.err, context.DeadlineExceeded):
+		log.Printf("[HTTP] Request #%d: Job timed out after %v", requestID, timeout)
+	case result.err != nil:
+		log.Printf("[HTTP] Request #%d: Job failed: %v", requestID, result.err)
+	default:
+		log.Printf("[HTTP] Request #%d: All instructions processed successfully on %s", requestID, printer.connection_string)
+	}
+	s.journal.Finished(jobID, response, result.err)
+
+	// Only jobs that may have printed something are remembered; a retry of
+	// one that never started should print.
+	if claim != nil {
+		if job.started.Load() {
+			s.idempotency.Complete(claim, httpStatus, response, idempotencyTTL)
+		} else {
+			s.idempotency.Release(scopedKey, claim)
+		}
+	}
+
+	respond(httpStatus, response)
+	log.Printf("[HTTP] Request #%d: Response sent (%d, success=%t, code=%q, status=0x%08x)",
+		requestID, httpStatus, response.Success, response.Code, response.Status)
+}
+
+// jobOutcome maps the result of a job to the HTTP status and ePOS response
+// reported for it
+func jobOutcome(result jobResult) (int, EposResponse) {
+	switch {
+	case errors.Is(result.err, context.DeadlineExceeded):
+		return http.StatusOK, EposResponse{Success: false, Code: EX_TIMEOUT, Status: ASB_NO_RESPONSE}
+	case result.err != nil:
+		return http.StatusInternalServerError, result.response
+	}
+	return http.StatusOK, result.response
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[HTTP] Status request received: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+
+	if !s.checkOrigin(w, r, "GET") {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	devid := r.URL.Query().Get("devid")
+	printer, ok := s.current().printers.Get(devid)
+	if !ok {
+		log.Printf("[HTTP] Status request: Unknown device ID %q", devid)
+		http.Error(w, fmt.Sprintf("Unknown device ID %q", devid), http.StatusNotFound)
+		return
+	}
+
+	writeStatusJSON(w, printer)
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[HTTP] Job request received: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+
+	if !s.checkOrigin(w, r, "GET") {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	record, ok := s.jobs.Get(id)
+	if !ok {
+		log.Printf("[HTTP] Job request: Unknown job %q", id)
+		http.Error(w, fmt.Sprintf("Unknown job %q", id), http.StatusNotFound)
+		return
+	}
+
+	writeJobJSON(w, http.StatusOK, record)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJob = `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print"><text>Hi</text><cut/></epos-print>`
+
+func createTestServer() (*Server, *MockWritable) {
+	conn := &MockWritable{}
+	printer := &Printer{
+		connection_string: "/test",
+		receipt_width:     576,
+		connection:        conn,
+	}
+	printers := NewPrinterRegistry(DEFAULT_DEVID)
+	printers.Add(DEFAULT_DEVID, printer)
+	return NewServer(printers, nil, nil, DefaultConfig().Limits), conn
+}
+
+func postJob(s *Server, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_ServicePath(t *testing.T) {
+	s, conn := createTestServer()
+
+	rec := postJob(s, EPOS_SERVICE_PATH+"?devid=local_printer&timeout=60000", testJob)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `success="true"`) {
+		t.Errorf("expected success response, got %s", rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) == 0 {
+		t.Error("expected the job to be sent to the printer")
+	}
+}
+
+func TestServer_RootPathStillServed(t *testing.T) {
+	s, conn := createTestServer()
+
+	rec := postJob(s, "/", testJob)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) == 0 {
+		t.Error("expected the job to be sent to the printer")
+	}
+}
+
+func TestServer_DeviceNotFound(t *testing.T) {
+	s, conn := createTestServer()
+
+	rec := postJob(s, EPOS_SERVICE_PATH+"?devid=kitchen_printer", testJob)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `success="false" code="DeviceNotFound"`) {
+		t.Errorf("expected DeviceNotFound response, got %s", rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) != 0 {
+		t.Errorf("expected nothing sent to the printer, got %d writes", len(conn.WriteRawCalls))
+	}
+}
+
+func TestServer_RequestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{"non-numeric timeout", EPOS_SERVICE_PATH + "?timeout=soon", testJob},
+		{"zero timeout", EPOS_SERVICE_PATH + "?timeout=0", testJob},
+		{"empty body", EPOS_SERVICE_PATH, ""},
+		{"malformed XML", EPOS_SERVICE_PATH, "<epos-print>"},
+	}
+
+	for _, tt := range tests {
+		s, conn := createTestServer()
+		rec := postJob(s, tt.target, tt.body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.name, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `code="SchemaError"`) {
+			t.Errorf("%s: expected SchemaError response, got %s", tt.name, rec.Body.String())
+		}
+		if len(conn.WriteRawCalls) != 0 {
+			t.Errorf("%s: expected nothing sent to the printer", tt.name)
+		}
+	}
+}
+
+func TestServer_Image(t *testing.T) {
+	s, conn := createTestServer()
+	body := encodePNG(t, image.NewGray(image.Rect(0, 0, 100, 50)))
+
+	req := httptest.NewRequest(http.MethodPost, "/image?dither=bayer&width=64&align=left&cut=true", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "image/png")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `success="true"`) {
+		t.Fatalf("expected success, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// 64x32 dots, left aligned on the 576 dot receipt, then a cut
+	expected := []byte{0x1d, 0x76, 0x30, 0x00, 72, 0, 32, 0}
+	var raster []byte
+	cut := false
+	for _, call := range conn.WriteRawCalls {
+		if bytes.HasPrefix(call, expected) {
+			raster = call[len(expected):]
+		}
+		cut = cut || (raster != nil && bytes.Equal(call, CUT_TYPE_CMDS[CutFeed]))
+	}
+	if raster == nil {
+		t.Fatalf("expected raster header %v, got %v", expected, conn.WriteRawCalls)
+	}
+	if !bytes.HasPrefix(raster, append(bytes.Repeat([]byte{0xff}, 8), 0)) {
+		t.Errorf("expected the black image on the left, got %v", raster[:72])
+	}
+	if !cut {
+		t.Errorf("expected a cut after the image")
+	}
+}
+
+func TestServer_ImageTooLargeToPrint(t *testing.T) {
+	s, conn := createTestServer()
+	s.current().printers.configs[DEFAULT_DEVID] = PrinterConfig{DevID: DEFAULT_DEVID, ReceiptWidth: 576}
+	body := encodePNG(t, image.NewGray(image.Rect(0, 0, 4, 100000)))
+
+	req := httptest.NewRequest(http.MethodPost, "/image", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "image/png")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `code="SchemaError"`) {
+		t.Errorf("expected 400 SchemaError, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) != 0 {
+		t.Errorf("expected nothing sent to the printer")
+	}
+}
+
+func TestServer_ImageErrors(t *testing.T) {
+	body := string(encodePNG(t, image.NewGray(image.Rect(0, 0, 8, 8))))
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+	}{
+		{"no content type", "/image", ""},
+		{"unsupported type", "/image", "image/gif"},
+		{"wrong type", "/image", "image/jpeg"},
+		{"bad dither", "/image?dither=halftone", "image/png"},
+		{"bad width", "/image?width=-1", "image/png"},
+		{"bad align", "/image?align=middle", "image/png"},
+		{"bad cut", "/image?cut=maybe", "image/png"},
+	}
+
+	for _, tt := range tests {
+		s, conn := createTestServer()
+		req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `code="SchemaError"`) {
+			t.Errorf("%s: expected 400 SchemaError, got %d: %s", tt.name, rec.Code, rec.Body.String())
+		}
+		if len(conn.WriteRawCalls) != 0 {
+			t.Errorf("%s: expected nothing sent to the printer", tt.name)
+		}
+	}
+}
+
+func TestServer_RawCommandsCheckedTogether(t *testing.T) {
+	conn := &MockWritable{}
+	printers := NewPrinterRegistry(DEFAULT_DEVID)
+	printers.Add(DEFAULT_DEVID, &Printer{connection_string: "/test", receipt_width: 576, connection: conn})
+	filter, err := NewCommandFilter("", DEFAULT_COMMAND_DENY)
+	if err != nil {
+		t.Fatalf("NewCommandFilter failed: %v", err)
+	}
+	s := NewServer(printers, nil, filter, DefaultConfig().Limits)
+
+	job := `<epos-print xmlns="http://www.epson-pos.com/schemas/2011/03/epos-print">` +
+		`<command>1c</command><command>71 01</command></epos-print>`
+	rec := postJob(s, EPOS_SERVICE_PATH, job)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for FS q split across elements, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) != 0 {
+		t.Errorf("expected nothing sent to the printer, got %d writes", len(conn.WriteRawCalls))
+	}
+}
+
+func TestServer_PrintFailure(t *testing.T) {
+	s, conn := createTestServer()
+	printer, _ := s.current().printers.Get("")
+	printer.SetRetryPolicy(RetryPolicy{Attempts: 1, Delay: Duration(time.Millisecond)})
+
+	// A printer that can be reopened but refuses the job fails it
+	conn.WriteRawError = errors.New("write refused")
+	rec := postJob(s, EPOS_SERVICE_PATH, testJob)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `code="EX_BADPORT"`) {
+		t.Errorf("expected EX_BADPORT response, got %s", rec.Body.String())
+	}
+
+	// An unplugged printer received nothing, so the job is spooled until
+	// its deadline instead
+	conn.OpenError = errors.New("device unplugged")
+	rec = postJob(s, EPOS_SERVICE_PATH+"?timeout=50", testJob)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `code="EX_TIMEOUT"`) {
+		t.Errorf("expected the spooled job to time out, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRunJob_DeadlineExceeded(t *testing.T) {
+	s, conn := createTestServer()
+	epos, err := Parse([]byte(testJob))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	printer, _ := s.current().printers.Get("")
+	err = runJob(ctx, printer, epos, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if len(conn.WriteRawCalls) != 0 {
+		t.Errorf("expected nothing sent to the printer, got %d writes", len(conn.WriteRawCalls))
+	}
+}
+
+func TestServer_SoapHeaderParameters(t *testing.T) {
+	envelope := func(devid string) string {
+		return `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><parameter>` +
+			`<devid>` + devid + `</devid><printjobid>job-42</printjobid></parameter></s:Header>` +
+			`<s:Body>` + testJob + `</s:Body></s:Envelope>`
+	}
+
+	s, conn := createTestServer()
+	rec := postJob(s, EPOS_SERVICE_PATH, envelope("local_printer"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `<printjobid>job-42</printjobid>`) {
+		t.Errorf("expected printjobid to be echoed, got %s", rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) == 0 {
+		t.Error("expected the job to be sent to the printer")
+	}
+
+	s, conn = createTestServer()
+	rec = postJob(s, EPOS_SERVICE_PATH, envelope("kitchen_printer"))
+	if !strings.Contains(rec.Body.String(), `code="DeviceNotFound"`) || !strings.Contains(rec.Body.String(), `<printjobid>job-42</printjobid>`) {
+		t.Errorf("expected DeviceNotFound with printjobid, got %s", rec.Body.String())
+	}
+	if len(conn.WriteRawCalls) != 0 {
+		t.Errorf("expected nothing sent to the printer, got %d writes", len(conn.WriteRawCalls))
+	}
+}
+
+func TestServer_BodyTooLarge(t *testing.T) {
+	s, conn := createTestServer()
+	s.current().limits.MaxBodyBytes = 16
+
+	rec := postJob(s, EPOS_SERVICE_PATH, testJob)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rec.Code)
+	}
+	if len(conn.WriteRawCalls) != 0 {
+		t.Errorf("expected nothing sent to the printer, got %d writes", len(conn.WriteRawCalls))
+	}
+}
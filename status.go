@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ePOS-Print status bits reported in the response "status" attribute
+const (
+	ASB_NO_RESPONSE        uint32 = 0x00000001
+	ASB_PRINT_SUCCESS      uint32 = 0x00000002
+	ASB_DRAWER_KICK        uint32 = 0x00000004
+	ASB_OFF_LINE           uint32 = 0x00000008
+	ASB_COVER_OPEN         uint32 = 0x00000020
+	ASB_PAPER_FEED         uint32 = 0x00000040
+	ASB_WAIT_ON_LINE       uint32 = 0x00000100
+	ASB_PANEL_SWITCH       uint32 = 0x00000200
+	ASB_MECHANICAL_ERR     uint32 = 0x00000400
+	ASB_AUTOCUTTER_ERR     uint32 = 0x00000800
+	ASB_UNRECOVER_ERR      uint32 = 0x00002000
+	ASB_AUTORECOVER_ERR    uint32 = 0x00004000
+	ASB_RECEIPT_NEAR_END   uint32 = 0x00020000
+	ASB_RECEIPT_END        uint32 = 0x00080000
+	ASB_SPOOLER_IS_STOPPED uint32 = 0x80000000
+)
+
+// ePOS-Print response codes
+const (
+	EPTR_AUTOMATICAL   = "EPTR_AUTOMATICAL"
+	EPTR_COVER_OPEN    = "EPTR_COVER_OPEN"
+	EPTR_CUTTER        = "EPTR_CUTTER"
+	EPTR_MECHANICAL    = "EPTR_MECHANICAL"
+	EPTR_REC_EMPTY     = "EPTR_REC_EMPTY"
+	EPTR_UNRECOVERABLE = "EPTR_UNRECOVERABLE"
+	EX_BADPORT         = "EX_BADPORT"
+	EX_TIMEOUT         = "EX_TIMEOUT"
+	DEVICE_NOT_FOUND   = "DeviceNotFound"
+	SCHEMA_ERROR       = "SchemaError"
+)
+
+// ASB_NO_RESPONSE_CODE reports a job that was sent in full but whose
+// printer did not answer the status query afterwards
+const ASB_NO_RESPONSE_CODE = "ASB_NO_RESPONSE"
+
+// DLE EOT n: transmit real-time status. n=1 printer, 2 offline cause,
+// 3 error cause, 4 roll paper sensor.
+var STATUS_QUERY_CMD = func(n byte) []byte {
+	return []byte{0x10, 0x04, n}
+}
+
+// DEFAULT_STATUS_TIMEOUT bounds each DLE EOT response read
+const DEFAULT_STATUS_TIMEOUT = 2 * time.Second
+
+// ErrStatusUnsupported is returned when the printer connection cannot read
+// responses, so no status is available.
+var ErrStatusUnsupported = errors.New("printer connection does not support status reads")
+
+// ErrStatusTimeout is returned when the printer does not answer a status
+// query in time.
+var ErrStatusTimeout = errors.New("printer did not respond to status query")
+
+type PrinterStatus struct {
+	DrawerKick         bool `json:"drawer_kick"`
+	Offline            bool `json:"offline"`
+	CoverOpen          bool `json:"cover_open"`
+	PaperFeed          bool `json:"paper_feed"`
+	WaitOnline         bool `json:"wait_online"`
+	PanelSwitch        bool `json:"panel_switch"`
+	MechanicalError    bool `json:"mechanical_error"`
+	AutoCutterError    bool `json:"autocutter_error"`
+	UnrecoverableError bool `json:"unrecoverable_error"`
+	AutoRecoverError   bool `json:"autorecover_error"`
+	ReceiptNearEnd     bool `json:"receipt_near_end"`
+	ReceiptEnd         bool `json:"receipt_end"`
+}
+
+// decodeRealtimeStatus decodes the four DLE EOT 1-4 response bytes
+func decodeRealtimeStatus(printer byte, offline byte, errCause byte, paper byte) PrinterStatus {
+	return PrinterStatus{
+		DrawerKick:         printer&0x04 != 0,
+		Offline:            printer&0x08 != 0,
+		WaitOnline:         printer&0x20 != 0,
+		PanelSwitch:        printer&0x40 != 0,
+		CoverOpen:          offline&0x04 != 0,
+		PaperFeed:          offline&0x08 != 0,
+		MechanicalError:    errCause&0x04 != 0,
+		AutoCutterError:    errCause&0x08 != 0,
+		UnrecoverableError: errCause&0x20 != 0,
+		AutoRecoverError:   errCause&0x40 != 0,
+		ReceiptNearEnd:     paper&0x0c != 0,
+		ReceiptEnd:         paper&0x60 != 0,
+	}
+}
+
+// isRealtimeStatusByte checks the fixed bits of a DLE EOT response: bit 1
+// and bit 4 are always set, bit 0 and bit 7 always clear.
+func isRealtimeStatusByte(b byte) bool {
+	return b&0x93 == 0x12
+}
+
+// ASB returns the ePOS-Print status bitfield for this status
+func (s PrinterStatus) ASB() uint32 {
+	var asb uint32
+	flags := []struct {
+		set bool
+		bit uint32
+	}{
+		{s.DrawerKick, ASB_DRAWER_KICK},
+		{s.Offline, ASB_OFF_LINE},
+		{s.CoverOpen, ASB_COVER_OPEN},
+		{s.PaperFeed, ASB_PAPER_FEED},
+		{s.WaitOnline, ASB_WAIT_ON_LINE},
+		{s.PanelSwitch, ASB_PANEL_SWITCH},
+		{s.MechanicalError, ASB_MECHANICAL_ERR},
+		{s.AutoCutterError, ASB_AUTOCUTTER_ERR},
+		{s.UnrecoverableError, ASB_UNRECOVER_ERR},
+		{s.AutoRecoverError, ASB_AUTORECOVER_ERR},
+		{s.ReceiptNearEnd, ASB_RECEIPT_NEAR_END},
+		{s.ReceiptEnd, ASB_RECEIPT_END},
+	}
+	for _, f := range flags {
+		if f.set {
+			asb |= f.bit
+		}
+	}
+	return asb
+}
+
+// Code returns the ePOS-Print error code for the most severe condition in
+// this status, or "" when the printer is able to print.
+func (s PrinterStatus) Code() string {
+	switch {
+	case s.CoverOpen:
+		return EPTR_COVER_OPEN
+	case s.ReceiptEnd:
+		return EPTR_REC_EMPTY
+	case s.AutoCutterError:
+		return EPTR_CUTTER
+	case s.MechanicalError:
+		return EPTR_MECHANICAL
+	case s.UnrecoverableError:
+		return EPTR_UNRECOVERABLE
+	case s.AutoRecoverError:
+		return EPTR_AUTOMATICAL
+	}
+	return ""
+}
+
+// LiveStatus queries the printer's status between jobs. A running job
+// reads its own status reply from the same connection, so querying at the
+// same time could take each other's reply bytes.
+func (p *Printer) LiveStatus() (PrinterStatus, error) {
+	p.jobs.Lock()
+	defer p.jobs.Unlock()
+	return p.QueryStatus()
+}
+
+// QueryStatus asks the printer for its real-time status with DLE EOT 1-4.
+// Returns ErrStatusUnsupported if the connection is write-only.
+func (p *Printer) QueryStatus() (PrinterStatus, error) {
+	log.Printf("[STATUS] Querying printer status: %s", p.connection_string)
+
+	// With ASB on, the background reader owns the connection's input, so a
+	// DLE EOT reply would be swallowed. Use the status it keeps instead.
+	if p.asbEnabled() {
+		status, err := p.waitCachedStatus(p.statusTimeout)
+		if err != nil {
+			log.Printf("[STATUS] ERROR: No ASB status received within %v", p.statusTimeout)
+			return PrinterStatus{}, err
+		}
+		log.Printf("[STATUS] Using ASB status: %+v (asb=0x%08x, code=%q)", status, status.ASB(), status.Code())
+		return status, nil
+	}
+
+	reader, ok := p.connection.(Readable)
+	if !ok {
+		log.Printf("[STATUS] Connection cannot read responses, status unavailable")
+		return PrinterStatus{}, ErrStatusUnsupported
+	}
+
+	var responses [4]byte
+	for i := range responses {
+		n := byte(i + 1)
+		if err := p.connection.WriteRaw(STATUS_QUERY_CMD(n)); err != nil {
+			log.Printf("[STATUS] ERROR: Failed to send DLE EOT %d: %v", n, err)
+			return PrinterStatus{}, fmt.Errorf("failed to send status query: %w", err)
+		}
+
+		buf := make([]byte, 1)
+		read, err := ReadFull(reader, buf, p.statusTimeout)
+		if errors.Is(err, ErrReadUnsupported) {
+			log.Printf("[STATUS] Connection cannot read responses, status unavailable")
+			return PrinterStatus{}, ErrStatusUnsupported
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("[STATUS] ERROR: Timed out waiting for DLE EOT %d response after %v", n, p.statusTimeout)
+			return PrinterStatus{}, ErrStatusTimeout
+		}
+		if err != nil {
+			log.Printf("[STATUS] ERROR: Failed to read DLE EOT %d response: %v", n, err)
+			return PrinterStatus{}, fmt.Errorf("failed to read status response: %w", err)
+		}
+		if read != 1 || !isRealtimeStatusByte(buf[0]) {
+			log.Printf("[STATUS] ERROR: Unexpected DLE EOT %d response: %x", n, buf[:read])
+			return PrinterStatus{}, fmt.Errorf("unexpected status response to DLE EOT %d: %x", n, buf[:read])
+		}
+		responses[i] = buf[0]
+	}
+
+	status := decodeRealtimeStatus(responses[0], responses[1], responses[2], responses[3])
+	log.Printf("[STATUS] Printer status: %+v (asb=0x%08x, code=%q)", status, status.ASB(), status.Code())
+	return status, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeRealtimeStatus_Idle(t *testing.T) {
+	// Fixed bits only: online, cover closed, no errors, paper present
+	status := decodeRealtimeStatus(0x12, 0x12, 0x12, 0x12)
+
+	if status != (PrinterStatus{}) {
+		t.Errorf("expected no conditions set, got %+v", status)
+	}
+	if status.ASB() != 0 {
+		t.Errorf("expected empty ASB, got 0x%08x", status.ASB())
+	}
+	if status.Code() != "" {
+		t.Errorf("expected empty code, got %q", status.Code())
+	}
+}
+
+func TestDecodeRealtimeStatus_Conditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytes    [4]byte
+		asb      uint32
+		code     string
+		expected PrinterStatus
+	}{
+		{
+			name:     "cover open while offline",
+			bytes:    [4]byte{0x1a, 0x16, 0x12, 0x12},
+			asb:      ASB_OFF_LINE | ASB_COVER_OPEN,
+			code:     EPTR_COVER_OPEN,
+			expected: PrinterStatus{Offline: true, CoverOpen: true},
+		},
+		{
+			name:     "paper end",
+			bytes:    [4]byte{0x1a, 0x32, 0x12, 0x72},
+			asb:      ASB_OFF_LINE | ASB_RECEIPT_END,
+			code:     EPTR_REC_EMPTY,
+			expected: PrinterStatus{Offline: true, ReceiptEnd: true},
+		},
+		{
+			name:     "near end only",
+			bytes:    [4]byte{0x12, 0x12, 0x12, 0x1e},
+			asb:      ASB_RECEIPT_NEAR_END,
+			code:     "",
+			expected: PrinterStatus{ReceiptNearEnd: true},
+		},
+		{
+			name:     "autocutter error",
+			bytes:    [4]byte{0x1a, 0x52, 0x1a, 0x12},
+			asb:      ASB_OFF_LINE | ASB_AUTOCUTTER_ERR,
+			code:     EPTR_CUTTER,
+			expected: PrinterStatus{Offline: true, AutoCutterError: true},
+		},
+		{
+			name:     "drawer pin high",
+			bytes:    [4]byte{0x16, 0x12, 0x12, 0x12},
+			asb:      ASB_DRAWER_KICK,
+			code:     "",
+			expected: PrinterStatus{DrawerKick: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := decodeRealtimeStatus(tt.bytes[0], tt.bytes[1], tt.bytes[2], tt.bytes[3])
+			if status != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, status)
+			}
+			if status.ASB() != tt.asb {
+				t.Errorf("expected ASB 0x%08x, got 0x%08x", tt.asb, status.ASB())
+			}
+			if status.Code() != tt.code {
+				t.Errorf("expected code %q, got %q", tt.code, status.Code())
+			}
+		})
+	}
+}
+
+func TestIsRealtimeStatusByte(t *testing.T) {
+	for _, b := range []byte{0x12, 0x16, 0x1a, 0x72} {
+		if !isRealtimeStatusByte(b) {
+			t.Errorf("expected 0x%02x to be a status byte", b)
+		}
+	}
+	for _, b := range []byte{0x00, 0x13, 0x92, 0x10} {
+		if isRealtimeStatusByte(b) {
+			t.Errorf("expected 0x%02x not to be a status byte", b)
+		}
+	}
+}
+
+func TestLiveStatus_WaitsForRunningJob(t *testing.T) {
+	conn := &FakeConnection{Respond: statusResponder([4]byte{0x16, 0x12, 0x12, 0x12})}
+	printer := createFakePrinter(conn)
+
+	// A job holds the printer while it reads its own status reply
+	printer.jobs.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := printer.LiveStatus()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.mu.Lock()
+	written := len(conn.Written)
+	conn.mu.Unlock()
+	if written != 0 {
+		t.Errorf("expected no status query while a job runs, got %x", conn.Written)
+	}
+	printer.jobs.Unlock()
+
+	if err := <-done; err != nil {
+		t.Errorf("LiveStatus failed: %v", err)
+	}
+}
+
+func TestJobResponse_WriteOnlyConnection(t *testing.T) {
+	printer := &Printer{
+		connection_string: "/test",
+		connection:        &MockWritable{},
+	}
+
+	resp := printer.JobResponse(nil)
+	if !resp.Success || resp.Code != "" || resp.Status != ASB_PRINT_SUCCESS {
+		t.Errorf("expected plain print success for write-only connection, got %+v", resp)
+	}
+}
+
+func TestJobResponse_JobFailed(t *testing.T) {
+	printer := &Printer{
+		connection_string: "/test",
+		connection:        &MockWritable{},
+	}
+
+	resp := printer.JobResponse(ErrStatusTimeout)
+	if resp.Success || resp.Code != EX_BADPORT || resp.Status != ASB_NO_RESPONSE {
+		t.Errorf("expected failed job response, got %+v", resp)
+	}
+}
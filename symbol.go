@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+type SymbolDecoded struct {
+	Type   string
+	Level  string
+	Width  int
+	Height int
+	Size   int
+	Data   []byte
+}
+
+type symbolFamily int
+
+const (
+	SymbolPDF417 symbolFamily = iota
+	SymbolQRCode
+	SymbolMaxiCode
+	SymbolDataMatrix
+)
+
+// GS ( k symbol selectors (cn) for each family
+var SYMBOL_FAMILY_CODES = map[symbolFamily]byte{
+	SymbolPDF417:     0x30,
+	SymbolQRCode:     0x31,
+	SymbolMaxiCode:   0x32,
+	SymbolDataMatrix: 0x36,
+}
+
+var symbolTypes = map[string]symbolFamily{
+	"pdf417_standard":         SymbolPDF417,
+	"pdf417_truncated":        SymbolPDF417,
+	"qrcode_model_1":          SymbolQRCode,
+	"qrcode_model_2":          SymbolQRCode,
+	"qrcode_micro":            SymbolQRCode,
+	"maxicode_mode_2":         SymbolMaxiCode,
+	"maxicode_mode_3":         SymbolMaxiCode,
+	"maxicode_mode_4":         SymbolMaxiCode,
+	"maxicode_mode_5":         SymbolMaxiCode,
+	"maxicode_mode_6":         SymbolMaxiCode,
+	"datamatrix_square":       SymbolDataMatrix,
+	"datamatrix_rectangle_8":  SymbolDataMatrix,
+	"datamatrix_rectangle_12": SymbolDataMatrix,
+	"datamatrix_rectangle_16": SymbolDataMatrix,
+}
+
+var symbolLevels = map[symbolFamily][]string{
+	SymbolPDF417:     {"default", "level_0", "level_1", "level_2", "level_3", "level_4", "level_5", "level_6", "level_7", "level_8"},
+	SymbolQRCode:     {"default", "level_l", "level_m", "level_q", "level_h"},
+	SymbolMaxiCode:   {"default"},
+	SymbolDataMatrix: {"default"},
+}
+
+// symbolWidthRanges are the module width limits accepted by each family
+var symbolWidthRanges = map[symbolFamily][2]int{
+	SymbolPDF417:     {2, 8},
+	SymbolQRCode:     {1, 16},
+	SymbolMaxiCode:   {0, 255},
+	SymbolDataMatrix: {2, 16},
+}
+
+var QR_MODEL_CODES = map[string]byte{
+	"qrcode_model_1": 49,
+	"qrcode_model_2": 50,
+	"qrcode_micro":   51,
+}
+
+var QR_LEVEL_CODES = map[string]byte{
+	"level_l": 48,
+	"level_m": 49,
+	"level_q": 50,
+	"level_h": 51,
+}
+
+var MAXICODE_MODE_CODES = map[string]byte{
+	"maxicode_mode_2": 50,
+	"maxicode_mode_3": 51,
+	"maxicode_mode_4": 52,
+	"maxicode_mode_5": 53,
+	"maxicode_mode_6": 54,
+}
+
+var DATAMATRIX_ROW_CODES = map[string]byte{
+	"datamatrix_square":       0,
+	"datamatrix_rectangle_8":  8,
+	"datamatrix_rectangle_12": 12,
+	"datamatrix_rectangle_16": 16,
+}
+
+// maxSymbolData is the largest payload GS ( k function 80 can carry
+const maxSymbolData = 0xffff - 3
+
+// parseSymbolAttrs reads the attributes of a <symbol> element, filling in
+// the ePOS-Print defaults for any that are missing.
+func parseSymbolAttrs(attrs []xml.Attr) (*SymbolDecoded, error) {
+	symbol := &SymbolDecoded{
+		Level:  "default",
+		Width:  3,
+		Height: 3,
+		Size:   0,
+	}
+
+	for _, attr := range attrs {
+		if attr.Name.Local == "type" {
+			if _, ok := symbolTypes[attr.Value]; !ok {
+				return nil, fmt.Errorf("unsupported symbol type %q", attr.Value)
+			}
+			symbol.Type = attr.Value
+		}
+	}
+	if symbol.Type == "" {
+		return nil, fmt.Errorf("symbol element is missing the type attribute")
+	}
+	family := symbolTypes[symbol.Type]
+
+	var err error
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "level":
+			symbol.Level, err = parseEnumAttr("symbol", attr, symbolLevels[family]...)
+		case "width":
+			widthRange := symbolWidthRanges[family]
+			symbol.Width, err = parseIntAttr("symbol", attr, widthRange[0], widthRange[1])
+		case "height":
+			symbol.Height, err = parseIntAttr("symbol", attr, 0, 8)
+		case "size":
+			symbol.Size, err = parseIntAttr("symbol", attr, 0, 30)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if family == SymbolPDF417 && symbol.Height < 2 {
+		return nil, fmt.Errorf("invalid symbol attribute height=%d: PDF417 row height must be from 2 to 8", symbol.Height)
+	}
+
+	return symbol, nil
+}
+
+func setSymbolData(symbol *SymbolDecoded, data string) error {
+	if data == "" {
+		return fmt.Errorf("invalid %s symbol: data must not be empty", symbol.Type)
+	}
+	if len(data) > maxSymbolData {
+		return fmt.Errorf("invalid %s symbol: data too long (%d bytes, max %d)", symbol.Type, len(data), maxSymbolData)
+	}
+	symbol.Data = []byte(data)
+	return nil
+}
+
+// symbolFunction builds one GS ( k function: GS ( k pL pH cn fn [params]
+func symbolFunction(cn byte, fn byte, params ...byte) []byte {
+	p := len(params) + 2
+	buf := []byte{0x1d, 0x28, 0x6b, byte(p & 0xff), byte((p >> 8) & 0xff), cn, fn}
+	return append(buf, params...)
+}
+
+// symbolCommands builds the full GS ( k sequence for a symbol: configure the
+// symbology, store the data in the symbol save area and print it.
+func symbolCommands(symbol *SymbolDecoded) []byte {
+	family := symbolTypes[symbol.Type]
+	cn := SYMBOL_FAMILY_CODES[family]
+	buf := []byte{}
+
+	switch family {
+	case SymbolQRCode:
+		buf = append(buf, symbolFunction(cn, 0x41, QR_MODEL_CODES[symbol.Type], 0)...)
+		buf = append(buf, symbolFunction(cn, 0x43, byte(symbol.Width))...)
+		if code, ok := QR_LEVEL_CODES[symbol.Level]; ok {
+			buf = append(buf, symbolFunction(cn, 0x45, code)...)
+		}
+	case SymbolPDF417:
+		buf = append(buf, symbolFunction(cn, 0x41, byte(symbol.Size))...)
+		buf = append(buf, symbolFunction(cn, 0x42, 0)...)
+		buf = append(buf, symbolFunction(cn, 0x43, byte(symbol.Width))...)
+		buf = append(buf, symbolFunction(cn, 0x44, byte(symbol.Height))...)
+		if symbol.Level != "default" {
+			level := symbol.Level[len("level_")] - '0'
+			buf = append(buf, symbolFunction(cn, 0x45, 0x30, 0x30+level)...)
+		}
+		truncated := byte(0)
+		if symbol.Type == "pdf417_truncated" {
+			truncated = 1
+		}
+		buf = append(buf, symbolFunction(cn, 0x46, truncated)...)
+	case SymbolMaxiCode:
+		buf = append(buf, symbolFunction(cn, 0x41, MAXICODE_MODE_CODES[symbol.Type])...)
+	case SymbolDataMatrix:
+		shape := byte(0)
+		if symbol.Type != "datamatrix_square" {
+			shape = 1
+		}
+		buf = append(buf, symbolFunction(cn, 0x42, shape, 0, DATAMATRIX_ROW_CODES[symbol.Type])...)
+		buf = append(buf, symbolFunction(cn, 0x43, byte(symbol.Width))...)
+	}
+
+	buf = append(buf, symbolFunction(cn, 0x50, append([]byte{0x30}, symbol.Data...)...)...)
+	buf = append(buf, symbolFunction(cn, 0x51, 0x30)...)
+	return buf
+}
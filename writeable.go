@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 type Writable interface {
@@ -16,6 +17,58 @@ type Writable interface {
 	Close() error
 }
 
+// Readable is implemented by connections that can read the printer's
+// responses. ReadRaw blocks until data arrives or the timeout expires, in
+// which case the error wraps os.ErrDeadlineExceeded.
+type Readable interface {
+	ReadRaw(buf []byte, timeout time.Duration) (int, error)
+}
+
+// ErrReadUnsupported is returned by ReadRaw when the underlying device
+// cannot be read with a deadline (for example a plain file standing in for
+// a printer), so a read could block forever.
+var ErrReadUnsupported = errors.New("connection does not support reads with a deadline")
+
+// TCP_DIAL_TIMEOUT bounds a connection attempt, so an unreachable printer
+// is noticed quickly instead of after the system's TCP timeout
+const TCP_DIAL_TIMEOUT = 5 * time.Second
+
+// deadlineReader is satisfied by *os.File and net.Conn
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadFull reads exactly len(buf) bytes from r, failing if they do not all
+// arrive before the timeout.
+func ReadFull(r Readable, buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	total := 0
+	for total < len(buf) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return total, fmt.Errorf("read %d/%d bytes: %w", total, len(buf), os.ErrDeadlineExceeded)
+		}
+		n, err := r.ReadRaw(buf[total:], remaining)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// readWithDeadline performs one read from a device that supports deadlines
+func readWithDeadline(dr deadlineReader, buf []byte, timeout time.Duration) (int, error) {
+	if err := dr.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		if errors.Is(err, os.ErrNoDeadline) {
+			return 0, ErrReadUnsupported
+		}
+		return 0, err
+	}
+	return dr.Read(buf)
+}
+
 type UsbWriter struct {
 	mu     sync.Mutex
 	path   string
@@ -48,6 +101,34 @@ func (u *UsbWriter) WriteRaw(data []byte) error {
 	return nil
 }
 
+func (u *UsbWriter) ReadRaw(buf []byte, timeout time.Duration) (int, error) {
+	// Only hold the lock long enough to grab the device so a slow read
+	// does not block writers.
+	u.mu.Lock()
+	writer := u.writer
+	u.mu.Unlock()
+
+	if writer == nil {
+		log.Printf("[USB] ERROR: Read attempted but no active connection to: %s", u.path)
+		return 0, errors.New("No active connection. Reconnect")
+	}
+
+	dr, ok := writer.(deadlineReader)
+	if !ok {
+		log.Printf("[USB] ERROR: USB device %s cannot be read from", u.path)
+		return 0, ErrReadUnsupported
+	}
+
+	n, err := readWithDeadline(dr, buf, timeout)
+	if err != nil {
+		log.Printf("[USB] ERROR: Read failed from %s: %v (read %d bytes)", u.path, err, n)
+		return n, err
+	}
+
+	log.Printf("[USB] Read successful: %d bytes from %s", n, u.path)
+	return n, nil
+}
+
 func (u *UsbWriter) Open() error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -112,6 +193,28 @@ func (t *TcpWriter) WriteRaw(data []byte) error {
 	return nil
 }
 
+func (t *TcpWriter) ReadRaw(buf []byte, timeout time.Duration) (int, error) {
+	// Only hold the lock long enough to grab the connection so a slow read
+	// does not block writers.
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+
+	if conn == nil {
+		log.Printf("[TCP] ERROR: Read attempted but no active connection to: %s", t.address)
+		return 0, errors.New("No active connection. Reconnect")
+	}
+
+	n, err := readWithDeadline(conn, buf, timeout)
+	if err != nil {
+		log.Printf("[TCP] ERROR: Read failed from %s: %v (read %d bytes)", t.address, err, n)
+		return n, err
+	}
+
+	log.Printf("[TCP] Read successful: %d bytes from %s", n, t.address)
+	return n, nil
+}
+
 func (t *TcpWriter) Open() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -122,7 +225,7 @@ func (t *TcpWriter) Open() error {
 	}
 
 	log.Printf("[TCP] Opening TCP connection to: %s", t.address)
-	conn, err := net.Dial("tcp", t.address)
+	conn, err := net.DialTimeout("tcp", t.address, TCP_DIAL_TIMEOUT)
 	if err != nil {
 		log.Printf("[TCP] ERROR: Failed to dial %s: %v", t.address, err)
 		return fmt.Errorf("failed to dial %s: %w", t.address, err)